@@ -0,0 +1,132 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// commandName returns the program invoked by a history line
+func commandName(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// cryptoSource is a rand.Source reading from crypto/rand. Noise from a
+// time-seeded generator can be replayed by anyone who can guess the seed,
+// which would let them subtract it from the released counts.
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	_, err := crand.Read(b[:])
+	if err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (cryptoSource) Seed(int64) {}
+
+// laplaceNoise draws from a Laplace(0, scale) distribution
+func laplaceNoise(rng *rand.Rand, scale float64) float64 {
+	// u comes from the open interval (-0.5, 0.5), -0.5 would take the log of 0
+	u := rng.Float64() - 0.5
+	for u == -0.5 {
+		u = rng.Float64() - 0.5
+	}
+	sign := 1.0
+	if u < 0 {
+		sign = -1.0
+	}
+	return -scale * sign * math.Log(1-2*math.Abs(u))
+}
+
+// releaseThreshold is the noisy count a command needs before its name is
+// released. Command names aren't known in advance, so a name seen only once
+// would give itself away; with Laplace noise of scale 1/epsilon, suppressing
+// noisy counts below 1 + ln(1/(2 delta))/epsilon makes the release
+// (epsilon, delta) differentially private.
+func releaseThreshold(epsilon, delta float64) float64 {
+	return 1 + math.Log(1/(2*delta))/epsilon
+}
+
+// privateCommandCounts counts command usage over a random sample of lines,
+// one line per time a command was run, and perturbs each count with Laplace
+// noise calibrated to epsilon. Only commands whose noisy count reaches
+// releaseThreshold are returned, so the result is (epsilon, delta)
+// differentially private with respect to any single command run.
+func privateCommandCounts(lines []string, sampleRate, epsilon, delta float64, rng *rand.Rand) map[string]int {
+	counts := make(map[string]int)
+	for _, line := range lines {
+		if rng.Float64() >= sampleRate {
+			continue
+		}
+		name := commandName(line)
+		if name == "" {
+			continue
+		}
+		counts[name]++
+	}
+
+	// Each history line contributes to exactly one count, so sensitivity is 1
+	scale := 1 / epsilon
+	threshold := releaseThreshold(epsilon, delta)
+	noisy := make(map[string]int)
+	for name, count := range counts {
+		value := float64(count) + laplaceNoise(rng, scale)
+		if value < threshold {
+			continue
+		}
+		noisy[name] = int(math.Round(value / sampleRate))
+	}
+
+	return noisy
+}
+
+func exportAnalytics(w io.Writer, lines []string, sampleRate, epsilon, delta float64) error {
+	if epsilon <= 0 {
+		return fmt.Errorf("epsilon must be positive, got %v", epsilon)
+	}
+	if delta <= 0 || delta >= 0.5 {
+		return fmt.Errorf("delta must be in (0, 0.5), got %v", delta)
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return fmt.Errorf("sample rate must be in (0, 1], got %v", sampleRate)
+	}
+
+	rng := rand.New(cryptoSource{})
+	counts := privateCommandCounts(lines, sampleRate, epsilon, delta, rng)
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		_, err := fmt.Fprintf(w, "%d\t%s\n", counts[name], name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// archivePrefix starts the name of every archive this tool creates, so
+// retention never touches archives made by hand
+const archivePrefix = "tarsnap-history-"
+
+// archiveDataDir snapshots dataDir after a run, either as a compressed tar
+// file in archiveDir or with the tarsnap client, and keeps the newest keep
+// archives. kind is "tar", "tarsnap" or empty to do nothing.
+func archiveDataDir(cmdRunner runner.Runner, kind, dataDir, archiveDir string, keep int) error {
+	if kind == "" {
+		return nil
+	}
+
+	absDataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return err
+	}
+	name := archivePrefix + time.Now().Format("20060102_150405")
+
+	switch kind {
+	case "tar":
+		err = os.MkdirAll(archiveDir, 0o700)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(archiveDir, name+".tar.gz")
+		err = runArchiveCommand(cmdRunner, "tar", "-czf", file, "-C", filepath.Dir(absDataDir), filepath.Base(absDataDir))
+		if err != nil {
+			return err
+		}
+		// tar creates the archive with the umask's permissions
+		err = os.Chmod(file, 0o600)
+		if err != nil {
+			return err
+		}
+		slog.Info("Archived data directory", "path", file)
+		return pruneTarArchives(archiveDir, keep)
+	case "tarsnap":
+		err = runArchiveCommand(cmdRunner, "tarsnap", "-c", "-f", name, "-C", filepath.Dir(absDataDir), filepath.Base(absDataDir))
+		if err != nil {
+			return err
+		}
+		slog.Info("Archived data directory", "archive", name)
+		return pruneTarsnapArchives(cmdRunner, keep)
+	default:
+		return fmt.Errorf("unknown archive kind %q, want tar or tarsnap", kind)
+	}
+}
+
+func runArchiveCommand(cmdRunner runner.Runner, name string, args ...string) error {
+	slog.Debug("Executing command", "cmd", name+" "+strings.Join(args, " "))
+	out, err := runner.Combined(cmdRunner, name, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// oldArchives returns the names beyond the newest keep. Names embed their
+// timestamp, so sorting them sorts by age.
+func oldArchives(names []string, keep int) []string {
+	if keep <= 0 || len(names) <= keep {
+		return nil
+	}
+	sort.Strings(names)
+	return names[:len(names)-keep]
+}
+
+func pruneTarArchives(archiveDir string, keep int) error {
+	files, err := filepath.Glob(filepath.Join(archiveDir, archivePrefix+"*.tar.gz"))
+	if err != nil {
+		return err
+	}
+	for _, file := range oldArchives(files, keep) {
+		err = os.Remove(file)
+		if err != nil {
+			return err
+		}
+		slog.Info("Removed old archive", "path", file)
+	}
+	return nil
+}
+
+func pruneTarsnapArchives(cmdRunner runner.Runner, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	slog.Debug("Executing command", "cmd", "tarsnap --list-archives")
+	out, err := runner.Output(cmdRunner, "tarsnap", "--list-archives")
+	if err != nil {
+		return fmt.Errorf("tarsnap --list-archives: %w", err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, archivePrefix) {
+			names = append(names, line)
+		}
+	}
+
+	for _, name := range oldArchives(names, keep) {
+		err = runArchiveCommand(cmdRunner, "tarsnap", "-d", "-f", name)
+		if err != nil {
+			return err
+		}
+		slog.Info("Removed old archive", "archive", name)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// Artifact is an extra remote file collected alongside .bash_history. Its
+// snapshots go to their own subdirectory, named after it, of the user's
+// directory.
+type Artifact struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+
+	// Parser is bash, zsh or fish for shell histories, which are stored as
+	// history snapshots and summarized with the rest, or raw for anything
+	// else, which is stored untouched
+	Parser string `yaml:"parser"`
+}
+
+// artifactList is a flag.Value collecting one name=path artifact per use of
+// the flag. The parser is guessed from the name and path.
+type artifactList []Artifact
+
+func (l *artifactList) String() string {
+	var parts []string
+	for _, a := range *l {
+		parts = append(parts, a.Name+"="+a.Path)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *artifactList) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("invalid artifact %q, want name=path", value)
+	}
+	// The command line is parsed twice, around the config file
+	for _, a := range *l {
+		if a.Name == name && a.Path == path {
+			return nil
+		}
+	}
+	*l = append(*l, Artifact{Name: name, Path: path, Parser: guessParser(name, path)})
+	return nil
+}
+
+func guessParser(name, path string) string {
+	for _, shell := range []string{"fish", "zsh", "bash"} {
+		if strings.Contains(name, shell) || strings.Contains(filepath.Base(path), shell) {
+			return shell
+		}
+	}
+	return "raw"
+}
+
+func (a Artifact) validate() error {
+	if a.Name == "" || a.Path == "" {
+		return fmt.Errorf("artifact %q needs a name and a path", a.Name)
+	}
+	if a.Name != filepath.Base(a.Name) || a.Name == "." || a.Name == ".." {
+		return fmt.Errorf("artifact name %q must not contain a path", a.Name)
+	}
+	switch a.Parser {
+	case "", "bash", "zsh", "fish", "raw":
+		return nil
+	default:
+		return fmt.Errorf("unknown parser %q for artifact %s, want bash, zsh, fish or raw", a.Parser, a.Name)
+	}
+}
+
+// isShellHistory reports whether the artifact is parsed into history lines
+func (a Artifact) isShellHistory() bool {
+	return a.Parser != "" && a.Parser != "raw"
+}
+
+// localFile is where a snapshot of the artifact taken now is stored. Shell
+// histories are named like bash_history snapshots so summaries, search and
+// pruning pick them up.
+func (a Artifact) localFile(userDir, host string, now time.Time) string {
+	prefix := a.Name
+	if a.isShellHistory() {
+		prefix = "bash_history"
+	}
+	return filepath.Join(userDir, a.Name, fmt.Sprintf("%s_%s_%s.txt", prefix, schedule.SanitizeHost(host), now.Format("20060102_150405")))
+}
+
+// parse rewrites a freshly fetched artifact into history lines. bash and
+// zsh lines are already understood by history.ParseLine.
+func (a Artifact) parse(path string) error {
+	if a.Parser != "fish" {
+		return nil
+	}
+	return convertFishSnapshot(path)
+}
+
+// convertFishSnapshot rewrites the fish history at path as history lines
+func convertFishSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, history.ConvertFish(data), 0o600)
+}
+
+// artifactsFor returns the artifacts collected from host: the global ones
+// followed by the host's own
+func (c Config) artifactsFor(host string) []Artifact {
+	artifacts := append([]Artifact{}, c.Artifacts...)
+	if hc, ok := c.PerHost[host]; ok {
+		artifacts = append(artifacts, hc.Artifacts...)
+	}
+	return artifacts
+}
+
+// fetchArtifacts collects every artifact of host for user. A missing
+// artifact is common, such as a zsh history on a host where nobody uses
+// zsh, so failures are logged and the rest are still fetched.
+func fetchArtifacts(remote fetch.Remote, user, host, userDir string, config Config, filter commandFilter) []string {
+	var paths []string
+	for _, a := range config.artifactsFor(host) {
+		localFile := a.localFile(userDir, host, time.Now())
+		path, err := fetch.File(remote, user, host, a.Path, localFile, config.RemoteOS, config.collectFor(host))
+		if err == nil && !config.DryRun {
+			err = a.parse(path)
+		}
+		if err == nil && !config.DryRun && a.isShellHistory() {
+			err = quarantineSnapshot(path, user+"@"+host)
+		}
+		if err == nil && !config.DryRun && a.isShellHistory() {
+			err = filterSnapshot(path, filter)
+		}
+		if err == nil && !config.DryRun {
+			path, err = history.Compress(path, config.Compress)
+		}
+		if err == nil && !config.DryRun {
+			path, err = history.Encrypt(path)
+		}
+		if err != nil {
+			slog.Warn("Failed to fetch artifact", "artifact", a.Name, "host", host, "user", user, "err", err)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// fuzzyScore reports whether every rune of query appears in s in order,
+// ignoring case, and scores the match: consecutive runs and matches at word
+// starts score higher, and an empty query matches everything with score 0
+func fuzzyScore(query, s string) (int, bool) {
+	q := []rune(strings.ToLower(query))
+	if len(q) == 0 {
+		return 0, true
+	}
+
+	score, qi, prevMatch := 0, 0, -2
+	runes := []rune(strings.ToLower(s))
+	for i, r := range runes {
+		if qi == len(q) {
+			break
+		}
+		if r != q[qi] {
+			continue
+		}
+		score++
+		if i == prevMatch+1 {
+			score += 2
+		}
+		if i == 0 || !unicode.IsLetter(runes[i-1]) && !unicode.IsDigit(runes[i-1]) {
+			score += 3
+		}
+		prevMatch = i
+		qi++
+	}
+	if qi < len(q) {
+		return 0, false
+	}
+	return score, true
+}
+
+// copyToClipboard hands text to the platform's clipboard tool
+func copyToClipboard(text string) error {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip"}}
+	default:
+		candidates = [][]string{{"wl-copy"}, {"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}}
+	}
+
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		_, err := runner.Exec{}.Run(runner.Command{Name: c[0], Args: c[1:], Stdin: strings.NewReader(text)})
+		return err
+	}
+	return errors.New("no clipboard tool found")
+}
+
+// browser is the state of an interactive `tarsnap browse` session
+type browser struct {
+	config  Config
+	host    string
+	since   time.Time
+	until   time.Time
+	limit   int
+	entries []history.Entry
+	matches []history.Entry
+}
+
+// load reads the unique commands for the current host filter
+func (b *browser) load() error {
+	config := b.config
+	config.Host = b.host
+	keep, err := historyFilter(config)
+	if err != nil {
+		return err
+	}
+	b.entries, err = history.UniqueEntries(config.DataDir, keep)
+	return err
+}
+
+// search fills b.matches with the entries matching query inside the date
+// range, best match first
+func (b *browser) search(query string) {
+	type scored struct {
+		entry history.Entry
+		score int
+	}
+	var found []scored
+	for _, e := range b.entries {
+		if !b.since.IsZero() && e.Timestamp.Before(b.since) {
+			continue
+		}
+		if !b.until.IsZero() && e.Timestamp.After(b.until) {
+			continue
+		}
+		if score, ok := fuzzyScore(query, e.Command); ok {
+			found = append(found, scored{e, score})
+		}
+	}
+
+	// Newest first among equally good matches
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score > found[j].score
+		}
+		return found[i].entry.Timestamp.After(found[j].entry.Timestamp)
+	})
+
+	b.matches = b.matches[:0]
+	for _, f := range found {
+		b.matches = append(b.matches, f.entry)
+	}
+}
+
+func (b *browser) show(w io.Writer) {
+	for i, e := range b.matches {
+		if i >= b.limit {
+			fmt.Fprintf(w, "  ... %d more, refine the search\n", len(b.matches)-b.limit)
+			break
+		}
+		when := "unknown   "
+		if !e.Timestamp.IsZero() {
+			when = e.Timestamp.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%3d  %s  %s\n", i+1, when, e.Command)
+	}
+	if len(b.matches) == 0 {
+		fmt.Fprintln(w, "  no matches")
+	}
+}
+
+const browseHelp = `Type text to fuzzy-search, or:
+  <number>       copy that result to the clipboard
+  :host [HOST]   only show commands from HOST, or every host
+  :since [TIME]  only show commands first run at or after TIME
+  :until [TIME]  only show commands first run at or before TIME
+  :q             quit
+`
+
+// command handles a ":" line and reports whether the session should end
+func (b *browser) command(w io.Writer, line string) (bool, error) {
+	name, arg, _ := strings.Cut(strings.TrimPrefix(line, ":"), " ")
+	arg = strings.TrimSpace(arg)
+
+	var err error
+	switch name {
+	case "q", "quit":
+		return true, nil
+	case "host":
+		b.host = arg
+		err = b.load()
+	case "since", "until":
+		var t time.Time
+		if arg != "" {
+			t, err = parseTimeArg(arg)
+			if err != nil {
+				return false, err
+			}
+		}
+		if name == "since" {
+			b.since = t
+		} else {
+			b.until = t
+		}
+	default:
+		fmt.Fprint(w, browseHelp)
+	}
+	return false, err
+}
+
+// readKey reads one keypress from a raw terminal: a printable rune, or
+// the name of a control key
+func readKey(in *bufio.Reader) (rune, string, error) {
+	r, _, err := in.ReadRune()
+	if err != nil {
+		return 0, "", err
+	}
+	switch r {
+	case '\r', '\n':
+		return 0, "enter", nil
+	case 127, 8:
+		return 0, "backspace", nil
+	case 3, 4:
+		return 0, "quit", nil
+	case 14:
+		return 0, "down", nil
+	case 16:
+		return 0, "up", nil
+	case 21:
+		return 0, "clear", nil
+	case 27:
+		// A lone escape quits; arrow and paging keys arrive as one
+		// "ESC [ x" or "ESC O x" sequence
+		if in.Buffered() == 0 {
+			return 0, "quit", nil
+		}
+		next, _, _ := in.ReadRune()
+		if next != '[' && next != 'O' {
+			return 0, "", nil
+		}
+		code, _, _ := in.ReadRune()
+		switch code {
+		case 'A':
+			return 0, "up", nil
+		case 'B':
+			return 0, "down", nil
+		case '5', '6':
+			in.ReadRune() // the trailing '~'
+			if code == '5' {
+				return 0, "pgup", nil
+			}
+			return 0, "pgdn", nil
+		}
+		return 0, "", nil
+	}
+	if unicode.IsControl(r) {
+		return 0, "", nil
+	}
+	return r, "", nil
+}
+
+// printable replaces control characters, which would otherwise drive the
+// terminal, and cuts s to width runes
+func printable(s string, width int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n >= width {
+			break
+		}
+		if unicode.IsControl(r) {
+			r = '?'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// screen is the full-screen view of a browse session
+type screen struct {
+	b        *browser
+	query    string
+	selected int
+	top      int
+	status   string
+}
+
+// orNone shows an unset filter
+func orNone(s string) string {
+	if s == "" {
+		return "any"
+	}
+	return s
+}
+
+func (s *screen) render(w io.Writer) {
+	rows, cols := terminalSize()
+	list := rows - 3
+	if list < 1 {
+		list = 1
+	}
+	if s.selected < s.top {
+		s.top = s.selected
+	}
+	if s.selected >= s.top+list {
+		s.top = s.selected - list + 1
+	}
+
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J")
+	out.WriteString(printable("> "+s.query, cols) + "\r\n")
+
+	since, until := "", ""
+	if !s.b.since.IsZero() {
+		since = s.b.since.Format("2006-01-02 15:04")
+	}
+	if !s.b.until.IsZero() {
+		until = s.b.until.Format("2006-01-02 15:04")
+	}
+	filters := fmt.Sprintf("%d/%d  host: %s  since: %s  until: %s", len(s.b.matches), len(s.b.entries), orNone(s.b.host), orNone(since), orNone(until))
+	out.WriteString("\x1b[2m" + printable(filters, cols) + "\x1b[0m\r\n")
+
+	for i := s.top; i < len(s.b.matches) && i < s.top+list; i++ {
+		e := s.b.matches[i]
+		when := "unknown   "
+		if !e.Timestamp.IsZero() {
+			when = e.Timestamp.Format("2006-01-02")
+		}
+		line := printable(when+"  "+e.Command, cols)
+		if i == s.selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		out.WriteString(line + "\r\n")
+	}
+
+	status := s.status
+	if status == "" {
+		status = "up/down move  enter copy  :host :since :until filter  esc quit"
+	}
+	fmt.Fprintf(&out, "\x1b[%d;1H\x1b[2m%s\x1b[0m", rows, printable(status, cols))
+	fmt.Fprintf(&out, "\x1b[1;%dH", len([]rune(printable("> "+s.query, cols)))+1)
+	io.WriteString(w, out.String())
+}
+
+// enter runs a ":" query as a command or copies the selected match
+func (s *screen) enter() bool {
+	if strings.HasPrefix(s.query, ":") {
+		var help strings.Builder
+		quit, err := s.b.command(&help, s.query)
+		switch {
+		case quit:
+			return true
+		case err != nil:
+			s.status = err.Error()
+		case help.Len() > 0:
+			s.status = "unknown command; try :host [HOST], :since [TIME], :until [TIME] or :q"
+		default:
+			s.status = ""
+		}
+		s.query = ""
+		s.b.search("")
+		s.selected = 0
+		return false
+	}
+
+	if s.selected >= len(s.b.matches) {
+		return false
+	}
+	command := s.b.matches[s.selected].Command
+	err := copyToClipboard(command)
+	if err != nil {
+		s.status = err.Error()
+		return false
+	}
+	s.status = "copied: " + command
+	return false
+}
+
+// run drives the screen from keypresses until the user quits
+func (s *screen) run(in *bufio.Reader, w io.Writer) error {
+	s.b.search("")
+	for {
+		s.render(w)
+		r, name, err := readKey(in)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		edited := false
+		switch name {
+		case "quit":
+			return nil
+		case "enter":
+			if s.enter() {
+				return nil
+			}
+			continue
+		case "up":
+			if s.selected > 0 {
+				s.selected--
+			}
+		case "down":
+			if s.selected < len(s.b.matches)-1 {
+				s.selected++
+			}
+		case "pgup", "pgdn":
+			rows, _ := terminalSize()
+			page := rows - 3
+			if name == "pgup" {
+				s.selected = max(s.selected-page, 0)
+			} else {
+				s.selected = max(min(s.selected+page, len(s.b.matches)-1), 0)
+			}
+		case "backspace":
+			if q := []rune(s.query); len(q) > 0 {
+				s.query = string(q[:len(q)-1])
+				edited = true
+			}
+		case "clear":
+			s.query = ""
+			edited = true
+		case "":
+			if r != 0 {
+				s.query += string(r)
+				edited = true
+			}
+		}
+
+		if edited {
+			s.status = ""
+			if !strings.HasPrefix(s.query, ":") {
+				s.b.search(s.query)
+				s.selected, s.top = 0, 0
+			}
+		}
+	}
+}
+
+// prompt runs a line-based session, for when stdin is not a terminal that
+// can be put in raw mode
+func (b *browser) prompt() error {
+	fmt.Printf("%d unique commands. ", len(b.entries))
+	fmt.Print(browseHelp)
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !in.Scan() {
+			fmt.Println()
+			return in.Err()
+		}
+		line := strings.TrimSpace(in.Text())
+
+		if n, err := strconv.Atoi(line); err == nil && len(b.matches) > 0 {
+			if n < 1 || n > len(b.matches) || n > b.limit {
+				fmt.Println("  no such result")
+				continue
+			}
+			err = copyToClipboard(b.matches[n-1].Command)
+			if err != nil {
+				fmt.Printf("  %v; the command is:\n%s\n", err, b.matches[n-1].Command)
+				continue
+			}
+			fmt.Println("  copied:", b.matches[n-1].Command)
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			quit, err := b.command(os.Stdout, line)
+			if err != nil {
+				fmt.Println(" ", err)
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+
+		b.search(line)
+		b.show(os.Stdout)
+	}
+}
+
+// runBrowseCommand implements `tarsnap browse`, a full-screen fuzzy search
+// over the deduplicated command set. Without a terminal it falls back to a
+// line-based prompt.
+func runBrowseCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("browse", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarsnap browse [flags]")
+		fmt.Fprintln(fs.Output(), "Fuzzy-searches the unique commands as you type. Up and down select a")
+		fmt.Fprintln(fs.Output(), "command, enter copies it, and :host, :since or :until followed by enter")
+		fmt.Fprintln(fs.Output(), "change the filters. When stdin isn't a terminal it reads queries a line")
+		fmt.Fprintln(fs.Output(), "at a time instead.")
+		fs.PrintDefaults()
+	}
+	host := fs.String("host", config.Host, "Only show commands from this host")
+	since := fs.String("since", "", "Only show commands first run at or after this time")
+	until := fs.String("until", "", "Only show commands first run at or before this time")
+	limit := fs.Int("n", 20, "Number of results shown per search by the line-based prompt")
+	fs.Parse(args)
+
+	b := &browser{config: config, host: *host, limit: *limit}
+	var err error
+	if *since != "" {
+		b.since, err = parseTimeArg(*since)
+		if err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		b.until, err = parseTimeArg(*until)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.load()
+	if err != nil {
+		return err
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return b.prompt()
+	}
+	defer restore()
+
+	// The alternate screen leaves the scrollback as it was on exit
+	fmt.Print("\x1b[?1049h")
+	defer fmt.Print("\x1b[?1049l")
+
+	s := &screen{b: b}
+	return s.run(bufio.NewReader(os.Stdin), os.Stdout)
+}
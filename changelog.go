@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+func changelogPath(dataDir string) string {
+	return filepath.Join(dataDir, "CHANGELOG.md")
+}
+
+// markdownCode wraps s in a code span, fenced with more backticks than it
+// holds in a row
+func markdownCode(s string) string {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", longest+1)
+	if longest > 0 {
+		return fence + " " + s + " " + fence
+	}
+	return fence + s + fence
+}
+
+// renderChangelog writes a section per day, newest first, listing under
+// each host the commands first seen there that day
+func renderChangelog(entries []LedgerEntry) []byte {
+	days := make(map[string]map[string][]string)
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		// Another user running the same command on the host isn't news
+		key := e.Host + "\x00" + e.Cmd
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		day := "undated"
+		if !e.FirstSeen.IsZero() {
+			day = e.FirstSeen.Local().Format("2006-01-02")
+		}
+		if days[day] == nil {
+			days[day] = make(map[string][]string)
+		}
+		days[day][e.Host] = append(days[day][e.Host], e.Cmd)
+	}
+
+	dates := make([]string, 0, len(days))
+	for day := range days {
+		dates = append(dates, day)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+
+	var buf bytes.Buffer
+	buf.WriteString("# Changelog\n\nCommands seen for the first time on each host, by day.\n")
+	for _, day := range dates {
+		fmt.Fprintf(&buf, "\n## %s\n", day)
+		hosts := make([]string, 0, len(days[day]))
+		for host := range days[day] {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			fmt.Fprintf(&buf, "\n### %s\n\n", host)
+			for _, cmd := range days[day][host] {
+				fmt.Fprintf(&buf, "- %s\n", markdownCode(cmd))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeChangelog brings CHANGELOG.md in dataDir up to date with the
+// ledger entries the summaries keep
+func writeChangelog(dataDir string, entries []LedgerEntry) error {
+	return history.WriteFile(changelogPath(dataDir), renderChangelog(entries), 0o600)
+}
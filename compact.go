@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// snapshotDigest is the SHA-256 of the history in the snapshot at path,
+// after decryption and decompression, so the same history stored two ways
+// still matches
+func snapshotDigest(path string) (string, error) {
+	f, err := history.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compactSnapshots removes snapshots identical to an older one of the same
+// host in the same directory, as every fetch of an unchanged history leaves
+// behind. Each removal is recorded in the host's state before the file is
+// deleted. It returns what was removed and how many bytes that freed.
+func compactSnapshots(dataDir, stateDir string, dryRun bool) ([]CompactedSnapshot, int64, error) {
+	absDataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	snapshots, _, err := listSnapshots(absDataDir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	taken := func(s snapshotFile) time.Time {
+		if t, ok := history.SnapshotTime(s.path); ok {
+			return t
+		}
+		return s.info.ModTime()
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return taken(snapshots[i]).Before(taken(snapshots[j])) })
+
+	rel := func(path string) string {
+		if r, err := filepath.Rel(absDataDir, path); err == nil {
+			return r
+		}
+		return path
+	}
+
+	kept := make(map[string]string)
+	dups := make(map[string][]CompactedSnapshot)
+	var removed []CompactedSnapshot
+	var freed int64
+	now := time.Now()
+	for _, s := range snapshots {
+		digest, err := snapshotDigest(s.path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to hash %s: %w", s.path, err)
+		}
+		host := snapshotHost(s.path)
+		key := filepath.Dir(s.path) + "\x00" + host + "\x00" + digest
+		first, ok := kept[key]
+		if !ok {
+			kept[key] = s.path
+			continue
+		}
+		c := CompactedSnapshot{Path: rel(s.path), Kept: rel(first), SHA256: digest, Size: s.size, Removed: now}
+		dups[host] = append(dups[host], c)
+		removed = append(removed, c)
+		freed += s.size
+	}
+	if len(removed) == 0 || dryRun {
+		for _, c := range removed {
+			runner.PrintDryRun("rm", filepath.Join(absDataDir, c.Path))
+		}
+		return removed, freed, nil
+	}
+
+	// The record is saved first, so a file is never gone without a trace
+	states, err := loadHostStates(stateDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	for host, cs := range dups {
+		st := hostState(states, host)
+		st.Compacted = append(st.Compacted, cs...)
+	}
+	err = saveHostStates(stateDir, states)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to record compacted snapshots: %w", err)
+	}
+
+	for i, c := range removed {
+		err := os.Remove(filepath.Join(absDataDir, c.Path))
+		if err != nil {
+			return removed[:i], freed, err
+		}
+		slog.Info("Removed duplicate snapshot", "path", c.Path, "kept", c.Kept)
+	}
+	return removed, freed, nil
+}
+
+// runCompactCommand implements `tarsnap compact`
+func runCompactCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	fs.Parse(args)
+
+	// A fetch saving its own copy of the host states would drop the record
+	// of what was removed
+	if !config.DryRun {
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
+	}
+
+	removed, freed, err := compactSnapshots(config.DataDir, config.StateDir, config.DryRun)
+	if err != nil {
+		return err
+	}
+	if config.DryRun {
+		fmt.Printf("Would remove %d duplicate snapshots, freeing %d bytes\n", len(removed), freed)
+		return nil
+	}
+	fmt.Printf("Removed %d duplicate snapshots, freeing %d bytes\n", len(removed), freed)
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	IP              string                `yaml:"ip"`
+	RemoteOS        string                `yaml:"remote_os"`
+	IPSource        string                `yaml:"ip_source"`
+	HostsFile       string                `yaml:"hosts_file"`
+	EC2Tag          string                `yaml:"ec2_tag"`
+	AWSRegion       string                `yaml:"aws_region"`
+	GCELabel        string                `yaml:"gce_label"`
+	GCEZone         string                `yaml:"gce_zone"`
+	GCPProject      string                `yaml:"gcp_project"`
+	AzureTag        string                `yaml:"azure_tag"`
+	AzureGroup      string                `yaml:"azure_resource_group"`
+	TailscaleDevice string                `yaml:"tailscale_device"`
+	TFDir           string                `yaml:"tf_dir"`
+	TFWorkspace     string                `yaml:"tf_workspace"`
+	TFOutput        string                `yaml:"tf_output_name"`
+	IPCacheTTL      time.Duration         `yaml:"ip_cache_ttl"`
+	RefreshIP       bool                  `yaml:"-"`
+	PreferIPv6      bool                  `yaml:"prefer_ipv6"`
+	Hosts           stringList            `yaml:"hosts"`
+	Users           stringList            `yaml:"users"`
+	DefaultUsers    bool                  `yaml:"-"`
+	Concurrency     int                   `yaml:"concurrency"`
+	SkipUnchanged   bool                  `yaml:"skip_unchanged"`
+	FlushHistory    bool                  `yaml:"flush_history"`
+	AlertAfter      int                   `yaml:"alert_after"`
+	LockWait        time.Duration         `yaml:"wait"`
+	SkipIfRunning   bool                  `yaml:"skip_if_running"`
+	KnownHosts      string                `yaml:"known_hosts"`
+	TrustOnFirstUse bool                  `yaml:"trust_on_first_use"`
+	JumpHost        string                `yaml:"jump_host"`
+	IdentityAgent   string                `yaml:"identity_agent"`
+	PasswordAuth    bool                  `yaml:"password_auth"`
+	PasswordCommand string                `yaml:"password_command"`
+	Password        string                `yaml:"password"`
+	SSHPassphrase   string                `yaml:"ssh_passphrase"`
+	AWSAccessKey    string                `yaml:"aws_access_key_id"`
+	AWSSecretKey    string                `yaml:"aws_secret_access_key"`
+	Collect         string                `yaml:"collect"`
+	Shell           string                `yaml:"shell"`
+	AuditUser       string                `yaml:"audit_user"`
+	AuditSudo       bool                  `yaml:"audit_sudo"`
+	BWLimit         int                   `yaml:"bwlimit"`
+	SSHMultiplex    bool                  `yaml:"ssh_multiplex"`
+	PerHost         map[string]HostConfig `yaml:"per_host"`
+	Artifacts       artifactList          `yaml:"artifacts"`
+	Results         bool                  `yaml:"results"`
+	Metadata        bool                  `yaml:"metadata"`
+	Store           string                `yaml:"store"`
+	HealthcheckURL  string                `yaml:"healthcheck_url"`
+	WebhookURL      string                `yaml:"webhook_url"`
+	WebhookFormat   string                `yaml:"webhook_format"`
+	Watch           patternList           `yaml:"watch"`
+	DataDir         string                `yaml:"data_dir"`
+	FixPerms        bool                  `yaml:"fix_perms"`
+	StateDir        string                `yaml:"state_dir"`
+	Quota           byteSize              `yaml:"quota"`
+	EvictionPolicy  string                `yaml:"eviction_policy"`
+	PruneKeepDays   int                   `yaml:"prune_keep_days"`
+	PruneKeepLast   int                   `yaml:"prune_keep_last"`
+	ManifestKeep    int                   `yaml:"manifest_keep"`
+	Archive         string                `yaml:"archive"`
+	GitCommit       bool                  `yaml:"git_commit"`
+	GitPush         string                `yaml:"git_push"`
+	ArchiveDir      string                `yaml:"archive_dir"`
+	ArchiveKeep     int                   `yaml:"archive_keep"`
+	Label           string                `yaml:"label"`
+	CWD             string                `yaml:"cwd"`
+	ShowFull        bool                  `yaml:"-"`
+	Chronological   bool                  `yaml:"chronological"`
+	Install         bool                  `yaml:"-"`
+	JobArgs         string                `yaml:"job_args"`
+	JobEnv          envList               `yaml:"job_env"`
+	DryRun          bool                  `yaml:"-"`
+	ForceFlags      bool                  `yaml:"-"`
+	ForceConfig     bool                  `yaml:"-"`
+	Delay           time.Duration         `yaml:"delay"`
+	Schedule        string                `yaml:"schedule"`
+	OnCalendar      string                `yaml:"on_calendar"`
+	Persistent      bool                  `yaml:"persistent"`
+	Scheduled       bool                  `yaml:"-"`
+
+	// launchd job tuning
+	RunAtLoad        bool          `yaml:"run_at_load"`
+	KeepAlive        string        `yaml:"keep_alive"`
+	ThrottleInterval int           `yaml:"throttle_interval"`
+	Nice             int           `yaml:"nice"`
+	LowPriorityIO    bool          `yaml:"low_priority_io"`
+	LegacyLaunchctl  bool          `yaml:"legacy_launchctl"`
+	Analytics        bool          `yaml:"-"`
+	Epsilon          float64       `yaml:"epsilon"`
+	Delta            float64       `yaml:"delta"`
+	SampleRate       float64       `yaml:"sample_rate"`
+	Tag              string        `yaml:"-"`
+	Host             string        `yaml:"-"`
+	Compress         string        `yaml:"compress"`
+	EncryptKey       string        `yaml:"encrypt_key"`
+	Output           string        `yaml:"output"`
+	MinLength        int           `yaml:"min_length"`
+	Normalize        stringList    `yaml:"normalize"`
+	Exact            bool          `yaml:"exact"`
+	Changelog        bool          `yaml:"changelog"`
+	Include          patternList   `yaml:"include"`
+	Exclude          patternList   `yaml:"exclude"`
+	LogLevel         string        `yaml:"log_level"`
+	LogFormat        string        `yaml:"log_format"`
+	LogFile          string        `yaml:"log_file"`
+	LogMaxSize       byteSize      `yaml:"log_max_size"`
+	LogKeep          int           `yaml:"log_keep"`
+	LogMaxAge        time.Duration `yaml:"log_max_age"`
+}
+
+// HostConfig holds the settings that differ for one host, keyed by the
+// host's address under per_host in the config file. Empty fields fall back
+// to the global settings.
+type HostConfig struct {
+	// Users replaces the global list of remote users for this host
+	Users         []string   `yaml:"users"`
+	Port          int        `yaml:"port"`
+	IdentityFile  string     `yaml:"identity_file"`
+	IdentityAgent string     `yaml:"identity_agent"`
+	JumpHost      string     `yaml:"jump_host"`
+	Collect       string     `yaml:"collect"`
+	Shell         string     `yaml:"shell"`
+	Artifacts     []Artifact `yaml:"artifacts"`
+
+	// PasswordAuth with PasswordCommand or Password enables password
+	// authentication for just this host
+	PasswordAuth    bool   `yaml:"password_auth"`
+	PasswordCommand string `yaml:"password_command"`
+	Password        string `yaml:"password"`
+}
+
+// shellFor returns whose history is fetched from host: bash, zsh, fish or
+// auto to detect it per user
+func (c Config) shellFor(host string) string {
+	if hc, ok := c.PerHost[host]; ok && hc.Shell != "" {
+		return hc.Shell
+	}
+	return c.Shell
+}
+
+// collectFor returns how history is copied from host
+func (c Config) collectFor(host string) string {
+	if hc, ok := c.PerHost[host]; ok && hc.Collect != "" {
+		return hc.Collect
+	}
+	return c.Collect
+}
+
+// usersFor returns the remote users whose history is fetched from host
+func (c Config) usersFor(host string) []string {
+	if hc, ok := c.PerHost[host]; ok && len(hc.Users) > 0 {
+		return hc.Users
+	}
+	return c.Users
+}
+
+// allUsers returns every remote user fetched from any host, global users
+// first
+func (c Config) allUsers() []string {
+	users := append([]string{}, c.Users...)
+	seen := make(map[string]bool)
+	for _, u := range users {
+		seen[u] = true
+	}
+	hosts := make([]string, 0, len(c.PerHost))
+	for host := range c.PerHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		for _, u := range c.PerHost[host].Users {
+			if !seen[u] {
+				seen[u] = true
+				users = append(users, u)
+			}
+		}
+	}
+	return users
+}
+
+// stringList is a flag.Value holding a comma separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = strings.Split(value, ",")
+	return nil
+}
+
+// envList is a flag.Value collecting one KEY=VALUE per use of the flag
+type envList []string
+
+func (l *envList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *envList) Set(value string) error {
+	if _, err := schedule.ParseEnv(value); err != nil {
+		return err
+	}
+	// The command line is parsed twice, around the config file
+	for _, v := range *l {
+		if v == value {
+			return nil
+		}
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// defaultConfigPath prefers tarsnap.yaml in the current directory and falls
+// back to ~/.config/tarsnap/config.yaml
+func defaultConfigPath() string {
+	if _, err := os.Stat("tarsnap.yaml"); err == nil {
+		return "tarsnap.yaml"
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".config", "tarsnap", "config.yaml")
+}
+
+// loadConfigFile overlays the values set in the YAML file at path onto
+// config. A missing file is not an error.
+func loadConfigFile(path string, config *Config) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(data, config)
+}
+
+// dataDirs are where snapshots, state and archives are kept
+type dataDirs struct {
+	Data     string
+	State    string
+	Archives string
+}
+
+// defaultDataDirs places the data under the user's data directory:
+// $XDG_DATA_HOME/tarsnap (~/.local/share/tarsnap) with the state in
+// $XDG_STATE_HOME/tarsnap on Linux, and ~/Library/Application Support/tarsnap
+// on macOS. Installs that already have ./data/bash_history keep using ./data
+// so their snapshots aren't orphaned.
+func defaultDataDirs() dataDirs {
+	legacy := dataDirs{Data: "./data/bash_history", State: "./data/state", Archives: "./data/archives"}
+	if _, err := os.Stat(legacy.Data); err == nil {
+		return legacy
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return legacy
+	}
+
+	var base string
+	switch runtime.GOOS {
+	case "darwin":
+		base = filepath.Join(home, "Library", "Application Support", "tarsnap")
+	case "windows":
+		// On Windows this is %LocalAppData%
+		appData, err := os.UserCacheDir()
+		if err != nil {
+			return legacy
+		}
+		base = filepath.Join(appData, "tarsnap")
+	}
+	if base != "" {
+		return dataDirs{
+			Data:     filepath.Join(base, "history"),
+			State:    filepath.Join(base, "state"),
+			Archives: filepath.Join(base, "archives"),
+		}
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return dataDirs{
+		Data:     filepath.Join(dataHome, "tarsnap"),
+		State:    filepath.Join(stateHome, "tarsnap"),
+		Archives: filepath.Join(stateHome, "tarsnap", "archives"),
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settingConflict is a setting given both on the command line and in the
+// config file with different values
+type settingConflict struct {
+	Flag      string
+	FlagValue string
+	FileValue string
+	field     int
+}
+
+// configFieldByKey returns the index of the Config field tagged with the
+// YAML key key, or -1
+func configFieldByKey(key string) int {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// configFileKeys returns the top level keys present in the YAML file at path
+func configFileKeys(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for k := range raw {
+		keys[k] = true
+	}
+	return keys, nil
+}
+
+// findConflicts compares the explicitly set flags against the settings in
+// the config file at path. Flag foo-bar corresponds to key foo_bar.
+func findConflicts(config Config, path string, setFlags map[string]bool) ([]settingConflict, Config, error) {
+	var fileConfig Config
+
+	keys, err := configFileKeys(path)
+	if err != nil || len(keys) == 0 {
+		return nil, fileConfig, err
+	}
+
+	err = loadConfigFile(path, &fileConfig)
+	if err != nil {
+		return nil, fileConfig, err
+	}
+
+	flagValues := reflect.ValueOf(config)
+	fileValues := reflect.ValueOf(fileConfig)
+
+	var conflicts []settingConflict
+	for name := range setFlags {
+		key := strings.ReplaceAll(name, "-", "_")
+		if !keys[key] {
+			continue
+		}
+		i := configFieldByKey(key)
+		if i < 0 {
+			continue
+		}
+
+		flagValue := fmt.Sprint(flagValues.Field(i).Interface())
+		fileValue := fmt.Sprint(fileValues.Field(i).Interface())
+		if flagValue != fileValue {
+			conflicts = append(conflicts, settingConflict{Flag: name, FlagValue: flagValue, FileValue: fileValue, field: i})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Flag < conflicts[j].Flag })
+	return conflicts, fileConfig, nil
+}
+
+// resolveInstallConflicts decides, for every setting where the command line
+// and the config file disagree, which one is baked into the scheduler entry.
+// --force-flags and --force-config pick a side up front; otherwise the user
+// is asked about each conflict.
+func resolveInstallConflicts(config *Config, path string, setFlags map[string]bool) error {
+	conflicts, fileConfig, err := findConflicts(*config, path, setFlags)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 || config.ForceFlags {
+		return nil
+	}
+
+	target := reflect.ValueOf(config).Elem()
+	source := reflect.ValueOf(fileConfig)
+
+	for _, c := range conflicts {
+		useFile := config.ForceConfig
+		if !useFile {
+			if !isTerminal(os.Stdin) {
+				return fmt.Errorf("-%s=%s disagrees with %s in %s; rerun with --force-flags or --force-config", c.Flag, c.FlagValue, c.FileValue, path)
+			}
+			useFile = !confirm(fmt.Sprintf("-%s is %q on the command line but %q in %s. Keep the command line value?", c.Flag, c.FlagValue, c.FileValue, path))
+		}
+
+		if useFile {
+			target.Field(c.field).Set(source.Field(c.field))
+			fmt.Printf("Using %s=%s from %s\n", c.Flag, c.FileValue, path)
+		} else {
+			fmt.Printf("Using %s=%s from the command line\n", c.Flag, c.FlagValue)
+		}
+	}
+
+	return nil
+}
+
+// isTerminal reports whether f is a character device, i.e. someone can answer prompts
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runDaemonCommand implements `tarsnap daemon`, which repeats the fetch every
+// config.Delay in the foreground so any process supervisor can run it
+func runDaemonCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	jitter := fs.Duration("jitter", 30*time.Second, "Random extra delay added to each interval so hosts aren't hit in lockstep")
+	metricsAddr := fs.String("metrics-addr", "", "Serve Prometheus metrics at http://<addr>/metrics, e.g. :9464")
+	fs.Parse(args)
+
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// The daemon keeps to -delay like an installed job
+	config.Scheduled = true
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		// A failed run is retried on the next tick rather than ending the daemon
+		err := dowork(config)
+		if err != nil {
+			slog.Error("Fetch failed", "err", err)
+		}
+
+		wait := config.Delay
+		if *jitter > 0 {
+			wait += time.Duration(rng.Int63n(int64(*jitter)))
+		}
+		slog.Info("Waiting for next fetch", "wait", wait.Round(time.Second))
+
+		select {
+		case <-time.After(wait):
+		case sig := <-stop:
+			slog.Info("Stopping daemon", "signal", sig.String())
+			return nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// HostDiff holds the commands a host's summary gained in its latest fetch,
+// the ones the dedup index hadn't seen from that host before
+type HostDiff struct {
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+	Commands []string  `json:"commands"`
+}
+
+func diffDir(stateDir string) string {
+	return filepath.Join(stateDir, "diff")
+}
+
+func diffPath(stateDir, host string) string {
+	return filepath.Join(diffDir(stateDir), schedule.SanitizeHost(host)+".json")
+}
+
+// saveHostDiffs replaces the diff of every host fetched successfully in
+// this run with what its summary gained, so a host skipped by a run keeps
+// showing its own latest fetch
+func saveHostDiffs(stateDir string, results []FetchResult, added map[string][]string, now time.Time) error {
+	err := os.MkdirAll(diffDir(stateDir), 0o700)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	done := make(map[string]bool)
+	for _, r := range results {
+		if r.Err != nil || done[r.Host] {
+			continue
+		}
+		done[r.Host] = true
+
+		data, err := json.MarshalIndent(HostDiff{Host: r.Host, Time: now, Commands: added[r.Host]}, "", "  ")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, history.WriteFile(diffPath(stateDir, r.Host), append(data, '\n'), 0o600))
+	}
+	return errors.Join(errs...)
+}
+
+// loadHostDiffs reads the diffs of hosts, or of every host when none are
+// given, in host order
+func loadHostDiffs(stateDir string, hosts []string) ([]HostDiff, error) {
+	var paths []string
+	if len(hosts) == 0 {
+		var err error
+		paths, err = filepath.Glob(filepath.Join(diffDir(stateDir), "*.json*"))
+		if err != nil {
+			return nil, err
+		}
+		for i, path := range paths {
+			paths[i] = strings.TrimSuffix(path, history.EncryptedSuffix)
+		}
+	}
+	for _, host := range hosts {
+		paths = append(paths, diffPath(stateDir, host))
+	}
+
+	var diffs []HostDiff
+	for _, path := range paths {
+		data, err := history.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && len(hosts) > 0 {
+			return nil, fmt.Errorf("no fetch from %s recorded yet", strings.TrimSuffix(filepath.Base(path), ".json"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		var d HostDiff
+		err = json.Unmarshal(data, &d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		diffs = append(diffs, d)
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Host < diffs[j].Host })
+	return diffs, nil
+}
+
+// runDiffCommand implements `tarsnap diff [host...]`, printing the commands
+// each host's latest fetch added to its summary
+func runDiffCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Parse(args)
+
+	diffs, err := loadHostDiffs(config.StateDir, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	if config.Output == "json" {
+		return writeJSON(os.Stdout, diffs)
+	}
+
+	for i, d := range diffs {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# %s, fetched %s: %d new\n", d.Host, d.Time.Local().Format("2006-01-02 15:04"), len(d.Commands))
+		for _, cmd := range d.Commands {
+			fmt.Println(cmd)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// runEncryptCommand implements `tarsnap encrypt`, encrypting the files
+// stored before -encrypt-key was set: snapshots, summaries, the ledger and
+// the views derived from it, and the per-host diffs in the state directory
+func runEncryptCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	fs.Parse(args)
+
+	if !history.Encrypting() {
+		return errors.New("usage: tarsnap -encrypt-key <identity> encrypt")
+	}
+
+	// Files replaced by their encrypted copy mustn't be written meanwhile
+	if !config.DryRun {
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
+	}
+
+	encrypted := 0
+	var errs []error
+	for _, dir := range []string{config.DataDir, diffDir(config.StateDir)} {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if errors.Is(err, os.ErrNotExist) && path == dir {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// A git repository's objects are its own business
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if info.IsDir() || strings.HasSuffix(path, history.EncryptedSuffix) || strings.HasPrefix(info.Name(), ".") {
+				return nil
+			}
+			if config.DryRun {
+				slog.Info("Would encrypt", "path", path)
+				return nil
+			}
+			_, err = history.Encrypt(path)
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			encrypted++
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	slog.Info("Encrypted stored history", "files", encrypted)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// renderHistory writes entries as a history file the shell named by format
+// can load. Timestamps are kept where known: bash gets HISTTIMEFORMAT style
+// "#<epoch>" comments and zsh EXTENDED_HISTORY lines. Entries without a
+// time are written as bare commands, which both shells accept.
+func renderHistory(w io.Writer, entries []history.Entry, format string) error {
+	for _, e := range entries {
+		var err error
+		switch {
+		case e.Timestamp.IsZero():
+			_, err = fmt.Fprintln(w, e.Command)
+		case format == "zsh":
+			_, err = fmt.Fprintf(w, ": %d:0;%s\n", e.Timestamp.Unix(), e.Command)
+		default:
+			_, err = fmt.Fprintf(w, "#%d\n%s\n", e.Timestamp.Unix(), e.Command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderLedgerCSV writes entries as CSV with a header row, for
+// spreadsheets and BI tools
+func renderLedgerCSV(w io.Writer, entries []LedgerEntry) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"host", "user", "command", "first_seen", "last_seen", "count"})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = cw.Write([]string{e.Host, e.User, e.Cmd, e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), strconv.Itoa(e.Count)})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportLedgerCSV writes the ledger entries from config.Host, or every
+// host, as CSV to out or standard output
+func exportLedgerCSV(config Config, out string) error {
+	if config.Tag != "" {
+		return errors.New("-tag can't be used with -format csv, the ledger doesn't record tags")
+	}
+	filter, err := newCommandFilter(config)
+	if err != nil {
+		return err
+	}
+	ledger, err := loadLedger(ledgerPath(config.DataDir))
+	if err != nil {
+		return err
+	}
+	var entries []LedgerEntry
+	for _, e := range ledger.Entries() {
+		if (config.Host == "" || e.Host == config.Host) && filter.allowed(e.Cmd) {
+			entries = append(entries, e)
+		}
+	}
+
+	if out == "" {
+		return renderLedgerCSV(os.Stdout, entries)
+	}
+
+	var buf bytes.Buffer
+	err = renderLedgerCSV(&buf, entries)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(out, buf.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", out, err)
+	}
+	slog.Info("Exported ledger", "path", out, "format", "csv", "entries", len(entries))
+	return nil
+}
+
+// runExportCommand implements `tarsnap export`, rendering the deduplicated
+// command set oldest first into a shell history file, or the ledger as CSV
+func runExportCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "bash", "Format to write: bash or zsh history, or csv of the ledger")
+	out := fs.String("out", "", "File to write, or standard output when empty")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return errors.New("usage: tarsnap export [-format bash|zsh|csv] [-out file]")
+	}
+	if *format == "csv" {
+		return exportLedgerCSV(config, *out)
+	}
+	if *format != "bash" && *format != "zsh" {
+		return fmt.Errorf("unknown export format %q, want bash, zsh or csv", *format)
+	}
+
+	keep, err := historyFilter(config)
+	if err != nil {
+		return err
+	}
+	filter, err := newCommandFilter(config)
+	if err != nil {
+		return err
+	}
+	entries, err := history.UniqueEntries(config.DataDir, keep)
+	if err != nil {
+		return err
+	}
+
+	// The minimum length only trims summaries; an exported history should
+	// still have the short commands
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.Command != "" && filter.allowed(e.Command) {
+			kept = append(kept, e)
+		}
+	}
+
+	if *out == "" {
+		return renderHistory(os.Stdout, kept, *format)
+	}
+
+	var buf bytes.Buffer
+	err = renderHistory(&buf, kept, *format)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(*out, buf.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", *out, err)
+	}
+	slog.Info("Exported history", "path", *out, "format", *format, "commands", len(kept))
+	return nil
+}
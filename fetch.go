@@ -0,0 +1,623 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/ipsource"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// FetchResult is the outcome of copying one user's history from one host
+type FetchResult struct {
+	Host     string        `json:"host"`
+	User     string        `json:"user"`
+	Path     string        `json:"path,omitempty"`
+	Metadata *HostMetadata `json:"metadata,omitempty"`
+	Err      error         `json:"-"`
+
+	// Unchanged is set when the remote history matched the checksum of the
+	// last fetch and wasn't copied; Path is empty then
+	Unchanged bool   `json:"unchanged,omitempty"`
+	Hash      string `json:"-"`
+
+	// Bytes is how much of the history was transferred: its size before
+	// filtering, or with rsync what was appended since the last fetch
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// Probe describes the copied history before filtering, and Rotated
+	// says why it no longer continued the previous copy, if it didn't
+	Probe   fetch.Probe `json:"-"`
+	Rotated string      `json:"rotated,omitempty"`
+
+	// Artifacts are the paths of the extra files collected with it
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// Shell is whose history was fetched; DetectedShell is set when it was
+	// just detected and should be remembered
+	Shell         string `json:"shell,omitempty"`
+	DetectedShell string `json:"-"`
+
+	// RemotePath is the history file copied from the host
+	RemotePath string `json:"-"`
+}
+
+// userShell returns the shell whose history is fetched for user on host:
+// the configured one, the one detected by an earlier fetch, or else the one
+// detected now, which is also returned as detected
+func userShell(config Config, remote fetch.Remote, states map[string]*HostState, host, user string) (shell, detected string) {
+	if s := config.shellFor(host); s != "" && s != "auto" {
+		return s, ""
+	}
+	if st := states[host]; st != nil && st.Shells[user] != "" {
+		return st.Shells[user], ""
+	}
+	if config.DryRun {
+		return "bash", ""
+	}
+	shell, err := fetch.DetectShell(remote, user, host)
+	if err != nil {
+		slog.Warn("Failed to detect shell, fetching bash history", "target", user+"@"+host, "err", err)
+		return "bash", ""
+	}
+	slog.Info("Detected shell", "target", user+"@"+host, "shell", shell)
+	return shell, shell
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (r FetchResult) MarshalJSON() ([]byte, error) {
+	type plain FetchResult
+	out := struct {
+		plain
+		Error string `json:"error,omitempty"`
+	}{plain: plain(r)}
+	if r.Err != nil {
+		out.Error = r.Err.Error()
+	}
+	return json.Marshal(out)
+}
+
+// newRemote builds the ssh and scp settings for host from config, with the
+// host's own port, identity and jump host when it has them
+func newRemote(config Config, host string, cmdRunner runner.Runner) fetch.Remote {
+	o := fetch.Options{
+		TrustOnFirstUse: config.TrustOnFirstUse,
+		KnownHosts:      config.KnownHosts,
+		JumpHost:        config.JumpHost,
+		IdentityAgent:   config.IdentityAgent,
+		PasswordAuth:    config.PasswordAuth,
+		PasswordCommand: config.PasswordCommand,
+		Password:        config.Password,
+		Passphrase:      config.SSHPassphrase,
+		BWLimit:         config.BWLimit,
+		AuditUser:       config.AuditUser,
+		AuditSudo:       config.AuditSudo,
+		DryRun:          config.DryRun,
+	}
+	if hc, ok := config.PerHost[host]; ok {
+		o.Port = hc.Port
+		o.IdentityFile = hc.IdentityFile
+		if hc.IdentityAgent != "" {
+			o.IdentityAgent = hc.IdentityAgent
+		}
+		if hc.PasswordAuth {
+			o.PasswordAuth = true
+		}
+		if hc.PasswordCommand != "" {
+			o.PasswordCommand = hc.PasswordCommand
+		}
+		if hc.Password != "" {
+			o.Password = hc.Password
+		}
+		if hc.JumpHost != "" {
+			o.JumpHost = hc.JumpHost
+		}
+	}
+	if o.PasswordAuth && (o.PasswordCommand != "" || o.Password != "") || o.Passphrase != "" {
+		exe, err := os.Executable()
+		if err != nil {
+			slog.Warn("Failed to find the executable to answer password prompts", "err", err)
+		}
+		o.Askpass = exe
+	}
+	return fetch.NewRemote(o, cmdRunner)
+}
+
+// fetchAll copies the history of every configured user on every host,
+// running at most config.Concurrency transfers at once. Results are returned
+// in host, user order. With config.Results the exit status log from onboard
+// --results is copied too, and with config.Metadata host metadata is
+// collected once per host. With config.SkipUnchanged the remote history is
+// checksummed first and not copied when it matches the checksum recorded in
+// the host state by the previous fetch. With config.FlushHistory the user's
+// live shells are first asked to write out their history.
+func fetchAll(hosts []string, localDir string, config Config, cmdRunner runner.Runner) []FetchResult {
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	remotes := make(map[string]fetch.Remote, len(hosts))
+	for _, host := range hosts {
+		remotes[host] = newRemote(config, host, cmdRunner)
+	}
+
+	// Windows' OpenSSH client can't multiplex connections
+	var mux *fetch.Multiplexer
+	if config.SSHMultiplex && !config.DryRun && runtime.GOOS != "windows" {
+		m, err := fetch.NewMultiplexer(cmdRunner)
+		if err != nil {
+			slog.Warn("Failed to set up ssh connection reuse, connecting for each copy", "err", err)
+		}
+		mux = m
+		defer mux.Close()
+	}
+	remotePath, _ := fetch.HistoryPath(config.RemoteOS)
+	filter, _ := newCommandFilter(config)
+
+	// Live shells are only signalled on unix hosts, through a POSIX shell
+	flushHistory := config.FlushHistory && config.RemoteOS != "windows"
+
+	// Checksums only work against sha256sum or shasum on the remote
+	skipUnchanged := config.SkipUnchanged && config.RemoteOS != "windows"
+	states, err := loadHostStates(config.StateDir)
+	if err != nil {
+		slog.Warn("Failed to load host state, fetching everything", "err", err)
+		states = make(map[string]*HostState)
+	}
+
+	jobs := make(chan int)
+	var results []FetchResult
+	for _, host := range hosts {
+		for _, user := range config.usersFor(host) {
+			results = append(results, FetchResult{Host: host, User: user})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				r := &results[j]
+				remote := mux.Connect(remotes[r.Host], r.User+"@"+r.Host)
+				collect := config.collectFor(r.Host)
+
+				// The audit log has no history file to flush or checksum
+				audit := fetch.IsAuditSource(collect)
+
+				remotePath := remotePath
+				if config.RemoteOS != "windows" && !audit {
+					r.Shell, r.DetectedShell = userShell(config, remote, states, r.Host, r.User)
+					remotePath, _ = fetch.ShellHistoryPath(r.Shell)
+				}
+				if !audit {
+					r.RemotePath = remotePath
+				}
+				// A history fetched before from another path, as after a
+				// shell switch, has nothing to compare against
+				prevHash, prev := lastFetch(states, r.Host, r.User, r.RemotePath)
+				if flushHistory && !audit {
+					n, err := fetch.FlushHistory(remote, r.User, r.Host)
+					if err != nil {
+						slog.Warn("Failed to flush live shell history, copying what is on disk", "target", r.User+"@"+r.Host, "err", err)
+					} else if n > 0 {
+						slog.Debug("Flushed live shell history", "target", r.User+"@"+r.Host, "shells", n)
+					}
+				}
+				if skipUnchanged && !audit {
+					hash, err := fetch.HistoryHash(remote, r.User, r.Host, remotePath)
+					if err != nil {
+						slog.Warn("Failed to checksum remote history, copying it", "target", r.User+"@"+r.Host, "err", err)
+					}
+					r.Hash = hash
+					r.Unchanged = hash != "" && hash == prevHash
+				}
+
+				// rsync only appends, so a history that was truncated or
+				// replaced has to be noticed before copying
+				if !r.Unchanged && collect == "rsync" && !config.DryRun && config.RemoteOS != "windows" {
+					probe, err := fetch.ProbeHistory(remote, r.User, r.Host, remotePath)
+					if err != nil {
+						slog.Warn("Failed to probe remote history", "target", r.User+"@"+r.Host, "err", err)
+					} else if r.Rotated = fetch.Rotated(prev, probe); r.Rotated != "" {
+						err = fetch.ResetMirror(filepath.Join(localDir, r.User), r.Host, remotePath)
+						if err != nil {
+							slog.Warn("Failed to reset rsync mirror", "target", r.User+"@"+r.Host, "err", err)
+						}
+					}
+				}
+
+				// Each remote user gets their own subdirectory
+				if !r.Unchanged {
+					r.Path, r.Err = fetch.UserHistory(remote, r.User, r.Host, filepath.Join(localDir, r.User), remotePath, config.RemoteOS, collect)
+					if r.Err == nil && !config.DryRun {
+						r.Bytes = fileSize(r.Path)
+						r.Probe, _ = fetch.ProbeFile(r.Path)
+						if r.Rotated == "" {
+							r.Rotated = fetch.Rotated(prev, r.Probe)
+						}
+						if r.Rotated != "" {
+							slog.Warn("Remote history was truncated or rotated, fetched it in full", "target", r.User+"@"+r.Host, "reason", r.Rotated)
+						}
+						// rsync only transferred what was appended to the mirror
+						if collect == "rsync" && r.Rotated == "" && prev.Size > 0 && r.Bytes >= prev.Size {
+							r.Bytes -= prev.Size
+						}
+						r.Err = quarantineSnapshot(r.Path, r.User+"@"+r.Host)
+					}
+					if r.Err == nil && !config.DryRun && r.Shell == "fish" {
+						r.Err = convertFishSnapshot(r.Path)
+					}
+					if r.Err == nil && !config.DryRun {
+						r.Err = filterSnapshot(r.Path, filter)
+					}
+					if r.Err == nil && !config.DryRun {
+						r.Path, r.Err = history.Compress(r.Path, config.Compress)
+					}
+					if r.Err == nil && !config.DryRun {
+						r.Path, r.Err = history.Encrypt(r.Path)
+					}
+				}
+				if r.Err == nil {
+					r.Artifacts = fetchArtifacts(remote, r.User, r.Host, filepath.Join(localDir, r.User), config, filter)
+				}
+				if r.Err == nil && config.Results {
+					fetchUserResults(remote, r.User, r.Host, filepath.Join(localDir, r.User))
+				}
+				if r.Err == nil && config.Metadata && r.User == config.usersFor(r.Host)[0] {
+					r.Metadata = collectHostMetadata(remote, r.User, r.Host)
+				}
+			}
+		}()
+	}
+
+	for j := range results {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// fetchErrors maps "user@host" to the error for every failed fetch
+func fetchErrors(results []FetchResult) map[string]string {
+	errs := make(map[string]string)
+	for _, r := range results {
+		if r.Err != nil {
+			errs[r.User+"@"+r.Host] = r.Err.Error()
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func logFetchResults(results []FetchResult) {
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			slog.Error("Failed to fetch history", "host", r.Host, "user", r.User, "err", r.Err)
+			continue
+		}
+		if r.Unchanged {
+			slog.Info("History unchanged, skipped copy", "host", r.Host, "user", r.User)
+			continue
+		}
+		slog.Info("Fetched history", "host", r.Host, "user", r.User, "path", r.Path)
+	}
+	slog.Info("Fetch finished", "fetched", len(results)-failed, "total", len(results), "failed", failed)
+}
+
+// printFetchTable writes a row per host and user with how its fetch went
+// and, for hosts whose summary was updated, how many lines it gained
+func printFetchTable(w io.Writer, results []FetchResult, newByHost map[string]int) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tUSER\tSTATUS\tNEW\tDETAIL")
+	for _, r := range results {
+		status, detail, added := "ok", r.Path, strconv.Itoa(newByHost[r.Host])
+		switch {
+		case r.Err != nil:
+			status, detail, added = "failed", strings.ReplaceAll(r.Err.Error(), "\n", " "), "-"
+		case r.Unchanged:
+			status = "unchanged"
+		}
+		if newByHost == nil && r.Err == nil {
+			added = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Host, r.User, status, added, detail)
+	}
+	return tw.Flush()
+}
+
+// multiHost reports whether results come from more than one host
+func multiHost(results []FetchResult) bool {
+	for _, r := range results {
+		if r.Host != results[0].Host {
+			return true
+		}
+	}
+	return false
+}
+
+// partialFailureError reports the fetches that failed in a run where others
+// may have succeeded
+type partialFailureError struct {
+	failed map[string]string
+	total  int
+}
+
+func (e *partialFailureError) Error() string {
+	targets := make([]string, 0, len(e.failed))
+	for target := range e.failed {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	details := make([]string, 0, len(targets))
+	for _, target := range targets {
+		details = append(details, fmt.Sprintf("%s: %s", target, e.failed[target]))
+	}
+	return fmt.Sprintf("failed to fetch %d of %d histories: %s", len(e.failed), e.total, strings.Join(details, "; "))
+}
+
+// resolveIPs returns the hosts to fetch from, as configured
+func resolveIPs(config Config, cmdRunner runner.Runner) ([]string, error) {
+	return cachedIPs(config, func() ([]string, error) {
+		return lookupIPs(config, cmdRunner)
+	}, time.Now())
+}
+
+// lookupIPs asks the configured source for the hosts
+func lookupIPs(config Config, cmdRunner runner.Runner) ([]string, error) {
+	return ipsource.Resolve(ipsource.Options{
+		Source:          config.IPSource,
+		IP:              config.IP,
+		Hosts:           config.Hosts,
+		HostsFile:       config.HostsFile,
+		EC2Tag:          config.EC2Tag,
+		AWSRegion:       config.AWSRegion,
+		GCELabel:        config.GCELabel,
+		GCEZone:         config.GCEZone,
+		GCPProject:      config.GCPProject,
+		AzureTag:        config.AzureTag,
+		AzureGroup:      config.AzureGroup,
+		TailscaleDevice: config.TailscaleDevice,
+		TFDir:           config.TFDir,
+		TFWorkspace:     config.TFWorkspace,
+		TFOutput:        config.TFOutput,
+		PreferIPv6:      config.PreferIPv6,
+	}, cmdRunner)
+}
+
+// applySSHAliasUsers makes hosts that are ~/.ssh/config aliases with their
+// own User fetch that user's history, unless the users were chosen with
+// --users, the config file or per_host
+func applySSHAliasUsers(config Config, hosts []string, cmdRunner runner.Runner) Config {
+	if !config.DefaultUsers {
+		return config
+	}
+
+	local := ""
+	if u, err := user.Current(); err == nil {
+		local = u.Username
+	}
+
+	perHost := make(map[string]HostConfig, len(config.PerHost))
+	for host, hc := range config.PerHost {
+		perHost[host] = hc
+	}
+	for _, host := range hosts {
+		hc := perHost[host]
+		if len(hc.Users) > 0 {
+			continue
+		}
+		c, err := fetch.ReadSSHConfig(cmdRunner, host)
+		if err != nil {
+			slog.Debug("Failed to read ssh config", "host", host, "err", err)
+			continue
+		}
+		// ssh reports the local account when no block sets User
+		if !c.IsAlias(host) || c.User == "" || c.User == local {
+			continue
+		}
+		slog.Debug("Using the user from ssh config", "host", host, "user", c.User)
+		hc.Users = []string{c.User}
+		perHost[host] = hc
+	}
+	config.PerHost = perHost
+	return config
+}
+
+// fetchAndSummarize fetches from every host and updates the summaries. When
+// only some fetches fail the rest of the run still completes and a
+// *partialFailureError describing the failures is returned.
+func fetchAndSummarize(config Config, cmdRunner runner.Runner) error {
+	run := beginRun(config, time.Now())
+
+	hosts, err := resolveIPs(config, cmdRunner)
+	if err != nil {
+		return err
+	}
+	run.Hosts = hosts
+	config = applySSHAliasUsers(config, hosts, cmdRunner)
+
+	// Fail before connecting anywhere if the history location or the
+	// filter patterns are invalid
+	_, err = fetch.HistoryPath(config.RemoteOS)
+	if err != nil {
+		return err
+	}
+	_, err = newCommandFilter(config)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		switch collect := config.collectFor(host); collect {
+		case "scp", "ssh":
+		case "rsync":
+			// rsync appends to a plaintext mirror of the remote history kept
+			// in the data directory, which encryption at rest can't allow
+			if history.Encrypting() {
+				return fmt.Errorf("rsync can't collect from %s with -encrypt-key set, use scp or ssh", host)
+			}
+		case "auditd", "journald":
+			if config.RemoteOS == "windows" {
+				return fmt.Errorf("%s can't collect from windows hosts, use scp or ssh", collect)
+			}
+		default:
+			return fmt.Errorf("unknown collect mode %q for %s, want scp, ssh, rsync, auditd or journald", collect, host)
+		}
+		if shell := config.shellFor(host); shell != "" && shell != "auto" {
+			if _, err := fetch.ShellHistoryPath(shell); err != nil {
+				return fmt.Errorf("%s: %w", host, err)
+			}
+		}
+		for _, a := range config.artifactsFor(host) {
+			if err := a.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if _, ok := history.CompressedSuffixes[config.Compress]; !ok && config.Compress != "" && config.Compress != "none" {
+		return fmt.Errorf("unknown compression %q, want none, gzip or zstd", config.Compress)
+	}
+
+	// Create local directory if it does not exist
+	localDir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Fetching into data directory", "path", localDir)
+
+	results := fetchAll(hosts, localDir, config, cmdRunner)
+	if config.DryRun {
+		return nil
+	}
+	run.Errors = fetchErrors(results)
+	run.Metadata = fetchMetadata(results)
+	logFetchResults(results)
+	metrics.recordFetch(results)
+
+	var fetchErr error
+	if len(run.Errors) > 0 {
+		fetchErr = &partialFailureError{failed: run.Errors, total: len(results)}
+	}
+	if len(run.Errors) == len(results) {
+		err = updateHostStates(config, results, nil, run.Start)
+		if err != nil {
+			slog.Error("Failed to update host state", "err", err)
+		}
+		run.End = time.Now()
+		if err := appendRunRecord(config.StateDir, run); err != nil {
+			slog.Error("Failed to record run", "err", err)
+		}
+		if config.Output == "text" && multiHost(results) {
+			printFetchTable(os.Stdout, results, nil)
+		}
+		return fetchErr
+	}
+
+	// A failed per-user or per-host summary is reported, but the run still
+	// records its state and does its housekeeping
+	summary, err := summarize(config, localDir)
+	var summaryErr *summaryErrors
+	if errors.As(err, &summaryErr) {
+		for _, e := range summaryErr.errs {
+			slog.Error("Failed to update summary", "err", e)
+		}
+	} else if err != nil {
+		return err
+	}
+	metrics.recordSummary(summary, fetchErr == nil)
+
+	err = updateHostStates(config, results, summary.NewByHost, run.Start)
+	if err != nil {
+		slog.Error("Failed to update host state", "err", err)
+	}
+
+	err = saveHostDiffs(config.StateDir, results, summary.AddedByHost, run.Start)
+	if err != nil {
+		slog.Error("Failed to save what's new per host", "err", err)
+	}
+
+	err = newNotifier(config).watchedCommands(config.Watch, summary.RanByHost)
+	if err != nil {
+		slog.Error("Failed to check watched commands", "err", err)
+	}
+
+	err = mirrorToStore(config, cmdRunner, localDir, results)
+	if err != nil {
+		slog.Error("Failed to mirror to store", "err", err)
+	}
+
+	err = archiveDataDir(cmdRunner, config.Archive, localDir, config.ArchiveDir, config.ArchiveKeep)
+	if err != nil {
+		slog.Error("Failed to archive data directory", "err", err)
+	}
+
+	_, err = pruneSnapshots(localDir, config.StateDir, config.PruneKeepDays, config.PruneKeepLast, false)
+	if err != nil {
+		slog.Error("Failed to prune snapshots", "err", err)
+	}
+
+	err = enforceQuota(localDir, int64(config.Quota), config.EvictionPolicy)
+	if err != nil {
+		slog.Error("Failed to enforce storage quota", "err", err)
+	}
+
+	if config.GitCommit {
+		err = commitDataDir(cmdRunner, localDir, config.GitPush, gitCommitMessage(results, summary.NewByHost))
+		if err != nil {
+			slog.Error("Failed to commit data directory", "err", err)
+		}
+	}
+
+	run.End = time.Now()
+	err = appendRunRecord(config.StateDir, run)
+	if err != nil {
+		slog.Error("Failed to record run", "err", err)
+	}
+
+	if config.Output == "json" {
+		err = writeJSON(os.Stdout, FetchReport{Timestamp: run.Start, Results: results, Summary: summary})
+		if err != nil {
+			return fmt.Errorf("failed to write JSON output: %w", err)
+		}
+	} else if multiHost(results) {
+		printFetchTable(os.Stdout, results, summary.NewByHost)
+	}
+
+	if summaryErr != nil {
+		return errors.Join(fetchErr, summaryErr)
+	}
+	return fetchErr
+}
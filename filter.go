@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// patternList is a flag.Value collecting one regular expression per use of
+// the flag, since patterns may themselves contain commas
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *patternList) Set(value string) error {
+	// The command line is parsed twice, around the config file
+	for _, v := range *l {
+		if v == value {
+			return nil
+		}
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// commandFilter decides which commands are kept. Excluded commands are
+// dropped; when include patterns are given only commands matching one of
+// them are kept; commands shorter than minLength are left out of summaries.
+type commandFilter struct {
+	minLength int
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func newCommandFilter(config Config) (commandFilter, error) {
+	include, err := compilePatterns(config.Include)
+	if err != nil {
+		return commandFilter{}, err
+	}
+	exclude, err := compilePatterns(config.Exclude)
+	if err != nil {
+		return commandFilter{}, err
+	}
+	return commandFilter{minLength: config.MinLength, include: include, exclude: exclude}, nil
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed applies the include and exclude patterns only
+func (f commandFilter) allowed(command string) bool {
+	if matchesAny(f.exclude, command) {
+		return false
+	}
+	return len(f.include) == 0 || matchesAny(f.include, command)
+}
+
+// Keep reports whether command belongs in a summary
+func (f commandFilter) Keep(command string) bool {
+	return len(command) >= f.minLength && f.allowed(command)
+}
+
+// quarantineSnapshot moves the binary junk in the snapshot at path fetched
+// from target out of the way, see history.Quarantine
+func quarantineSnapshot(path, target string) error {
+	n, err := history.Quarantine(path)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine garbage in %s: %w", path, err)
+	}
+	if n > 0 {
+		slog.Warn("Moved binary garbage out of fetched history", "target", target, "lines", n, "dir", filepath.Join(filepath.Dir(path), history.CorruptDir))
+	}
+	return nil
+}
+
+// filterSnapshot drops the lines of a freshly fetched snapshot whose command
+// the include and exclude patterns reject, so they are never stored. The
+// minimum length is not applied here, leaving short commands for top.
+func filterSnapshot(path string, f commandFilter) error {
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return nil
+	}
+
+	_, lines, err := history.ReadLines(path)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if f.allowed(history.NormalizeLine(line)) {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return atomicfile.WriteFile(path, buf.Bytes(), 0o600)
+}
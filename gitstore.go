@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// gitCommitMessage names the hosts fetched in this run with the lines each
+// one's summary gained
+func gitCommitMessage(results []FetchResult, newByHost map[string]int) string {
+	var hosts []string
+	seen := make(map[string]bool)
+	total := 0
+	for _, r := range results {
+		if r.Err != nil || seen[r.Host] {
+			continue
+		}
+		seen[r.Host] = true
+		hosts = append(hosts, r.Host)
+		total += newByHost[r.Host]
+	}
+	sort.Strings(hosts)
+
+	var b strings.Builder
+	if len(hosts) == 1 {
+		fmt.Fprintf(&b, "Fetch %s: %d new lines\n", hosts[0], total)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Fetch %d hosts: %d new lines\n", len(hosts), total)
+	b.WriteString("\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "%s: %d new lines\n", host, newByHost[host])
+	}
+	return b.String()
+}
+
+func runGit(cmdRunner runner.Runner, dir string, args ...string) error {
+	slog.Debug("Executing command", "cmd", "git -C "+dir+" "+strings.Join(args, " "))
+	out, err := runner.Combined(cmdRunner, "git", append([]string{"-C", dir}, args...)...)
+	if err != nil {
+		return fmt.Errorf("git: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// commitDataDir commits everything that changed in dataDir, turning it
+// into a git repository first if it isn't one, and pushes the commit to
+// remote when that is set
+func commitDataDir(cmdRunner runner.Runner, dataDir, remote, message string) error {
+	_, err := os.Stat(filepath.Join(dataDir, ".git"))
+	if errors.Is(err, os.ErrNotExist) {
+		err = runGit(cmdRunner, dataDir, "init", "-q")
+		if err != nil {
+			return err
+		}
+		slog.Info("Initialized git repository", "path", dataDir)
+	} else if err != nil {
+		return err
+	}
+
+	err = runGit(cmdRunner, dataDir, "add", "-A")
+	if err != nil {
+		return err
+	}
+	// diff --quiet exits 0 when nothing is staged
+	if runGit(cmdRunner, dataDir, "diff", "--cached", "--quiet") == nil {
+		slog.Debug("Nothing changed in the data directory, not committing")
+		return nil
+	}
+
+	// A scheduled job often runs without a git identity
+	args := []string{"commit", "-q", "-m", message}
+	if out, err := runner.Output(cmdRunner, "git", "-C", dataDir, "config", "user.email"); err != nil || strings.TrimSpace(string(out)) == "" {
+		args = append([]string{"-c", "user.name=tarsnap", "-c", "user.email=tarsnap@localhost"}, args...)
+	}
+	err = runGit(cmdRunner, dataDir, args...)
+	if err != nil {
+		return err
+	}
+	slog.Info("Committed data directory", "path", dataDir, "message", strings.SplitN(message, "\n", 2)[0])
+
+	if remote == "" {
+		return nil
+	}
+	err = runGit(cmdRunner, dataDir, "push", "-q", remote, "HEAD")
+	if err != nil {
+		return err
+	}
+	slog.Info("Pushed data directory", "remote", remote)
+	return nil
+}
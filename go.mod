@@ -1,8 +1,11 @@
 module github.com/taylormonacelli/tarsnap
 
-go 1.20
+go 1.21
 
-require inet.af/netaddr v0.0.0-20230525184311-b8eac61e914a
+require (
+	gopkg.in/yaml.v3 v3.0.1
+	inet.af/netaddr v0.0.0-20230525184311-b8eac61e914a
+)
 
 require (
 	go4.org/intern v0.0.0-20230525184215-6c62f75575cb // indirect
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthcheck pings a healthchecks.io style check: <url>/start when a run
+// begins, <url> when it succeeds and <url>/fail with the error when it
+// fails. An empty url disables it.
+type healthcheck struct {
+	url    string
+	client *http.Client
+}
+
+func newHealthcheck(url string) healthcheck {
+	return healthcheck{url: strings.TrimSuffix(url, "/"), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// ping posts body to the check. A monitoring outage must never fail the
+// run itself, so errors are only logged.
+func (h healthcheck) ping(suffix, body string) {
+	if h.url == "" {
+		return
+	}
+	resp, err := h.client.Post(h.url+suffix, "text/plain", strings.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to ping healthcheck", "url", h.url+suffix, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Healthcheck ping rejected", "url", h.url+suffix, "status", resp.Status)
+	}
+}
+
+func (h healthcheck) start() {
+	h.ping("/start", "")
+}
+
+// finish reports the outcome of the run that start announced
+func (h healthcheck) finish(err error) {
+	if err != nil {
+		h.ping("/fail", err.Error())
+		return
+	}
+	h.ping("", "")
+}
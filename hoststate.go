@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+)
+
+// HostState is the fetch history of one host, kept in state.json
+type HostState struct {
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+
+	// Version is the tarsnap version that last fetched from the host
+	Version string `json:"version,omitempty"`
+
+	// BytesFetched and LinesAdded are totals over every fetch
+	BytesFetched int64 `json:"bytes_fetched"`
+	LinesAdded   int   `json:"lines_added"`
+
+	// Hashes maps each user to the checksum of their history at the last
+	// fetch, for --skip-unchanged
+	Hashes map[string]string `json:"hashes,omitempty"`
+
+	// Files maps each user to the size and leading checksum of their
+	// history at the last fetch, to notice when it's truncated or rotated
+	Files map[string]fetch.Probe `json:"files,omitempty"`
+
+	// Paths maps each user to the remote history Hashes and Files describe,
+	// so switching to another shell's history doesn't compare the two
+	Paths map[string]string `json:"paths,omitempty"`
+
+	// Shells maps each user to the shell detected for them, so detection
+	// runs once
+	Shells map[string]string `json:"shells,omitempty"`
+
+	// Rotations are the most recent times a history was found truncated or
+	// replaced and fetched in full
+	Rotations []Rotation `json:"rotations,omitempty"`
+
+	// Compacted are the snapshots compact removed as byte-identical copies
+	// of another
+	Compacted []CompactedSnapshot `json:"compacted,omitempty"`
+}
+
+// Rotation records a remote history that no longer continued the copy
+// taken by the previous fetch
+type Rotation struct {
+	User     string    `json:"user"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	PrevSize int64     `json:"prev_size"`
+	Size     int64     `json:"size"`
+}
+
+// CompactedSnapshot records a snapshot removed by compact, with paths
+// relative to the data directory
+type CompactedSnapshot struct {
+	Path    string    `json:"path"`
+	Kept    string    `json:"kept"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Removed time.Time `json:"removed"`
+}
+
+// maxRotations is how many rotation events are kept per host
+const maxRotations = 20
+
+func hostStatePath(stateDir string) string {
+	return filepath.Join(stateDir, "state.json")
+}
+
+// loadHostStates reads state.json. Checksums from the remote_hashes.json
+// that preceded it are carried over the first time.
+func loadHostStates(stateDir string) (map[string]*HostState, error) {
+	states := make(map[string]*HostState)
+	data, err := os.ReadFile(hostStatePath(stateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return states, migrateRemoteHashes(stateDir, states)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", hostStatePath(stateDir), err)
+	}
+	return states, nil
+}
+
+func saveHostStates(stateDir string, states map[string]*HostState) error {
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(stateDir, 0o700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(hostStatePath(stateDir), append(data, '\n'), 0o600)
+}
+
+func migrateRemoteHashes(stateDir string, states map[string]*HostState) error {
+	data, err := os.ReadFile(filepath.Join(stateDir, "remote_hashes.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	legacy := make(map[string]string)
+	err = json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+	for target, hash := range legacy {
+		user, host, ok := strings.Cut(target, "@")
+		if !ok {
+			continue
+		}
+		hostState(states, host).Hashes[user] = hash
+	}
+	return nil
+}
+
+// hostState returns the state of host, adding it if it's new
+func hostState(states map[string]*HostState, host string) *HostState {
+	st, ok := states[host]
+	if !ok {
+		st = &HostState{}
+		states[host] = st
+	}
+	if st.Hashes == nil {
+		st.Hashes = make(map[string]string)
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]fetch.Probe)
+	}
+	if st.Paths == nil {
+		st.Paths = make(map[string]string)
+	}
+	return st
+}
+
+// lastFetch returns the checksum and probe of user's history at the last
+// fetch from host, or nothing when that fetch copied another file than
+// remotePath. States from before paths were kept are taken to match.
+func lastFetch(states map[string]*HostState, host, user, remotePath string) (string, fetch.Probe) {
+	st := states[host]
+	if st == nil {
+		return "", fetch.Probe{}
+	}
+	if p := st.Paths[user]; p != "" && p != remotePath {
+		return "", fetch.Probe{}
+	}
+	return st.Hashes[user], st.Files[user]
+}
+
+// recordFetches updates states with the results of a run. A host counts
+// as failed when any of its users failed. linesAdded holds the new summary
+// lines per host and may be nil. It returns the hosts that have just
+// reached alertAfter consecutive failures.
+func recordFetches(states map[string]*HostState, results []FetchResult, linesAdded map[string]int, alertAfter int, now time.Time) []string {
+	failed := make(map[string]error)
+	for _, r := range results {
+		st := hostState(states, r.Host)
+		st.LastAttempt = now
+		if r.Err != nil {
+			if failed[r.Host] == nil {
+				failed[r.Host] = fmt.Errorf("%s: %w", r.User, r.Err)
+			}
+			continue
+		}
+		st.BytesFetched += r.Bytes
+		if r.RemotePath != "" && r.RemotePath != st.Paths[r.User] {
+			delete(st.Hashes, r.User)
+			delete(st.Files, r.User)
+			st.Paths[r.User] = r.RemotePath
+		}
+		if r.Hash != "" {
+			st.Hashes[r.User] = r.Hash
+		}
+		if r.Rotated != "" {
+			st.Rotations = append(st.Rotations, Rotation{User: r.User, Time: now, Reason: r.Rotated, PrevSize: st.Files[r.User].Size, Size: r.Probe.Size})
+			if len(st.Rotations) > maxRotations {
+				st.Rotations = st.Rotations[len(st.Rotations)-maxRotations:]
+			}
+		}
+		if r.Probe.Size > 0 {
+			st.Files[r.User] = r.Probe
+		}
+		if r.DetectedShell != "" {
+			if st.Shells == nil {
+				st.Shells = make(map[string]string)
+			}
+			st.Shells[r.User] = r.DetectedShell
+		}
+	}
+
+	var alerts []string
+	for host, st := range states {
+		if !st.LastAttempt.Equal(now) {
+			continue
+		}
+		st.LinesAdded += linesAdded[host]
+		if err := failed[host]; err != nil {
+			st.LastError = err.Error()
+			st.ConsecutiveFailures++
+			if alertAfter > 0 && st.ConsecutiveFailures == alertAfter {
+				alerts = append(alerts, host)
+			}
+			continue
+		}
+		st.LastSuccess = now
+		st.LastError = ""
+		st.ConsecutiveFailures = 0
+	}
+	return alerts
+}
+
+// updateHostStates records a run in state.json and notifies about hosts
+// that keep failing
+func updateHostStates(config Config, results []FetchResult, linesAdded map[string]int, now time.Time) error {
+	states, err := loadHostStates(config.StateDir)
+	if err != nil {
+		return err
+	}
+
+	alerts := recordFetches(states, results, linesAdded, config.AlertAfter, now)
+	for _, st := range states {
+		if st.LastAttempt.Equal(now) {
+			st.Version = buildInfo().Version
+		}
+	}
+	for _, host := range alerts {
+		st := states[host]
+		newNotifier(config).hostFailing(host, st.ConsecutiveFailures, st.LastSuccess, st.LastError)
+	}
+
+	return saveHostStates(config.StateDir, states)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+)
+
+// HostStats sums up the ledger entries of one host
+type HostStats struct {
+	Host      string
+	Users     int
+	Commands  int
+	Runs      int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// reportBar is one row of a frequency chart; Percent is relative to the
+// largest count in the chart
+type reportBar struct {
+	Label   string
+	Count   int
+	Percent int
+}
+
+type htmlReportData struct {
+	Generated time.Time
+	Version   string
+	Hosts     []HostStats
+	Tools     []reportBar
+	Commands  []reportBar
+	Recent    []LedgerEntry
+	Entries   []LedgerEntry
+}
+
+// hostStats groups entries by host, in host order
+func hostStats(entries []LedgerEntry) []HostStats {
+	byHost := make(map[string]*HostStats)
+	users := make(map[string]map[string]bool)
+	for _, e := range entries {
+		s := byHost[e.Host]
+		if s == nil {
+			s = &HostStats{Host: e.Host, FirstSeen: e.FirstSeen}
+			byHost[e.Host] = s
+			users[e.Host] = make(map[string]bool)
+		}
+		users[e.Host][e.User] = true
+		s.Commands++
+		s.Runs += e.Count
+		if e.FirstSeen.Before(s.FirstSeen) {
+			s.FirstSeen = e.FirstSeen
+		}
+		if e.LastSeen.After(s.LastSeen) {
+			s.LastSeen = e.LastSeen
+		}
+	}
+
+	stats := make([]HostStats, 0, len(byHost))
+	for host, s := range byHost {
+		s.Users = len(users[host])
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+	return stats
+}
+
+// chartBars turns the top limit counts into bars
+func chartBars(counts map[string]int, limit int) []reportBar {
+	var bars []reportBar
+	for i, k := range rankCounts(counts) {
+		if i >= limit {
+			break
+		}
+		bars = append(bars, reportBar{Label: k, Count: counts[k]})
+	}
+	if len(bars) > 0 && bars[0].Count > 0 {
+		for i := range bars {
+			bars[i].Percent = bars[i].Count * 100 / bars[0].Count
+		}
+	}
+	return bars
+}
+
+// buildHTMLReport gathers what the report shows from the ledger entries
+func buildHTMLReport(entries []LedgerEntry, top, recent int, now time.Time) htmlReportData {
+	data := htmlReportData{Generated: now, Version: buildInfo().Version, Hosts: hostStats(entries), Entries: entries}
+
+	_, tools := classifyLedger(entries, "")
+	toolRuns := make(map[string]int)
+	for tool, c := range tools {
+		toolRuns[tool] = c.Runs
+	}
+	data.Tools = chartBars(toolRuns, top)
+
+	commandRuns := make(map[string]int)
+	for _, e := range entries {
+		commandRuns[e.Cmd] += e.Count
+	}
+	data.Commands = chartBars(commandRuns, top)
+
+	// Entries are oldest first, so the recent additions are at the end
+	for i := len(entries) - 1; i >= 0 && len(data.Recent) < recent; i-- {
+		data.Recent = append(data.Recent, entries[i])
+	}
+	return data
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>tarsnap report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; margin: 2em; color: #222; }
+h1 { margin-bottom: 0; }
+.meta { color: #777; margin-top: .2em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { text-align: left; padding: .25em .8em; border-bottom: 1px solid #eee; vertical-align: top; }
+th { background: #f6f6f6; }
+td.num { text-align: right; }
+code { font-family: ui-monospace, Menlo, monospace; white-space: pre-wrap; word-break: break-all; }
+.charts { display: flex; flex-wrap: wrap; gap: 3em; }
+.chart { min-width: 24em; flex: 1; }
+.bar { display: flex; align-items: center; margin: .15em 0; }
+.bar .label { width: 40%; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; font-family: ui-monospace, Menlo, monospace; }
+.bar .fill { background: #4a7fd4; height: 1em; margin-right: .4em; }
+#search { width: 30em; padding: .3em; font-size: 1em; }
+</style>
+</head>
+<body>
+<h1>tarsnap report</h1>
+<p class="meta">Generated {{date .Generated}}{{with .Version}} by tarsnap {{.}}{{end}}</p>
+
+<h2>Hosts</h2>
+<table>
+<tr><th>Host</th><th>Users</th><th>Commands</th><th>Runs</th><th>First seen</th><th>Last seen</th></tr>
+{{range .Hosts}}<tr><td>{{.Host}}</td><td class="num">{{.Users}}</td><td class="num">{{.Commands}}</td><td class="num">{{.Runs}}</td><td>{{date .FirstSeen}}</td><td>{{date .LastSeen}}</td></tr>
+{{end}}</table>
+
+<div class="charts">
+<div class="chart">
+<h2>Top tools</h2>
+{{range .Tools}}<div class="bar"><span class="label">{{.Label}}</span><span class="fill" style="width: {{.Percent}}%"></span>{{.Count}}</div>
+{{end}}</div>
+<div class="chart">
+<h2>Top commands</h2>
+{{range .Commands}}<div class="bar"><span class="label" title="{{.Label}}">{{.Label}}</span><span class="fill" style="width: {{.Percent}}%"></span>{{.Count}}</div>
+{{end}}</div>
+</div>
+
+<h2>Recent additions</h2>
+<table>
+<tr><th>First seen</th><th>Host</th><th>User</th><th>Command</th></tr>
+{{range .Recent}}<tr><td>{{date .FirstSeen}}</td><td>{{.Host}}</td><td>{{.User}}</td><td><code>{{.Cmd}}</code></td></tr>
+{{end}}</table>
+
+<h2>History</h2>
+<input id="search" type="search" placeholder="Filter commands, hosts or users">
+<table id="history">
+<thead><tr><th>First seen</th><th>Last seen</th><th>Runs</th><th>Host</th><th>User</th><th>Command</th></tr></thead>
+<tbody>
+{{range .Entries}}<tr><td>{{date .FirstSeen}}</td><td>{{date .LastSeen}}</td><td class="num">{{.Count}}</td><td>{{.Host}}</td><td>{{.User}}</td><td><code>{{.Cmd}}</code></td></tr>
+{{end}}</tbody>
+</table>
+<script>
+document.getElementById("search").addEventListener("input", function () {
+  var q = this.value.toLowerCase();
+  document.querySelectorAll("#history tbody tr").forEach(function (tr) {
+    tr.style.display = tr.textContent.toLowerCase().indexOf(q) >= 0 ? "" : "none";
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// runReportCommand implements `tarsnap report`, rendering the ledger as a
+// standalone page that is easier to share than summary.txt
+func runReportCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "html", "Report format: html")
+	out := fs.String("out", "", "File to write, or standard output when empty")
+	top := fs.Int("n", 20, "Number of tools and commands in each chart")
+	recent := fs.Int("recent", 50, "Number of recent additions to list")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return errors.New("usage: tarsnap report [-format html] [-out file]")
+	}
+	if *format != "html" {
+		return fmt.Errorf("unknown report format %q, want html", *format)
+	}
+
+	filter, err := newCommandFilter(config)
+	if err != nil {
+		return err
+	}
+	ledger, err := loadLedger(ledgerPath(config.DataDir))
+	if err != nil {
+		return err
+	}
+	var entries []LedgerEntry
+	for _, e := range ledger.Kept(filter) {
+		if config.Host == "" || e.Host == config.Host {
+			entries = append(entries, e)
+		}
+	}
+
+	data := buildHTMLReport(entries, *top, *recent, time.Now())
+	if *out == "" {
+		return htmlReportTemplate.Execute(os.Stdout, data)
+	}
+
+	var buf bytes.Buffer
+	err = htmlReportTemplate.Execute(&buf, data)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(*out, buf.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", *out, err)
+	}
+	slog.Info("Wrote report", "path", *out, "hosts", len(data.Hosts), "commands", len(entries))
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// ImportReport is what `tarsnap import` emits with --output json
+type ImportReport struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	Path   string `json:"path,omitempty"`
+	Lines  int    `json:"lines"`
+	Added  int    `json:"added"`
+}
+
+// importHistory stores the lines of data whose command isn't anywhere in
+// dataDir yet as a new snapshot for user and host, returning its path and
+// the number of lines stored. Nothing is written when every line is known.
+func importHistory(dataDir, user, host string, data []byte, now time.Time) (string, int, error) {
+	known, err := history.UniqueLines(dataDir, nil)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", 0, err
+	}
+	seen := make(map[string]struct{}, len(known))
+	for _, line := range known {
+		seen[line] = struct{}{}
+	}
+
+	var buf bytes.Buffer
+	added := 0
+	for _, line := range history.PairTimestamps(strings.Split(string(data), "\n")) {
+		command := history.NormalizeLine(line)
+		if strings.TrimSpace(command) == "" {
+			continue
+		}
+		if _, ok := seen[command]; ok {
+			continue
+		}
+		seen[command] = struct{}{}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		added++
+	}
+	if added == 0 {
+		return "", 0, nil
+	}
+
+	path := filepath.Join(dataDir, user, fmt.Sprintf("bash_history_%s_%s.txt", host, now.Format("20060102_150405")))
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, added, atomicfile.WriteFile(path, buf.Bytes(), 0o600)
+}
+
+// runImportCommand implements `tarsnap import <file>`, seeding the store
+// with a local history file
+func runImportCommand(config Config, args []string) error {
+	defaultUser := "local"
+	if u, err := user.Current(); err == nil {
+		defaultUser = u.Username
+	}
+	defaultHost, err := os.Hostname()
+	if err != nil {
+		defaultHost = "localhost"
+	}
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	userName := fs.String("user", defaultUser, "User the history is stored under")
+	host := fs.String("host", defaultHost, "Host the history is recorded as coming from")
+	format := fs.String("format", "auto", "History format: auto, bash, zsh or fish")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: tarsnap import [flags] <file>")
+	}
+	file := fs.Arg(0)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	report := ImportReport{File: file, Format: *format}
+	switch report.Format {
+	case "auto":
+		report.Format = history.DetectFormat(data)
+	case "bash", "zsh", "fish":
+	default:
+		return fmt.Errorf("unknown history format %q, want auto, bash, zsh or fish", report.Format)
+	}
+	if report.Format == "fish" {
+		data = history.ConvertFish(data)
+	}
+	report.Lines = bytes.Count(data, []byte("\n"))
+
+	localDir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		return err
+	}
+
+	// A scheduled fetch appends to the same summaries and dedup indexes
+	unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+	if err != nil {
+		return fmt.Errorf("another run is in progress: %w", err)
+	}
+	defer unlock()
+
+	// Host names end up in snapshot names the same way addresses do
+	hostPart := schedule.SanitizeHost(*host)
+	report.Path, report.Added, err = importHistory(localDir, *userName, hostPart, data, time.Now())
+	if err == nil && report.Added > 0 {
+		report.Path, err = history.Encrypt(report.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", file, err)
+	}
+
+	if report.Added > 0 {
+		// The imported user gets a summary of their own even when no
+		// configured host has them
+		if !slices.Contains(config.allUsers(), *userName) {
+			config.Users = append(append([]string{}, config.Users...), *userName)
+		}
+		_, err = summarize(config, localDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Output == "json" {
+		return writeJSON(os.Stdout, report)
+	}
+	slog.Info("Imported history", "file", file, "format", report.Format, "lines", report.Lines, "added", report.Added, "path", report.Path)
+	return nil
+}
@@ -0,0 +1,99 @@
+// Package atomicfile writes files so that a crash never leaves one half
+// written: data goes to a temporary file in the same directory, is synced,
+// and is then renamed into place.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// File is written under a temporary name in the destination's
+// directory and only appears at its real path once Commit renames it there,
+// so a crash mid-write never leaves a half-written file behind
+type File struct {
+	*os.File
+	path string
+	perm os.FileMode
+}
+
+// Create starts a File that Commit will move to path with perm
+func Create(path string, perm os.FileMode) (*File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: tmp, path: path, perm: perm}, nil
+}
+
+// Commit flushes the file to disk and renames it into place
+func (f *File) Commit() error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), f.perm)
+	}
+	if err == nil {
+		err = Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Abort discards the file; it does nothing after a successful Commit
+func (f *File) Abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// Rename renames oldpath to newpath and syncs the directory so the
+// rename itself survives a crash
+func Rename(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(newpath))
+	if err != nil {
+		return nil
+	}
+	defer dir.Close()
+
+	// Not every platform can sync a directory, and the rename is done
+	dir.Sync()
+	return nil
+}
+
+// Sync flushes a file written by another program, such as scp, to disk
+func Sync(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteFile replaces path with data by writing a temporary file in
+// the same directory and renaming it over path, so readers see either the
+// old or the new contents and never a half-written file
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := Create(path, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,73 @@
+package fetch
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/secrets"
+)
+
+// AskpassEnv is set when ssh runs tarsnap as its askpass program. The
+// secrets are passed as references or commands, never as values.
+const AskpassEnv = "TARSNAP_ASKPASS"
+
+const (
+	askpassCommandEnv    = "TARSNAP_ASKPASS_COMMAND"
+	askpassPasswordEnv   = "TARSNAP_ASKPASS_PASSWORD"
+	askpassPassphraseEnv = "TARSNAP_ASKPASS_PASSPHRASE"
+)
+
+// askpassEnv returns the environment making ssh ask RunAskpass for the
+// password and passphrase o configures, or nil when ssh should prompt
+func askpassEnv(o Options) []string {
+	var env []string
+	if o.PasswordAuth && o.PasswordCommand != "" {
+		env = append(env, askpassCommandEnv+"="+o.PasswordCommand)
+	}
+	if o.PasswordAuth && o.Password != "" {
+		env = append(env, askpassPasswordEnv+"="+o.Password)
+	}
+	if o.Passphrase != "" {
+		env = append(env, askpassPassphraseEnv+"="+o.Passphrase)
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return append([]string{"SSH_ASKPASS=" + o.Askpass, "SSH_ASKPASS_REQUIRE=force", AskpassEnv + "=1"}, env...)
+}
+
+// RunAskpass prints the answer to ssh's prompt: the key passphrase, or the
+// password from its command or secret
+func RunAskpass(prompt string) error {
+	if strings.Contains(strings.ToLower(prompt), "passphrase") {
+		return printSecret(os.Getenv(askpassPassphraseEnv))
+	}
+
+	if command := os.Getenv(askpassCommandEnv); command != "" {
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/c"
+		}
+		cmd := exec.Command(shell, flag, command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	return printSecret(os.Getenv(askpassPasswordEnv))
+}
+
+func printSecret(ref string) error {
+	if ref == "" {
+		return fmt.Errorf("nothing configured to answer the prompt")
+	}
+	secret, err := secrets.Resolve(runner.Exec{}, ref)
+	if err != nil {
+		return err
+	}
+	fmt.Println(secret)
+	return nil
+}
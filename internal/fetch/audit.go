@@ -0,0 +1,243 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// IsAuditSource reports whether collect reads commands from the audit log
+// instead of copying a history file: auditd through ausearch, or journald
+// on hosts where the audit records go to the journal
+func IsAuditSource(collect string) bool {
+	return collect == "auditd" || collect == "journald"
+}
+
+// auditCommand prints the execve records of user, through sudo -n with
+// sudo set. ausearch reads stdin when it isn't a terminal, hence
+// --input-logs. journalctl can't filter by user, so the uid comes first and
+// the records are matched to it locally.
+func auditCommand(collect, user string, sudo bool) string {
+	prefix := ""
+	if sudo {
+		prefix = "sudo -n "
+	}
+	if collect == "journald" {
+		return fmt.Sprintf("id -u %s && %sjournalctl -q --no-pager -o json _TRANSPORT=audit", runner.ShellQuote(user), prefix)
+	}
+	return fmt.Sprintf("%sausearch --input-logs --format raw -sc execve -ua %s", prefix, runner.ShellQuote(user))
+}
+
+// auditPermissionErrors are what sudo, ausearch and journalctl say when the
+// audit records can't be read. journalctl only hints and still succeeds.
+var auditPermissionErrors = []string{
+	"a password is required",
+	"a terminal is required",
+	"is not in the sudoers file",
+	"Error opening",
+	"You are currently not seeing messages from other users",
+	"insufficient permissions",
+}
+
+// auditPermissionError explains a failure to read the audit records in
+// stderr, or returns nil when there was none
+func auditPermissionError(collect, login string, sudo bool, stderr string) error {
+	for _, msg := range auditPermissionErrors {
+		if !strings.Contains(stderr, msg) {
+			continue
+		}
+		if sudo {
+			tool := "ausearch"
+			if collect == "journald" {
+				tool = "journalctl"
+			}
+			return fmt.Errorf("%s can't read the audit records with sudo -n; allow it to run %s without a password: %s", login, tool, strings.TrimSpace(stderr))
+		}
+		return fmt.Errorf("%s can't read the audit records, which need root or, for journald, the adm group; use -audit-sudo or -audit-user: %s", login, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// Audit saves the commands user ran on ip, according to the audit log
+// collect names, to localFile as zsh extended history lines so they carry
+// their time into the ledger
+func Audit(r Remote, user, ip, localFile, collect string) (string, error) {
+	absLocalFile, err := filepath.Abs(localFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	login := user
+	if r.AuditUser != "" {
+		login = r.AuditUser
+	}
+	target := login + "@" + ip
+	remoteCmd := auditCommand(collect, user, r.AuditSudo)
+	args := append(append([]string{}, r.Options...), target, remoteCmd)
+	if r.DryRun {
+		runner.PrintDryRun("ssh", args...)
+		return absLocalFile, nil
+	}
+
+	var stdout bytes.Buffer
+	var stderr strings.Builder
+	cmd := runner.Command{Name: "ssh", Args: args, Stdout: newThrottledWriter(&stdout, r.BWLimit), Stderr: &stderr, Env: r.Env}
+
+	slog.Debug("Executing command", "cmd", fmt.Sprintf("ssh %s %s %q", strings.Join(r.Options, " "), target, remoteCmd))
+
+	_, err = r.Runner.Run(cmd)
+	if permErr := auditPermissionError(collect, login, r.AuditSudo, stderr.String()); permErr != nil {
+		return "", fmt.Errorf("%s failed on %s: %w", collect, ip, permErr)
+	}
+	// ausearch fails when nothing matched, which is just an empty history
+	if err != nil && !strings.Contains(stderr.String(), "<no matches>") {
+		return "", fmt.Errorf("%s failed: %w", collect, hostKeyError(target, stderr.String(), err))
+	}
+
+	data := stdout.Bytes()
+	uid := ""
+	if collect == "journald" {
+		first, rest, _ := bytes.Cut(data, []byte("\n"))
+		uid = strings.TrimSpace(string(first))
+		data = journalAuditRecords(rest)
+	}
+
+	err = os.MkdirAll(filepath.Dir(absLocalFile), 0o700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = atomicfile.WriteFile(absLocalFile, ConvertAudit(data, uid), 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s: %w", absLocalFile, err)
+	}
+
+	slog.Debug("Captured audit log", "target", target, "source", collect, "local", absLocalFile)
+	return absLocalFile, nil
+}
+
+// journalAuditRecords turns journalctl's JSON entries for audit records
+// back into the raw lines ausearch prints
+func journalAuditRecords(data []byte) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry struct {
+			Type     string `json:"_AUDIT_TYPE_NAME"`
+			ID       string `json:"_AUDIT_ID"`
+			Realtime string `json:"__REALTIME_TIMESTAMP"`
+			Message  any    `json:"MESSAGE"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		// Messages that aren't valid UTF-8 come as byte arrays and are skipped
+		msg, ok := entry.Message.(string)
+		if !ok || entry.Type == "" || entry.ID == "" {
+			continue
+		}
+		usec, err := strconv.ParseInt(entry.Realtime, 10, 64)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&out, "type=%s msg=audit(%d.%03d:%s): %s\n", entry.Type, usec/1e6, usec/1e3%1e3, entry.ID, msg)
+	}
+	return out.Bytes()
+}
+
+// auditRecordRe matches a raw audit record: its type, time and serial
+var auditRecordRe = regexp.MustCompile(`^type=(\w+) msg=audit\((\d+)\.\d+:(\d+)\):\s*(.*)$`)
+
+// auditArgRe matches an argument of an EXECVE record, a0="ls" or a1=2D6C,
+// including the pieces a1[0]= of one too long for a single record
+var auditArgRe = regexp.MustCompile(`\ba(\d+)(?:\[(\d+)\])?=("[^"]*"|[0-9A-F]+)`)
+
+// auditUIDRe matches the user a SYSCALL record ran as
+var auditUIDRe = regexp.MustCompile(`\b(?:auid|uid)=(\d+)\b`)
+
+// ConvertAudit turns raw execve audit records into zsh extended history
+// lines, one per command in the order they ran. With uid set, only
+// commands whose SYSCALL record has that uid or login uid are kept.
+func ConvertAudit(data []byte, uid string) []byte {
+	type event struct {
+		when  int64
+		args  map[int]string
+		users map[string]bool
+	}
+	events := make(map[string]*event)
+	var order []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := auditRecordRe.FindStringSubmatch(scanner.Text())
+		if m == nil || (m[1] != "EXECVE" && m[1] != "SYSCALL") {
+			continue
+		}
+		when, _ := strconv.ParseInt(m[2], 10, 64)
+		ev, ok := events[m[3]]
+		if !ok {
+			ev = &event{when: when, args: make(map[int]string), users: make(map[string]bool)}
+			events[m[3]] = ev
+			order = append(order, m[3])
+		}
+		if m[1] == "SYSCALL" {
+			for _, u := range auditUIDRe.FindAllStringSubmatch(m[4], -1) {
+				ev.users[u[1]] = true
+			}
+			continue
+		}
+		for _, a := range auditArgRe.FindAllStringSubmatch(m[4], -1) {
+			n, _ := strconv.Atoi(a[1])
+			ev.args[n] += auditArg(a[3])
+		}
+	}
+
+	var out bytes.Buffer
+	for _, serial := range order {
+		ev := events[serial]
+		if len(ev.args) == 0 || (uid != "" && !ev.users[uid]) {
+			continue
+		}
+		indexes := make([]int, 0, len(ev.args))
+		for n := range ev.args {
+			indexes = append(indexes, n)
+		}
+		sort.Ints(indexes)
+		words := make([]string, 0, len(indexes))
+		for _, n := range indexes {
+			words = append(words, runner.ShellQuote(ev.args[n]))
+		}
+		command := strings.Join(words, " ")
+		if strings.ContainsAny(command, "\n\r") {
+			continue
+		}
+		fmt.Fprintf(&out, ": %d:0;%s\n", ev.when, command)
+	}
+	return out.Bytes()
+}
+
+// auditArg decodes an argument, which auditd writes hex encoded when it
+// holds spaces, quotes or control characters
+func auditArg(value string) string {
+	if strings.HasPrefix(value, `"`) {
+		return strings.Trim(value, `"`)
+	}
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+	return string(decoded)
+}
@@ -0,0 +1,36 @@
+package fetch
+
+import (
+	"io"
+	"time"
+)
+
+// throttledWriter passes writes on to w no faster than rate bytes per
+// second. Blocking the writer holds up the pipe from ssh, which in turn
+// slows the transfer down.
+type throttledWriter struct {
+	w       io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottledWriter(w io.Writer, kibPerSec int) io.Writer {
+	if kibPerSec <= 0 {
+		return w
+	}
+	return &throttledWriter{w: w, rate: int64(kibPerSec) * 1024}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	n, err := t.w.Write(p)
+	t.written += int64(n)
+	due := t.start.Add(time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,38 @@
+package fetch
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SessionDir is where shells set up by onboard register their PID, so only
+// shells with a handler installed are ever signalled
+const SessionDir = "~/.tarsnap_sessions"
+
+// flushScript signals every registered shell that is still a bash or zsh
+// to append its in-memory history, dropping registrations of shells that
+// have exited, then gives them a moment to write. It prints how many shells
+// were signalled.
+const flushScript = `n=0
+for f in ` + SessionDir + `/*; do
+  [ -e "$f" ] || continue
+  p=${f##*/}
+  case "$(ps -o comm= -p "$p" 2>/dev/null)" in
+    bash|-bash|zsh|-zsh) kill -USR1 "$p" 2>/dev/null && n=$((n+1)) ;;
+    *) rm -f "$f" ;;
+  esac
+done
+[ "$n" -eq 0 ] || sleep 1
+echo "$n"`
+
+// FlushHistory asks user's live shells on ip to write their history to
+// disk before it is copied, returning how many were asked. Only shells
+// registered by the onboard snippet are signalled.
+func FlushHistory(remote Remote, user, ip string) (int, error) {
+	out, err := remote.Run(user+"@"+ip, flushScript, "")
+	if err != nil || out == "" {
+		return 0, err
+	}
+	fields := strings.Fields(out)
+	return strconv.Atoi(fields[len(fields)-1])
+}
@@ -0,0 +1,21 @@
+package fetch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HistoryHash checksums remotePath on the host without copying it.
+// sha256sum is tried first, then shasum for macOS hosts.
+func HistoryHash(remote Remote, user, ip, remotePath string) (string, error) {
+	script := fmt.Sprintf("sha256sum %[1]s 2>/dev/null || shasum -a 256 %[1]s", remotePath)
+	out, err := remote.Run(user+"@"+ip, script, "")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], nil
+}
@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// Multiplexer keeps one ssh master connection open per user@host, so the
+// checksum, copy, artifacts and metadata of a target all ride on a single
+// TCP connection and authentication instead of a handshake each
+type Multiplexer struct {
+	dir     string
+	runner  runner.Runner
+	mu      sync.Mutex
+	masters map[string]*master
+}
+
+type master struct {
+	path  string
+	ready bool
+	once  sync.Once
+	done  chan struct{}
+	args  []string
+	env   []string
+}
+
+// NewMultiplexer creates the private directory the control sockets live
+// in. Socket paths are limited to about a hundred bytes, so it's made under
+// /tmp rather than the longer per-user temporary directory macOS has.
+func NewMultiplexer(cmdRunner runner.Runner) (*Multiplexer, error) {
+	base := "/tmp"
+	if _, err := os.Stat(base); err != nil {
+		base = os.TempDir()
+	}
+	dir, err := os.MkdirTemp(base, "tarsnap-ssh-")
+	if err != nil {
+		return nil, err
+	}
+	return &Multiplexer{dir: dir, runner: cmdRunner, masters: make(map[string]*master)}, nil
+}
+
+// Connect returns r set up to share the master connection to target,
+// starting it the first time target is seen. When the master can't be
+// started r is returned as is and connects on its own.
+func (m *Multiplexer) Connect(r Remote, target string) Remote {
+	if m == nil || r.DryRun {
+		return r
+	}
+
+	m.mu.Lock()
+	mc := m.masters[target]
+	if mc == nil {
+		mc = &master{path: filepath.Join(m.dir, fmt.Sprint(len(m.masters))), done: make(chan struct{})}
+		m.masters[target] = mc
+	}
+	m.mu.Unlock()
+
+	mc.once.Do(func() { m.start(mc, r, target) })
+	if !mc.ready {
+		return r
+	}
+	r.Options = append(append([]string{}, r.Options...), "-o", "ControlMaster=no", "-o", "ControlPath="+mc.path)
+	return r
+}
+
+// start runs the master for target in the background and waits until its
+// control socket appears or it gives up
+func (m *Multiplexer) start(mc *master, r Remote, target string) {
+	mc.args = append(append([]string{}, r.Options...), "-o", "ControlMaster=yes", "-o", "ControlPath="+mc.path, "-N", target)
+	mc.env = r.Env
+	slog.Debug("Executing command", "cmd", "ssh "+strings.Join(mc.args, " "))
+	go func() {
+		defer close(mc.done)
+		out, err := m.runner.Run(runner.Command{Name: "ssh", Args: mc.args, Env: mc.env, Combined: true})
+		if err != nil {
+			slog.Debug("ssh master connection ended", "target", target, "err", hostKeyError(target, string(out), err))
+		}
+	}()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(mc.path); err == nil {
+			mc.ready = true
+			return
+		}
+		select {
+		case <-mc.done:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Close ends every master connection and removes the socket directory
+func (m *Multiplexer) Close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for target, mc := range m.masters {
+		if mc.args == nil {
+			continue
+		}
+		if mc.ready {
+			_, err := m.runner.Run(runner.Command{Name: "ssh", Args: []string{"-o", "ControlPath=" + mc.path, "-O", "exit", target}, Combined: true})
+			if err != nil {
+				slog.Debug("Failed to stop ssh master connection", "target", target, "err", err)
+			}
+		}
+		select {
+		case <-mc.done:
+		case <-time.After(5 * time.Second):
+			slog.Warn("ssh master connection didn't exit", "target", target)
+		}
+	}
+	os.RemoveAll(m.dir)
+}
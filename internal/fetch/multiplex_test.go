@@ -0,0 +1,102 @@
+package fetch
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// controlPath returns the ControlPath option among args
+func controlPath(args []string) string {
+	for _, arg := range args {
+		if path, ok := strings.CutPrefix(arg, "ControlPath="); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+func TestMultiplexerSharesOneMaster(t *testing.T) {
+	var mu sync.Mutex
+	var masters, exits int
+	stop := make(chan struct{})
+	fake := runFunc(func(c runner.Command) ([]byte, error) {
+		switch {
+		case slices.Contains(c.Args, "ControlMaster=yes"):
+			// The master creates its socket and runs until told to exit
+			mu.Lock()
+			masters++
+			mu.Unlock()
+			err := os.WriteFile(controlPath(c.Args), nil, 0o600)
+			if err != nil {
+				return nil, err
+			}
+			<-stop
+			return nil, nil
+		case slices.Contains(c.Args, "exit"):
+			mu.Lock()
+			exits++
+			mu.Unlock()
+			close(stop)
+			return nil, nil
+		}
+		return nil, errors.New("unexpected command " + c.String())
+	})
+
+	m, err := NewMultiplexer(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Remote{Options: []string{"-o", "BatchMode=yes"}, Runner: fake}
+
+	first := m.Connect(r, "ops@web1")
+	second := m.Connect(r, "ops@web1")
+	want := []string{"-o", "BatchMode=yes", "-o", "ControlMaster=no", "-o", "ControlPath=" + m.masters["ops@web1"].path}
+	if !slices.Equal(first.Options, want) || !slices.Equal(second.Options, want) {
+		t.Errorf("options = %q and %q, want %q", first.Options, second.Options, want)
+	}
+	if len(r.Options) != 2 {
+		t.Errorf("Connect changed the caller's options: %q", r.Options)
+	}
+
+	dir := m.dir
+	m.Close()
+	if masters != 1 || exits != 1 {
+		t.Errorf("started %d masters and stopped %d, want one each", masters, exits)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("socket directory left behind: %v", err)
+	}
+}
+
+func TestMultiplexerFallsBack(t *testing.T) {
+	fake := &runner.Fake{}
+	m, err := NewMultiplexer(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// A master that exits without a socket leaves the remote connecting
+	// on its own
+	r := Remote{Options: []string{"-o", "BatchMode=yes"}, Runner: fake}
+	got := m.Connect(r, "ops@web1")
+	if !slices.Equal(got.Options, r.Options) {
+		t.Errorf("options = %q, want %q", got.Options, r.Options)
+	}
+
+	// Dry runs and a nil Multiplexer never start one
+	r.DryRun = true
+	m.Connect(r, "ops@web2")
+	var none *Multiplexer
+	none.Connect(Remote{Runner: fake}, "ops@web3")
+	none.Close()
+	if len(fake.Calls) != 1 {
+		t.Errorf("ran %d commands, want only the failed master", len(fake.Calls))
+	}
+}
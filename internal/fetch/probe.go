@@ -0,0 +1,77 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HeadSize is how much of the start of a history file is checksummed to
+// tell a file that kept growing from one that was truncated or replaced
+const HeadSize = 4096
+
+// Probe is the size of a history file and the checksum of its first
+// HeadSize bytes
+type Probe struct {
+	Size int64  `json:"size"`
+	Head string `json:"head,omitempty"`
+}
+
+// ProbeHistory probes remotePath on the host without copying it
+func ProbeHistory(remote Remote, user, ip, remotePath string) (Probe, error) {
+	script := fmt.Sprintf("wc -c < %[1]s && head -c %[2]d %[1]s | (sha256sum 2>/dev/null || shasum -a 256)", remotePath, HeadSize)
+	out, err := remote.Run(user+"@"+ip, script, "")
+	if err != nil || out == "" {
+		return Probe{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return Probe{}, fmt.Errorf("unexpected probe output %q", out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Probe{}, fmt.Errorf("unexpected probe output %q", out)
+	}
+	return Probe{Size: size, Head: fields[1]}, nil
+}
+
+// ProbeFile probes a local copy of a history file
+func ProbeFile(path string) (Probe, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Probe{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return Probe{}, err
+	}
+	h := sha256.New()
+	_, err = io.CopyN(h, file, HeadSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Probe{}, err
+	}
+	return Probe{Size: info.Size(), Head: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Rotated reports why the history probed as cur can't have grown out of
+// the one probed as prev, or "" when it can. The heads are only compared
+// once prev was at least HeadSize long, as until then they cover different
+// lengths.
+func Rotated(prev, cur Probe) string {
+	switch {
+	case prev.Size == 0:
+		return ""
+	case cur.Size < prev.Size:
+		return "size decreased"
+	case prev.Size >= HeadSize && prev.Head != "" && cur.Head != prev.Head:
+		return "leading hash mismatch"
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+func TestProbeHistory(t *testing.T) {
+	script := "wc -c < ~/.bash_history && head -c 4096 ~/.bash_history | (sha256sum 2>/dev/null || shasum -a 256)"
+
+	tests := []struct {
+		name    string
+		output  string
+		want    Probe
+		wantErr bool
+	}{
+		{name: "sha256sum", output: "5120\nabc123  -\n", want: Probe{Size: 5120, Head: "abc123"}},
+		{name: "padded wc", output: "     42\nabc123  -\n", want: Probe{Size: 42, Head: "abc123"}},
+		{name: "missing history", output: "", want: Probe{}},
+		{name: "no checksum", output: "42\n", wantErr: true},
+		{name: "garbage", output: "nope abc123", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &runner.Fake{Outputs: map[string]string{"ssh ops@10.0.0.1 " + script: tt.output}}
+			got, err := ProbeHistory(Remote{Runner: fake}, "ops", "10.0.0.1", "~/.bash_history")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeFileMatchesRemote(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	long := filepath.Join(dir, "long")
+	os.WriteFile(short, []byte("ls\n"), 0o600)
+	os.WriteFile(long, []byte(strings.Repeat("x", HeadSize+10)), 0o600)
+
+	p, err := ProbeFile(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The head is printed the way sha256sum prints it
+	sum := sha256.Sum256([]byte("ls\n"))
+	if want := (Probe{Size: 3, Head: hex.EncodeToString(sum[:])}); p != want {
+		t.Errorf("ProbeFile(short) = %+v, want %+v", p, want)
+	}
+
+	full, err := ProbeFile(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(long, []byte(strings.Repeat("x", HeadSize+500)), 0o600)
+	grown, err := ProbeFile(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Head != grown.Head {
+		t.Error("appending past the head changed its checksum")
+	}
+}
+
+func TestRotated(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur Probe
+		want      string
+	}{
+		{name: "first fetch", prev: Probe{}, cur: Probe{Size: 10, Head: "a"}, want: ""},
+		{name: "grew", prev: Probe{Size: 10, Head: "a"}, cur: Probe{Size: 20, Head: "b"}, want: ""},
+		{name: "unchanged", prev: Probe{Size: HeadSize, Head: "a"}, cur: Probe{Size: HeadSize, Head: "a"}, want: ""},
+		{name: "truncated", prev: Probe{Size: 20, Head: "a"}, cur: Probe{Size: 10, Head: "a"}, want: "size decreased"},
+		{name: "replaced", prev: Probe{Size: HeadSize, Head: "a"}, cur: Probe{Size: HeadSize + 1, Head: "b"}, want: "leading hash mismatch"},
+		{name: "head not yet full", prev: Probe{Size: HeadSize - 1, Head: "a"}, cur: Probe{Size: HeadSize + 1, Head: "b"}, want: ""},
+		{name: "older state without a head", prev: Probe{Size: HeadSize}, cur: Probe{Size: HeadSize + 1, Head: "b"}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := Rotated(tt.prev, tt.cur); got != tt.want {
+			t.Errorf("%s: Rotated = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Package fetch copies files from remote hosts over ssh and scp.
+package fetch
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// Remote runs ssh and scp against hosts with the options derived from
+// Options
+type Remote struct {
+	Options []string
+
+	// DryRun prints the ssh and scp commands instead of running them
+	DryRun bool
+
+	// Env is added to the environment of ssh, scp and rsync
+	Env []string
+
+	// BWLimit caps copies at this many KiB/s; 0 leaves them unlimited
+	BWLimit int
+
+	// AuditUser is who reads the audit log over ssh instead of the audited
+	// user, and AuditSudo runs the reading through sudo -n, since the log
+	// is only readable by root and the journal's audit records by adm
+	AuditUser string
+	AuditSudo bool
+
+	Runner runner.Runner
+}
+
+// Options are the connection settings shared by every host
+type Options struct {
+	TrustOnFirstUse bool
+	KnownHosts      string
+
+	// JumpHost is a bastion, as user@host[:port], or a comma separated chain
+	JumpHost string
+
+	// Port and IdentityFile override ssh's own defaults when set
+	Port         int
+	IdentityFile string
+
+	// IdentityAgent is the ssh-agent socket keys are offered from instead
+	// of SSH_AUTH_SOCK, or none to use identity files only. Agent keys,
+	// FIDO2 sk keys included, are tried before identity files.
+	IdentityAgent string
+
+	// PasswordAuth allows password and keyboard-interactive authentication,
+	// which is otherwise refused so a scheduled run never waits on a
+	// prompt. ssh asks on the terminal unless PasswordCommand prints the
+	// password or Password holds it, usually as a secrets reference.
+	PasswordAuth    bool
+	PasswordCommand string
+	Password        string
+
+	// Passphrase unlocks encrypted identity files, usually as a secrets
+	// reference
+	Passphrase string
+
+	// Askpass is the path of a program running RunAskpass, answering ssh's
+	// prompts from the settings above
+	Askpass string
+
+	// BWLimit caps copies at this many KiB/s, like rsync's --bwlimit
+	BWLimit int
+
+	// AuditUser and AuditSudo are how auditd and journald collection get
+	// at the audit records, see Remote
+	AuditUser string
+	AuditSudo bool
+
+	DryRun bool
+}
+
+// NewRemote returns a Remote connecting with o
+func NewRemote(o Options, cmdRunner runner.Runner) Remote {
+	opts := []string{"-o", "ConnectTimeout=10"}
+
+	// Host keys are always verified: unknown hosts are refused unless
+	// trust-on-first-use records them, and changed keys always fail
+	if o.TrustOnFirstUse {
+		opts = append(opts, "-o", "StrictHostKeyChecking=accept-new")
+	} else {
+		opts = append(opts, "-o", "StrictHostKeyChecking=yes")
+	}
+	if o.KnownHosts != "" {
+		opts = append(opts, "-o", "UserKnownHostsFile="+o.KnownHosts)
+	}
+
+	// Hosts on private subnets are reached through a bastion
+	if o.JumpHost != "" {
+		opts = append(opts, "-o", "ProxyJump="+o.JumpHost)
+	}
+
+	if o.Port != 0 {
+		opts = append(opts, "-o", "Port="+strconv.Itoa(o.Port))
+	}
+	if o.IdentityFile != "" {
+		opts = append(opts, "-o", "IdentityFile="+o.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	if o.IdentityAgent != "" {
+		opts = append(opts, "-o", "IdentityAgent="+o.IdentityAgent)
+	}
+
+	if !o.PasswordAuth {
+		opts = append(opts, "-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no")
+	} else if o.PasswordCommand != "" || o.Password != "" {
+		// A wrong password fails the fetch instead of being asked again
+		opts = append(opts, "-o", "NumberOfPasswordPrompts=1")
+	}
+
+	return Remote{Options: opts, DryRun: o.DryRun, Env: askpassEnv(o), BWLimit: o.BWLimit, AuditUser: o.AuditUser, AuditSudo: o.AuditSudo, Runner: cmdRunner}
+}
+
+// hostKeyError turns ssh's host key complaints into a clear error
+func hostKeyError(target string, output string, err error) error {
+	switch {
+	case strings.Contains(output, "REMOTE HOST IDENTIFICATION HAS CHANGED"):
+		return fmt.Errorf("host key for %s does not match known_hosts, refusing to connect: possible man-in-the-middle", target)
+	case strings.Contains(output, "Host key verification failed"):
+		return fmt.Errorf("host key for %s could not be verified; add it to known_hosts or use --trust-on-first-use", target)
+	case strings.Contains(output, "Permission denied") && os.Getenv("SSH_AUTH_SOCK") == "":
+		// Scheduled jobs don't inherit the login session's agent
+		return fmt.Errorf("%s refused the identity files and no ssh-agent is reachable, SSH_AUTH_SOCK is unset; point --identity-agent at the agent socket or set an identity_file: %w", target, err)
+	}
+	return fmt.Errorf("%w: %s", err, strings.TrimSpace(output))
+}
+
+// Run runs remoteCmd on target and returns its trimmed stdout
+func (r Remote) Run(target, remoteCmd string, stdin string) (string, error) {
+	args := append(append([]string{}, r.Options...), target, remoteCmd)
+	if r.DryRun {
+		runner.PrintDryRun("ssh", args...)
+		return "", nil
+	}
+	cmd := runner.Command{Name: "ssh", Args: args, Env: r.Env}
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	slog.Debug("Executing command", "cmd", fmt.Sprintf("ssh %s %s %q", strings.Join(r.Options, " "), target, remoteCmd))
+
+	out, err := r.Runner.Run(cmd)
+	if stderr.Len() > 0 {
+		os.Stderr.WriteString(stderr.String())
+	}
+	if err != nil {
+		return "", hostKeyError(target, stderr.String(), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Copy copies remotePath from user@ip to localFile with scp
+func (r Remote) Copy(user, ip, remotePath, localFile string) (string, error) {
+	absLocalFile, err := filepath.Abs(localFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	// scp needs IPv6 literals bracketed to tell the address from the path
+	host := ip
+	if strings.Contains(ip, ":") {
+		host = "[" + ip + "]"
+	}
+	source := fmt.Sprintf("%s@%s:%s", user, host, remotePath)
+	args := append([]string{}, r.Options...)
+	if r.BWLimit > 0 {
+		// scp takes its limit in Kbit/s
+		args = append(args, "-l", strconv.Itoa(r.BWLimit*8))
+	}
+	args = append(args, source, absLocalFile)
+	if r.DryRun {
+		runner.PrintDryRun("scp", args...)
+		return absLocalFile, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(absLocalFile), 0o700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// scp writes to a temporary name next to the destination, which only
+	// takes the real name once the copy is complete and on disk
+	tmp, err := atomicfile.Create(absLocalFile, 0o600)
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	args[len(args)-1] = tmp.Name()
+
+	slog.Debug("Executing command", "cmd", "scp "+strings.Join(args, " "))
+
+	// Run the command and capture the combined output
+	outBytes, err := r.Runner.Run(runner.Command{Name: "scp", Args: args, Combined: true, Env: r.Env})
+	if err != nil {
+		return "", fmt.Errorf("scp failed: %w", hostKeyError(user+"@"+ip, string(outBytes), err))
+	}
+
+	if len(outBytes) > 0 {
+		slog.Debug("scp output", "target", user+"@"+ip, "output", strings.TrimSpace(string(outBytes)))
+	}
+
+	err = atomicfile.Sync(tmp.Name())
+	if err == nil {
+		err = atomicfile.Rename(tmp.Name(), absLocalFile)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s: %w", absLocalFile, err)
+	}
+
+	slog.Debug("Copied remote file", "target", user+"@"+ip, "remote", remotePath, "local", absLocalFile)
+	return absLocalFile, nil
+}
+
+// Cat saves the output of running catCmd on user@ip to localFile, for hosts
+// where scp and SFTP are disabled
+func (r Remote) Cat(user, ip, catCmd, localFile string) (string, error) {
+	absLocalFile, err := filepath.Abs(localFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	target := user + "@" + ip
+	args := append(append([]string{}, r.Options...), target, catCmd)
+	if r.DryRun {
+		runner.PrintDryRun("ssh", args...)
+		return absLocalFile, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(absLocalFile), 0o700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := atomicfile.Create(absLocalFile, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Abort()
+
+	var stderr strings.Builder
+	cmd := runner.Command{Name: "ssh", Args: args, Stdout: newThrottledWriter(file, r.BWLimit), Stderr: &stderr, Env: r.Env}
+
+	slog.Debug("Executing command", "cmd", fmt.Sprintf("ssh %s %s %q", strings.Join(r.Options, " "), target, catCmd))
+
+	_, err = r.Runner.Run(cmd)
+	if err != nil {
+		return "", fmt.Errorf("ssh failed: %w", hostKeyError(target, stderr.String(), err))
+	}
+	err = file.Commit()
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s: %w", absLocalFile, err)
+	}
+
+	slog.Debug("Captured remote output", "target", target, "cmd", catCmd, "local", absLocalFile)
+	return absLocalFile, nil
+}
+
+// UserHistory copies user's remote history file into a timestamped file
+// in userDir, with scp, with rsync when collect is "rsync" or, when collect
+// is "ssh", by capturing the output of printing it over ssh. With an audit
+// source the file holds the commands from the audit log instead.
+func UserHistory(remote Remote, user, ip, userDir, remotePath, remoteOS, collect string) (string, error) {
+	// Append host and current timestamp to the filename. The host is
+	// sanitized, an IPv6 address's colons aren't allowed in Windows paths.
+	localFile := fmt.Sprintf("%s/bash_history_%s_%s.txt", userDir, schedule.SanitizeHost(ip), time.Now().Format("20060102_150405"))
+	if IsAuditSource(collect) {
+		return Audit(remote, user, ip, localFile, collect)
+	}
+	return File(remote, user, ip, remotePath, localFile, remoteOS, collect)
+}
+
+// File copies remotePath from user@ip to localFile the way
+// collect says: scp, ssh or rsync
+func File(remote Remote, user, ip, remotePath, localFile, remoteOS, collect string) (string, error) {
+	switch collect {
+	case "ssh":
+		return remote.Cat(user, ip, catCommand(remoteOS, remotePath), localFile)
+	case "rsync":
+		if remoteOS == "windows" {
+			return "", fmt.Errorf("rsync can't collect from windows hosts, use scp or ssh")
+		}
+		return remote.Rsync(user, ip, remotePath, localFile)
+	default:
+		return remote.Copy(user, ip, remotePath, localFile)
+	}
+}
+
+// catCommand prints remotePath on a host running remoteOS. Windows
+// OpenSSH runs commands with cmd.exe in the user's profile.
+func catCommand(remoteOS, remotePath string) string {
+	if remoteOS == "windows" {
+		return `type "` + strings.ReplaceAll(remotePath, "/", `\`) + `"`
+	}
+	return "cat " + remotePath
+}
+
+// HistoryPath is the history file fetched from hosts running remoteOS.
+// On Windows that is PSReadLine's history, which scp resolves relative to
+// the user's profile.
+func HistoryPath(remoteOS string) (string, error) {
+	switch remoteOS {
+	case "", "unix":
+		return "~/.bash_history", nil
+	case "windows":
+		return "AppData/Roaming/Microsoft/Windows/PowerShell/PSReadLine/ConsoleHost_history.txt", nil
+	default:
+		return "", fmt.Errorf("unknown remote OS %q, want unix or windows", remoteOS)
+	}
+}
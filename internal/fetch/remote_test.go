@@ -0,0 +1,212 @@
+package fetch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// runFunc is a runner.Runner answering every command with a function, for
+// commands whose arguments, such as temporary file names, aren't known in
+// advance
+type runFunc func(c runner.Command) ([]byte, error)
+
+func (f runFunc) Run(c runner.Command) ([]byte, error) {
+	return f(c)
+}
+
+func TestNewRemoteOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+		env  []string
+	}{
+		{
+			name: "defaults refuse unknown hosts and passwords",
+			want: []string{"-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=yes", "-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no"},
+		},
+		{
+			name: "trust on first use through a bastion",
+			opts: Options{TrustOnFirstUse: true, KnownHosts: "/kh", JumpHost: "ops@bastion", Port: 2222},
+			want: []string{"-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=accept-new", "-o", "UserKnownHostsFile=/kh", "-o", "ProxyJump=ops@bastion", "-o", "Port=2222", "-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no"},
+		},
+		{
+			name: "identity file and agent",
+			opts: Options{IdentityFile: "/id", IdentityAgent: "none"},
+			want: []string{"-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=yes", "-o", "IdentityFile=/id", "-o", "IdentitiesOnly=yes", "-o", "IdentityAgent=none", "-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no"},
+		},
+		{
+			name: "password from a command is asked once through askpass",
+			opts: Options{PasswordAuth: true, PasswordCommand: "pass show host", Askpass: "/bin/tarsnap"},
+			want: []string{"-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=yes", "-o", "NumberOfPasswordPrompts=1"},
+			env:  []string{"SSH_ASKPASS=/bin/tarsnap", "SSH_ASKPASS_REQUIRE=force", AskpassEnv + "=1", askpassCommandEnv + "=pass show host"},
+		},
+		{
+			name: "interactive password",
+			opts: Options{PasswordAuth: true},
+			want: []string{"-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=yes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRemote(tt.opts, &runner.Fake{})
+			if !reflect.DeepEqual(r.Options, tt.want) {
+				t.Errorf("options = %q, want %q", r.Options, tt.want)
+			}
+			if !reflect.DeepEqual(r.Env, tt.env) {
+				t.Errorf("env = %q, want %q", r.Env, tt.env)
+			}
+		})
+	}
+}
+
+func TestRemoteRun(t *testing.T) {
+	fake := &runner.Fake{
+		Outputs: map[string]string{"ssh -o BatchMode=yes ops@web1 uname": "Linux\n"},
+		Errors:  map[string]error{"ssh -o BatchMode=yes ops@web2 uname": errors.New("exit status 255")},
+	}
+	r := Remote{Options: []string{"-o", "BatchMode=yes"}, Runner: fake}
+
+	out, err := r.Run("ops@web1", "uname", "")
+	if err != nil || out != "Linux" {
+		t.Errorf("Run = %q, %v, want Linux", out, err)
+	}
+	_, err = r.Run("ops@web2", "uname", "")
+	if err == nil {
+		t.Error("Run succeeded against a failing host")
+	}
+
+	r.DryRun = true
+	_, err = r.Run("ops@web3", "uname", "")
+	if err != nil || len(fake.Calls) != 2 {
+		t.Errorf("dry run ran ssh: %v, %d calls", err, len(fake.Calls))
+	}
+}
+
+func TestHostKeyError(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	base := errors.New("exit status 255")
+
+	tests := []struct {
+		output string
+		want   string
+		wraps  bool
+	}{
+		{"@@@ WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED! @@@", "does not match known_hosts", false},
+		{"Host key verification failed.", "could not be verified", false},
+		{"ops@web1: Permission denied (publickey).", "no ssh-agent is reachable", true},
+		{"Connection refused", "Connection refused", true},
+	}
+	for _, tt := range tests {
+		err := hostKeyError("ops@web1", tt.output, base)
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("hostKeyError(%q) = %v, want it to mention %q", tt.output, err, tt.want)
+		}
+		if errors.Is(err, base) != tt.wraps {
+			t.Errorf("hostKeyError(%q) wraps the ssh error: %v, want %v", tt.output, !tt.wraps, tt.wraps)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	var args []string
+	r := Remote{Options: []string{"-o", "BatchMode=yes"}, BWLimit: 100, Runner: runFunc(func(c runner.Command) ([]byte, error) {
+		args = c.Args
+		// scp writes to the temporary name passed last
+		return nil, os.WriteFile(c.Args[len(c.Args)-1], []byte("ls\n"), 0o600)
+	})}
+
+	local := filepath.Join(dir, "ops", "history.txt")
+	got, err := r.Copy("ops", "fe80::1", "~/.bash_history", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != local {
+		t.Errorf("Copy = %s, want %s", got, local)
+	}
+	want := []string{"-o", "BatchMode=yes", "-l", "800", "ops@[fe80::1]:~/.bash_history"}
+	if !reflect.DeepEqual(args[:len(args)-1], want) {
+		t.Errorf("scp args = %q, want %q", args[:len(args)-1], want)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil || string(data) != "ls\n" {
+		t.Errorf("copied file = %q, %v", data, err)
+	}
+
+	// A failed copy leaves nothing behind
+	r.Runner = runFunc(func(c runner.Command) ([]byte, error) {
+		return []byte("Host key verification failed."), errors.New("exit status 1")
+	})
+	failed := filepath.Join(dir, "ops", "failed.txt")
+	_, err = r.Copy("ops", "10.0.0.1", "~/.bash_history", failed)
+	if err == nil || !strings.Contains(err.Error(), "could not be verified") {
+		t.Errorf("Copy error = %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "ops"))
+	if len(entries) != 1 {
+		t.Errorf("failed copy left files behind: %v", entries)
+	}
+}
+
+func TestUserHistory(t *testing.T) {
+	tests := []struct {
+		name     string
+		remoteOS string
+		collect  string
+		command  string
+		wantErr  bool
+	}{
+		{name: "unix over ssh", remoteOS: "unix", collect: "ssh", command: "ssh ops@10.0.0.1 cat ~/.bash_history"},
+		{name: "windows over ssh", remoteOS: "windows", collect: "ssh", command: `ssh ops@10.0.0.1 type "AppData\hist.txt"`},
+		{name: "windows can't rsync", remoteOS: "windows", collect: "rsync", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fake := &runner.Fake{Outputs: map[string]string{tt.command: "ls\npwd\n"}}
+			remotePath := "~/.bash_history"
+			if tt.remoteOS == "windows" {
+				remotePath = "AppData/hist.txt"
+			}
+
+			path, err := UserHistory(Remote{Runner: fake}, "ops", "10.0.0.1", dir, remotePath, tt.remoteOS, tt.collect)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(filepath.Base(path), "bash_history_10.0.0.1_") {
+				t.Errorf("snapshot name %s doesn't carry the host", path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != "ls\npwd\n" {
+				t.Errorf("snapshot = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestUserHistorySanitizesIPv6(t *testing.T) {
+	dir := t.TempDir()
+	fake := &runner.Fake{Outputs: map[string]string{"ssh ops@fe80::1 cat ~/.bash_history": "ls\n"}}
+	path, err := UserHistory(Remote{Runner: fake}, "ops", "fe80::1", dir, "~/.bash_history", "unix", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(filepath.Base(path), ":") {
+		t.Errorf("snapshot name %s has the address's colons", path)
+	}
+}
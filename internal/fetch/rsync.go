@@ -0,0 +1,111 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// mirrorDir holds, in each user's directory, the copies rsync keeps
+// appending to between fetches
+const mirrorDir = ".rsync"
+
+// mirrorPath is the file rsync keeps in step with remotePath on ip. It sits
+// next to the snapshots in userDir but is never mistaken for one.
+func mirrorPath(userDir, ip, remotePath string) string {
+	name := strings.NewReplacer("/", "_", "~", "", ":", "-", `\`, "_").Replace(ip + "_" + remotePath)
+	return filepath.Join(userDir, mirrorDir, name)
+}
+
+// ResetMirror drops the mirror of remotePath on ip, so the next Rsync copies
+// the whole file instead of appending to a copy it no longer continues
+func ResetMirror(userDir, ip, remotePath string) error {
+	err := os.Remove(mirrorPath(userDir, ip, remotePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Rsync copies remotePath from user@ip to localFile with rsync over ssh.
+// rsync appends to a mirror of the remote file kept from the previous fetch,
+// so only what the history gained is transferred, and --append-verify
+// falls back to a full copy when the mirror no longer matches the start of
+// the remote file. The snapshot is then copied from the mirror.
+func (r Remote) Rsync(user, ip, remotePath, localFile string) (string, error) {
+	absLocalFile, err := filepath.Abs(localFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	mirror := mirrorPath(filepath.Dir(absLocalFile), ip, remotePath)
+
+	quoted := make([]string, 0, len(r.Options)+1)
+	quoted = append(quoted, "ssh")
+	for _, opt := range r.Options {
+		quoted = append(quoted, runner.ShellQuote(opt))
+	}
+
+	host := ip
+	if strings.Contains(ip, ":") {
+		host = "[" + ip + "]"
+	}
+	source := fmt.Sprintf("%s@%s:%s", user, host, remotePath)
+	args := []string{"--append-verify", "--compress", "--times", "-e", strings.Join(quoted, " ")}
+	if r.BWLimit > 0 {
+		args = append(args, "--bwlimit="+strconv.Itoa(r.BWLimit))
+	}
+	args = append(args, source, mirror)
+	if r.DryRun {
+		runner.PrintDryRun("rsync", args...)
+		return absLocalFile, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(mirror), 0o700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	slog.Debug("Executing command", "cmd", "rsync "+strings.Join(args, " "))
+
+	outBytes, err := r.Runner.Run(runner.Command{Name: "rsync", Args: args, Combined: true, Env: r.Env})
+	if err != nil {
+		return "", fmt.Errorf("rsync failed: %w", hostKeyError(user+"@"+ip, string(outBytes), err))
+	}
+
+	err = copyFile(mirror, absLocalFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s: %w", absLocalFile, err)
+	}
+
+	slog.Debug("Copied remote file", "target", user+"@"+ip, "remote", remotePath, "local", absLocalFile, "via", "rsync")
+	return absLocalFile, nil
+}
+
+// copyFile atomically copies src to dest
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := atomicfile.Create(dest, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
@@ -0,0 +1,70 @@
+package fetch
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Shells are the shells whose history can be fetched from unix hosts
+var Shells = []string{"bash", "zsh", "fish"}
+
+// shellHistoryFiles are where each shell keeps its history by default,
+// relative to the home directory
+var shellHistoryFiles = map[string]string{
+	"bash": ".bash_history",
+	"zsh":  ".zsh_history",
+	"fish": ".local/share/fish/fish_history",
+}
+
+// ShellHistoryPath is the history file fetched for users of shell
+func ShellHistoryPath(shell string) (string, error) {
+	file, ok := shellHistoryFiles[shell]
+	if !ok {
+		return "", fmt.Errorf("unknown shell %q, want bash, zsh or fish", shell)
+	}
+	return "~/" + file, nil
+}
+
+// detectShellScript prints the login shell and then which of the history
+// files hold anything
+const detectShellScript = `basename "${SHELL:-sh}"; for f in .bash_history .zsh_history .local/share/fish/fish_history; do [ -s "$HOME/$f" ] && echo "$f"; done; true`
+
+// DetectShell works out which shell's history user has on ip: the login
+// shell when it has kept a history, otherwise whichever shell has, bash
+// first, falling back to the login shell or bash
+func DetectShell(remote Remote, user, ip string) (string, error) {
+	out, err := remote.Run(user+"@"+ip, detectShellScript, "")
+	if err != nil {
+		return "", err
+	}
+	return chooseShell(strings.Split(out, "\n")), nil
+}
+
+func chooseShell(lines []string) string {
+	login := ""
+	if len(lines) > 0 {
+		login = path.Base(strings.TrimSpace(lines[0]))
+	}
+	kept := make(map[string]bool)
+	for _, line := range lines[1:] {
+		for shell, file := range shellHistoryFiles {
+			if strings.TrimSpace(line) == file {
+				kept[shell] = true
+			}
+		}
+	}
+
+	if kept[login] {
+		return login
+	}
+	for _, shell := range Shells {
+		if kept[shell] {
+			return shell
+		}
+	}
+	if _, ok := shellHistoryFiles[login]; ok {
+		return login
+	}
+	return "bash"
+}
@@ -0,0 +1,54 @@
+package fetch
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// SSHConfig is how ssh connects to a host once ~/.ssh/config is applied
+type SSHConfig struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// ReadSSHConfig asks ssh -G for the settings every matching Host and Match
+// block of the ssh configuration gives host
+func ReadSSHConfig(cmdRunner runner.Runner, host string) (SSHConfig, error) {
+	slog.Debug("Executing command", "cmd", "ssh -G "+host)
+
+	out, err := runner.Output(cmdRunner, "ssh", "-G", host)
+	if err != nil {
+		return SSHConfig{}, fmt.Errorf("ssh -G %s: %w", host, err)
+	}
+
+	var c SSHConfig
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToLower(key) {
+		case "hostname":
+			c.HostName = value
+		case "user":
+			c.User = value
+		case "port":
+			c.Port, _ = strconv.Atoi(value)
+		case "identityfile":
+			c.IdentityFiles = append(c.IdentityFiles, value)
+		case "proxyjump":
+			c.ProxyJump = value
+		}
+	}
+	return c, nil
+}
+
+// IsAlias reports whether the ssh configuration maps host to a different
+// HostName, making host a name only ssh knows how to reach
+func (c SSHConfig) IsAlias(host string) bool {
+	return c.HostName != "" && !strings.EqualFold(c.HostName, host)
+}
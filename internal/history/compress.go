@@ -0,0 +1,147 @@
+package history
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// CompressedSuffixes are the extensions compressed snapshots get
+var CompressedSuffixes = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// TrimCompressedSuffix returns name without a .age, .gz or .zst extension
+func TrimCompressedSuffix(name string) string {
+	name = strings.TrimSuffix(name, EncryptedSuffix)
+	for _, suffix := range CompressedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// Open opens path, or path.age when only that exists, for reading,
+// transparently decrypting age files with the age CLI and decompressing
+// gzip files with the standard library and zstd files with the zstd CLI
+func Open(path string) (io.ReadCloser, error) {
+	path = ResolvePath(path)
+
+	var file io.ReadCloser
+	var err error
+	if strings.HasSuffix(path, EncryptedSuffix) {
+		file, err = decrypt(path)
+		path = strings.TrimSuffix(path, EncryptedSuffix)
+	} else {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return gzipReadCloser{Reader: zr, file: file}, nil
+	case strings.HasSuffix(path, ".zst"):
+		// Closing the reader early makes zstd's next write fail, ending it
+		pr, pw := io.Pipe()
+		go func() {
+			defer file.Close()
+			_, err := runner.Exec{}.Run(runner.Command{Name: "zstd", Args: []string{"-dcq"}, Stdin: file, Stdout: pw})
+			if err != nil {
+				err = fmt.Errorf("zstd: %w", err)
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	default:
+		return file, nil
+	}
+}
+
+// Compress replaces the snapshot at path with a compressed copy and
+// returns the new path. method is "gzip", "zstd" or "none".
+func Compress(path, method string) (string, error) {
+	switch method {
+	case "", "none":
+		return path, nil
+	case "gzip":
+		dest := path + CompressedSuffixes[method]
+		err := gzipFile(path, dest)
+		if err != nil {
+			return "", err
+		}
+		return dest, os.Remove(path)
+	case "zstd":
+		dest := path + CompressedSuffixes[method]
+		tmp, err := atomicfile.Create(dest, 0o600)
+		if err != nil {
+			return "", err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		slog.Debug("Executing command", "cmd", "zstd -q -f -o "+tmp.Name()+" "+path)
+		out, err := runner.Combined(runner.Exec{}, "zstd", "-q", "-f", "-o", tmp.Name(), path)
+		if err != nil {
+			return "", fmt.Errorf("zstd: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+		err = atomicfile.Sync(tmp.Name())
+		if err == nil {
+			err = atomicfile.Rename(tmp.Name(), dest)
+		}
+		if err != nil {
+			return "", err
+		}
+		return dest, os.Remove(path)
+	default:
+		return "", fmt.Errorf("unknown compression %q, want none, gzip or zstd", method)
+	}
+}
+
+func gzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := atomicfile.Create(dest, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
@@ -0,0 +1,73 @@
+package history
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+)
+
+// CorruptDir is the subdirectory of a user's directory that garbage cut out
+// of snapshots is moved to
+const CorruptDir = "corrupt"
+
+// IsGarbage reports whether line is binary junk rather than a command, as
+// left in a history file by a crash: invalid UTF-8, a NUL, or more than one
+// in ten characters being control characters other than tab
+func IsGarbage(line string) bool {
+	if !utf8.ValidString(line) {
+		return true
+	}
+	var runes, control int
+	for _, r := range line {
+		runes++
+		switch {
+		case r == 0:
+			return true
+		case r == '\t':
+		case r < 0x20, r == 0x7f, r >= 0x80 && r < 0xa0, r == utf8.RuneError:
+			control++
+		}
+	}
+	return control > 0 && control*10 > runes
+}
+
+// Quarantine moves the garbage lines of the plain snapshot at path to
+// CorruptDir next to it, named after the snapshot with a .corrupt suffix so
+// nothing reads it as history, and returns how many lines were moved
+func Quarantine(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var clean, corrupt bytes.Buffer
+	var moved int
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if IsGarbage(string(bytes.TrimRight(line, "\r\n"))) {
+			corrupt.Write(line)
+			moved++
+		} else {
+			clean.Write(line)
+		}
+	}
+	if moved == 0 {
+		return 0, nil
+	}
+
+	dir := filepath.Join(filepath.Dir(path), CorruptDir)
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return 0, err
+	}
+	err = WriteFile(filepath.Join(dir, filepath.Base(path)+".corrupt"), corrupt.Bytes(), 0o600)
+	if err != nil {
+		return 0, err
+	}
+	return moved, atomicfile.WriteFile(path, clean.Bytes(), 0o600)
+}
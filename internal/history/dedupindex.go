@@ -0,0 +1,208 @@
+package history
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DedupIndex remembers the hash of every line already written to a
+// summary.txt and which snapshot files have been read, so each run only has
+// to look at snapshots it hasn't seen before. Lines read but left out by the
+// filter are kept whole, so a later, looser filter can still write them.
+//
+// The index file is append-only after a "v2" header: "f\t<path>" lines
+// record processed snapshots, "d\t<line>" lines record dropped lines and
+// bare hex lines record the hashes of written lines.
+type DedupIndex struct {
+	path    string
+	hashes  map[uint64]struct{}
+	files   map[string]struct{}
+	dropped map[string]struct{}
+	// droppedOrder is the dropped lines in the order they were read
+	droppedOrder []string
+
+	newHashes  []uint64
+	newFiles   []string
+	newDropped []string
+
+	// legacy is set when the file predates the header; its hashes also
+	// cover dropped lines, so it is started over
+	legacy bool
+}
+
+// indexHeader starts every index file written since dropped lines were
+// kept apart from written ones
+const indexHeader = "v2"
+
+func hashLine(line string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return h.Sum64()
+}
+
+func LoadDedupIndex(path string) (*DedupIndex, error) {
+	idx := &DedupIndex{
+		path:    path,
+		hashes:  make(map[uint64]struct{}),
+		files:   make(map[string]struct{}),
+		dropped: make(map[string]struct{}),
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 0; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if n == 0 && line != indexHeader {
+			idx.legacy = true
+			return idx, nil
+		}
+		if n == 0 {
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "f\t"); ok {
+			idx.files[name] = struct{}{}
+			continue
+		}
+		if d, ok := strings.CutPrefix(line, "d\t"); ok {
+			if _, ok := idx.dropped[d]; !ok {
+				idx.dropped[d] = struct{}{}
+				idx.droppedOrder = append(idx.droppedOrder, d)
+			}
+			continue
+		}
+		h, err := strconv.ParseUint(line, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt dedup index %s: %w", path, err)
+		}
+		idx.hashes[h] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Empty reports whether the index has never recorded anything
+func (idx *DedupIndex) Empty() bool {
+	return len(idx.hashes) == 0 && len(idx.files) == 0 && len(idx.droppedOrder) == 0
+}
+
+// Len is how many distinct lines have been written
+func (idx *DedupIndex) Len() int {
+	return len(idx.hashes)
+}
+
+// Has reports whether line has been written
+func (idx *DedupIndex) Has(line string) bool {
+	_, ok := idx.hashes[hashLine(line)]
+	return ok
+}
+
+// Add records line as written and reports whether it was new
+func (idx *DedupIndex) Add(line string) bool {
+	h := hashLine(line)
+	if _, ok := idx.hashes[h]; ok {
+		return false
+	}
+	idx.hashes[h] = struct{}{}
+	idx.newHashes = append(idx.newHashes, h)
+	return true
+}
+
+// Drop records line as read but left out, unless it was written already.
+// Lines can't hold a newline, so they are stored as they are.
+func (idx *DedupIndex) Drop(line string) {
+	if _, ok := idx.dropped[line]; ok || idx.Has(line) {
+		return
+	}
+	idx.dropped[line] = struct{}{}
+	idx.droppedOrder = append(idx.droppedOrder, line)
+	idx.newDropped = append(idx.newDropped, line)
+}
+
+// Dropped returns the lines left out so far that haven't been written
+// since, in the order they were dropped
+func (idx *DedupIndex) Dropped() []string {
+	var waiting []string
+	for _, d := range idx.droppedOrder {
+		if !idx.Has(d) {
+			waiting = append(waiting, d)
+		}
+	}
+	return waiting
+}
+
+func (idx *DedupIndex) Seen(file string) bool {
+	_, ok := idx.files[file]
+	return ok
+}
+
+func (idx *DedupIndex) MarkSeen(file string) {
+	idx.files[file] = struct{}{}
+	idx.newFiles = append(idx.newFiles, file)
+}
+
+// Save appends everything recorded since the index was loaded
+func (idx *DedupIndex) Save() error {
+	if len(idx.newHashes) == 0 && len(idx.newFiles) == 0 && len(idx.newDropped) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(idx.path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if idx.legacy {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(idx.path, flags, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	if info.Size() == 0 {
+		fmt.Fprintln(w, indexHeader)
+	}
+	for _, h := range idx.newHashes {
+		fmt.Fprintf(w, "%x\n", h)
+	}
+	for _, d := range idx.newDropped {
+		fmt.Fprintf(w, "d\t%s\n", d)
+	}
+	for _, name := range idx.newFiles {
+		fmt.Fprintf(w, "f\t%s\n", name)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	idx.newHashes, idx.newFiles, idx.newDropped = nil, nil, nil
+	idx.legacy = false
+	return file.Close()
+}
@@ -0,0 +1,115 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDedupIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "all.idx")
+
+	idx, err := LoadDedupIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Empty() {
+		t.Error("missing index isn't empty")
+	}
+	if !idx.Add("ls") || idx.Add("ls") {
+		t.Error("Add didn't report ls as new exactly once")
+	}
+	idx.Add("pwd")
+	idx.Drop("rm -rf /")
+	idx.Drop("ls") // written already
+	idx.Drop("rm -rf /")
+	idx.MarkSeen("web1/bash_history_1.txt")
+	err = idx.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloaded, everything is there, and later saves append
+	idx, err = LoadDedupIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Empty() || idx.Len() != 2 || !idx.Has("ls") || !idx.Has("pwd") || idx.Has("rm -rf /") {
+		t.Errorf("reloaded index: len %d", idx.Len())
+	}
+	if !idx.Seen("web1/bash_history_1.txt") || idx.Seen("web1/bash_history_2.txt") {
+		t.Error("reloaded index lost the seen files")
+	}
+	if got := idx.Dropped(); !reflect.DeepEqual(got, []string{"rm -rf /"}) {
+		t.Errorf("Dropped = %q", got)
+	}
+
+	// A dropped line written later is no longer waiting
+	idx.Add("rm -rf /")
+	idx.Drop("git push")
+	err = idx.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = LoadDedupIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.Dropped(); !reflect.DeepEqual(got, []string{"git push"}) {
+		t.Errorf("Dropped after writing = %q", got)
+	}
+	if idx.Len() != 3 {
+		t.Errorf("Len = %d, want 3", idx.Len())
+	}
+}
+
+func TestDedupIndexLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "all.idx")
+	// Before the header, hashes covered dropped lines too
+	os.WriteFile(path, []byte("af63bd4c8601b7df\nf\tweb1/bash_history_1.txt\n"), 0o600)
+
+	idx, err := LoadDedupIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Empty() {
+		t.Error("legacy index wasn't started over")
+	}
+	idx.Add("ls")
+	err = idx.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), indexHeader+"\n") {
+		t.Errorf("legacy index not rewritten with a header: %q", data)
+	}
+	idx, err = LoadDedupIndex(path)
+	if err != nil || idx.Len() != 1 || idx.Seen("web1/bash_history_1.txt") {
+		t.Errorf("rewritten index = %d lines, %v", idx.Len(), err)
+	}
+}
+
+func TestDedupIndexCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "all.idx")
+	os.WriteFile(path, []byte("v2\nnot hex\n"), 0o600)
+	_, err := LoadDedupIndex(path)
+	if err == nil {
+		t.Error("corrupt index loaded")
+	}
+}
+
+func TestDedupIndexSaveNothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "all.idx")
+	idx, _ := LoadDedupIndex(path)
+	err := idx.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("saving an unchanged index created it")
+	}
+}
@@ -0,0 +1,184 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// EncryptedSuffix is the extension files encrypted with age get, after any
+// compression suffix
+const EncryptedSuffix = ".age"
+
+// key is the age identity files are decrypted with and the recipient they
+// are encrypted to; files are stored in the clear until SetKey is called
+var key struct {
+	identity  string
+	recipient string
+}
+
+// SetKey makes Encrypt and WriteFile encrypt to the age identity's
+// recipient, and Open decrypt with identity. The age and age-keygen CLIs
+// do the work.
+func SetKey(identity string) error {
+	identity = strings.TrimSpace(identity)
+	out, err := runner.Exec{}.Run(runner.Command{Name: "age-keygen", Args: []string{"-y"}, Stdin: strings.NewReader(identity + "\n")})
+	if err != nil {
+		return fmt.Errorf("age-keygen: %w, is the key an age identity?", err)
+	}
+	key.identity = identity
+	key.recipient = strings.TrimSpace(string(out))
+	return nil
+}
+
+// Encrypting reports whether SetKey was called
+func Encrypting() bool {
+	return key.recipient != ""
+}
+
+// ResolvePath returns the encrypted counterpart of path when only that
+// exists, so files are found whether or not they were encrypted
+func ResolvePath(path string) string {
+	if strings.HasSuffix(path, EncryptedSuffix) {
+		return path
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(path + EncryptedSuffix); err == nil {
+			return path + EncryptedSuffix
+		}
+	}
+	return path
+}
+
+// decrypt streams the plaintext of the age file at path
+func decrypt(path string) (io.ReadCloser, error) {
+	if !Encrypting() {
+		return nil, fmt.Errorf("%s is encrypted, pass -encrypt-key to read it", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		var stderr bytes.Buffer
+		_, err := runner.Exec{}.Run(runner.Command{
+			Name:   "age",
+			Args:   []string{"-d", "-i", "-", path},
+			Stdin:  strings.NewReader(key.identity + "\n"),
+			Stdout: pw,
+			Stderr: &stderr,
+		})
+		if err != nil {
+			err = fmt.Errorf("age: %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// encryptData returns data encrypted to the key's recipient
+func encryptData(data []byte) ([]byte, error) {
+	var stderr bytes.Buffer
+	out, err := runner.Exec{}.Run(runner.Command{
+		Name:   "age",
+		Args:   []string{"-r", key.recipient},
+		Stdin:  bytes.NewReader(data),
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("age: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Encrypt replaces the file at path with an encrypted copy and returns the
+// new path. Without a key, or for a file already encrypted, it returns
+// path unchanged.
+func Encrypt(path string) (string, error) {
+	if !Encrypting() || strings.HasSuffix(path, EncryptedSuffix) {
+		return path, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := encryptData(data)
+	if err != nil {
+		return "", err
+	}
+	dest := path + EncryptedSuffix
+	slog.Debug("Encrypted file", "path", dest)
+	err = atomicfile.WriteFile(dest, sealed, fi.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	return dest, os.Remove(path)
+}
+
+// WriteFile replaces path with data like atomicfile.WriteFile. With a key
+// set the data is encrypted into path.age instead, and a plaintext file
+// left at path from before is removed.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if !Encrypting() {
+		return atomicfile.WriteFile(path, data, perm)
+	}
+	sealed, err := encryptData(data)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(path+EncryptedSuffix, sealed, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ReadFile returns the contents of path, or of path.age, decrypted and
+// decompressed
+func ReadFile(path string) ([]byte, error) {
+	f, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// AppendFile adds data to the end of path, creating it if needed. An
+// encrypted file can't be extended in place, so with a key set the
+// plaintext is read back and written again through WriteFile.
+func AppendFile(path string, data []byte, perm os.FileMode) error {
+	if Encrypting() {
+		existing, err := ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return WriteFile(path, append(existing, data...), perm)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,57 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DetectFormat guesses whether data is a bash, zsh or fish history
+// from its first few lines
+func DetectFormat(data []byte) string {
+	lines := strings.SplitN(string(data), "\n", 50)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "- cmd: ") {
+			return "fish"
+		}
+		if zshExtendedRe.MatchString(line) {
+			return "zsh"
+		}
+	}
+	return "bash"
+}
+
+// ConvertFish turns fish's YAML-like history into zsh extended
+// history lines, keeping each command's timestamp
+func ConvertFish(data []byte) []byte {
+	var out bytes.Buffer
+	var cmd string
+	flush := func(when string) {
+		if cmd == "" {
+			return
+		}
+		if when == "" {
+			out.WriteString(cmd)
+		} else {
+			fmt.Fprintf(&out, ": %s:0;%s", when, cmd)
+		}
+		out.WriteByte('\n')
+		cmd = ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "- cmd: "):
+			flush("")
+			cmd = strings.TrimPrefix(line, "- cmd: ")
+		case strings.HasPrefix(line, "  when: "):
+			flush(strings.TrimSpace(strings.TrimPrefix(line, "  when: ")))
+		}
+	}
+	flush("")
+	return out.Bytes()
+}
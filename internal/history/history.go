@@ -0,0 +1,92 @@
+// Package history parses, deduplicates and summarizes the shell history
+// snapshots kept in the data directory.
+package history
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a single command parsed out of a shell history file
+type Entry struct {
+	Timestamp time.Time
+	Command   string
+}
+
+// zshExtendedRe matches zsh EXTENDED_HISTORY lines: ": <start>:<elapsed>;<command>"
+var zshExtendedRe = regexp.MustCompile(`^: (\d+):(\d+);(.*)$`)
+
+// ParseLine recognizes the history format of a line and returns the
+// normalized entry. Lines that aren't in a known format are treated as plain
+// bash history with no timestamp.
+func ParseLine(line string) Entry {
+	if m := zshExtendedRe.FindStringSubmatch(line); m != nil {
+		secs, err := strconv.ParseInt(m[1], 10, 64)
+		if err == nil {
+			return Entry{Timestamp: time.Unix(secs, 0), Command: normalization.Apply(m[3])}
+		}
+	}
+
+	return Entry{Command: normalization.Apply(line)}
+}
+
+// bashTimestampRe matches the comment bash writes before each command when
+// HISTTIMEFORMAT is set: # followed by the time in seconds
+var bashTimestampRe = regexp.MustCompile(`^#(\d+)$`)
+
+// TimestampPairer attaches bash's timestamp comments to the command after
+// them, feeding lines through Pair in file order
+type TimestampPairer struct {
+	pending string
+}
+
+// Pair returns line with the timestamp before it as a zsh extended history
+// line, which ParseLine reads the time from. ok is false for the timestamp
+// comments themselves, which aren't commands.
+func (p *TimestampPairer) Pair(line string) (paired string, ok bool) {
+	if m := bashTimestampRe.FindStringSubmatch(line); m != nil {
+		p.pending = m[1]
+		return "", false
+	}
+	if p.pending == "" {
+		return line, true
+	}
+	paired = ": " + p.pending + ":0;" + line
+	p.pending = ""
+	return paired, true
+}
+
+// PairTimestamps applies a TimestampPairer to lines
+func PairTimestamps(lines []string) []string {
+	var p TimestampPairer
+	paired := lines[:0]
+	for _, line := range lines {
+		if line, ok := p.Pair(line); ok {
+			paired = append(paired, line)
+		}
+	}
+	return paired
+}
+
+// NormalizeLine strips any format specific decoration so the same
+// command is deduplicated regardless of which shell recorded it
+func NormalizeLine(line string) string {
+	return ParseLine(line).Command
+}
+
+// IsSnapshotFile reports whether path is a raw history dump that eviction
+// may remove, compressed or not. Summaries and anything else in the data
+// directory are kept.
+func IsSnapshotFile(path string) bool {
+	name := TrimCompressedSuffix(filepath.Base(path))
+	return strings.HasPrefix(name, "bash_history_") && strings.HasSuffix(name, ".txt")
+}
+
+// IsHistoryFile reports whether path holds history lines, either a raw
+// snapshot or a generated summary
+func IsHistoryFile(path string) bool {
+	return IsSnapshotFile(path) || strings.TrimSuffix(filepath.Base(path), EncryptedSuffix) == "summary.txt"
+}
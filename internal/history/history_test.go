@@ -0,0 +1,110 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Entry
+	}{
+		{line: "ls -la", want: Entry{Command: "ls -la"}},
+		{line: ": 1700000000:0;git status", want: Entry{Timestamp: time.Unix(1700000000, 0), Command: "git status"}},
+		{line: ": 1700000000:12;echo a;b", want: Entry{Timestamp: time.Unix(1700000000, 0), Command: "echo a;b"}},
+		{line: ": not a timestamp;ls", want: Entry{Command: ": not a timestamp;ls"}},
+		{line: "#1700000000", want: Entry{Command: "#1700000000"}},
+	}
+	for _, tt := range tests {
+		got := ParseLine(tt.line)
+		if !got.Timestamp.Equal(tt.want.Timestamp) || got.Command != tt.want.Command {
+			t.Errorf("ParseLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestPairTimestamps(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "plain bash",
+			lines: []string{"ls", "pwd"},
+			want:  []string{"ls", "pwd"},
+		},
+		{
+			name:  "HISTTIMEFORMAT",
+			lines: []string{"#1700000000", "ls", "#1700000060", "pwd"},
+			want:  []string{": 1700000000:0;ls", ": 1700000060:0;pwd"},
+		},
+		{
+			name:  "a later timestamp wins and a trailing one is dropped",
+			lines: []string{"#1700000000", "#1700000030", "ls", "pwd", "#1700000060"},
+			want:  []string{": 1700000030:0;ls", "pwd"},
+		},
+		{
+			name:  "comments that aren't timestamps are commands",
+			lines: []string{"# todo", "#17x"},
+			want:  []string{"# todo", "#17x"},
+		},
+	}
+	for _, tt := range tests {
+		got := PairTimestamps(append([]string{}, tt.lines...))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: PairTimestamps = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeLine(t *testing.T) {
+	all, err := ParseNormalization(NormalizationNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		n    Normalization
+		line string
+		want string
+	}{
+		{name: "off by default", line: "  sudo  ls ;", want: "  sudo  ls ;"},
+		{name: "zsh decoration", line: ": 1700000000:0;ls", want: "ls"},
+		{name: "whitespace", n: Normalization{Whitespace: true}, line: " git \t status  ", want: "git status"},
+		{name: "sudo", n: Normalization{Sudo: true}, line: "sudo apt update", want: "apt update"},
+		{name: "lone sudo is kept", n: Normalization{Sudo: true}, line: "sudo ", want: "sudo "},
+		{name: "env", n: Normalization{Env: true}, line: `FOO=1 BAR="a b" make`, want: "make"},
+		{name: "lone assignment is kept", n: Normalization{Env: true}, line: "FOO=1", want: "FOO=1"},
+		{name: "sudo and env in either order", n: all, line: "FOO=1 sudo BAR=2 make install", want: "make install"},
+		{name: "semicolons", n: Normalization{Semicolon: true}, line: "ls ; ;", want: "ls"},
+		{name: "find's escaped semicolon", n: Normalization{Semicolon: true}, line: `find . -exec rm {} \;`, want: `find . -exec rm {} \;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetNormalization(tt.n)
+			t.Cleanup(func() { SetNormalization(Normalization{}) })
+			if got := NormalizeLine(tt.line); got != tt.want {
+				t.Errorf("NormalizeLine(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNormalization(t *testing.T) {
+	n, err := ParseNormalization([]string{"sudo", " env "})
+	if err != nil || n != (Normalization{Sudo: true, Env: true}) {
+		t.Errorf("ParseNormalization = %+v, %v", n, err)
+	}
+	n, err = ParseNormalization([]string{"none"})
+	if err != nil || n != (Normalization{}) {
+		t.Errorf("ParseNormalization(none) = %+v, %v", n, err)
+	}
+	_, err = ParseNormalization([]string{"case"})
+	if err == nil {
+		t.Error("ParseNormalization accepted an unknown name")
+	}
+}
@@ -0,0 +1,88 @@
+package history
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Normalization selects the rewrites applied to every command before it is
+// deduplicated, so trivially different variants count as one command
+type Normalization struct {
+	// Whitespace collapses runs of spaces and tabs and trims the ends
+	Whitespace bool
+	// Sudo strips a leading "sudo "
+	Sudo bool
+	// Env strips leading FOO=bar assignments
+	Env bool
+	// Semicolon trims trailing semicolons, but not find's escaped \;
+	Semicolon bool
+}
+
+// NormalizationNames are the names ParseNormalization accepts, in the order
+// they are applied
+var NormalizationNames = []string{"whitespace", "env", "sudo", "semicolon"}
+
+// ParseNormalization turns a list of NormalizationNames into a
+// Normalization. "none" or an empty list turns every rewrite off.
+func ParseNormalization(names []string) (Normalization, error) {
+	var n Normalization
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "whitespace":
+			n.Whitespace = true
+		case "env":
+			n.Env = true
+		case "sudo":
+			n.Sudo = true
+		case "semicolon":
+			n.Semicolon = true
+		case "none", "":
+		default:
+			return n, fmt.Errorf("unknown normalization %q, use %s or none", name, strings.Join(NormalizationNames, ", "))
+		}
+	}
+	return n, nil
+}
+
+// normalization is applied by ParseLine; commands are kept exactly as
+// recorded until SetNormalization is called
+var normalization Normalization
+
+// SetNormalization sets the rewrites ParseLine and NormalizeLine apply
+func SetNormalization(n Normalization) {
+	normalization = n
+}
+
+var (
+	whitespaceRe = regexp.MustCompile(`[ \t]+`)
+	envPrefixRe  = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_]*=(?:'[^']*'|"[^"]*"|[^\s'"]*)[ \t]+)+`)
+	sudoRe       = regexp.MustCompile(`^sudo[ \t]+`)
+)
+
+// Apply rewrites command according to n
+func (n Normalization) Apply(command string) string {
+	if n.Whitespace {
+		command = strings.TrimSpace(whitespaceRe.ReplaceAllString(command, " "))
+	}
+	// sudo FOO=bar cmd and FOO=bar sudo cmd both come down to cmd
+	for changed := true; changed; {
+		changed = false
+		if n.Env {
+			if loc := envPrefixRe.FindStringIndex(command); loc != nil && loc[1] < len(command) {
+				command, changed = command[loc[1]:], true
+			}
+		}
+		if n.Sudo {
+			if loc := sudoRe.FindStringIndex(command); loc != nil && loc[1] < len(command) {
+				command, changed = command[loc[1]:], true
+			}
+		}
+	}
+	if n.Semicolon {
+		for strings.HasSuffix(command, ";") && !strings.HasSuffix(command, `\;`) {
+			command = strings.TrimRight(strings.TrimSuffix(command, ";"), " \t")
+		}
+	}
+	return command
+}
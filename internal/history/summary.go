@@ -0,0 +1,285 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Filter decides which commands are written to a summary
+type Filter interface {
+	Keep(command string) bool
+}
+
+// LineCache holds the raw lines of snapshots already read during a run so
+// later summaries don't read them again. A nil LineCache reads from disk.
+type LineCache map[string][]string
+
+func (c LineCache) Read(path string) ([]string, error) {
+	if lines, ok := c[path]; ok {
+		return lines, nil
+	}
+	_, lines, err := ReadLines(path)
+	return lines, err
+}
+
+// snapshotTimeRe extracts the timestamp that fetch.UserHistory puts in snapshot names
+var snapshotTimeRe = regexp.MustCompile(`(\d{8}_\d{6})\.txt(?:\.gz|\.zst)?(?:\.age)?$`)
+
+// SnapshotTime returns when the snapshot at path was taken
+func SnapshotTime(path string) (time.Time, bool) {
+	m := snapshotTimeRe.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation("20060102_150405", m[1], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// GenerateSummary appends to summary.txt in logDir, or the file called
+// name there, the commands it doesn't hold yet. all is every command the
+// summary covers and added those that have appeared since the last run;
+// all is only read when the dedup index at indexPath is new. Only the
+// commands filter keeps are written; the rest are remembered in the index
+// and written once filter keeps them.
+func GenerateSummary(logDir, name, indexPath string, all, added []string, filter Filter) ([]string, error) {
+	summaryPath := filepath.Join(logDir, name)
+
+	idx, err := LoadDedupIndex(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dedup index: %w", err)
+	}
+
+	// Without an index, whatever summary.txt already holds seeds it and
+	// every command is looked at again
+	candidates := added
+	rewrite := false
+	var existing []string
+	if idx.Empty() {
+		candidates = all
+		_, lines, err := readLines(summaryPath, false)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		// Bash timestamp comments summarized before they were understood
+		// aren't commands
+		for _, line := range lines {
+			if bashTimestampRe.MatchString(line) {
+				rewrite = true
+				continue
+			}
+			existing = append(existing, line)
+			idx.Add(line)
+		}
+	}
+
+	// Lines an earlier, stricter filter left out come first, having been
+	// seen first
+	var written []string
+	for _, line := range idx.Dropped() {
+		if filter.Keep(line) && idx.Add(line) {
+			written = append(written, line)
+		}
+	}
+	for _, line := range candidates {
+		if idx.Has(line) {
+			continue
+		}
+		if !filter.Keep(line) {
+			idx.Drop(line)
+			continue
+		}
+		idx.Add(line)
+		written = append(written, line)
+	}
+
+	var buf bytes.Buffer
+	lines := written
+	if rewrite {
+		lines = append(existing, written...)
+	}
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	err = os.MkdirAll(logDir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	// An empty summary is still created, so it is there to be read
+	_, statErr := os.Stat(ResolvePath(summaryPath))
+	if rewrite {
+		err = WriteFile(summaryPath, buf.Bytes(), 0o600)
+	} else if buf.Len() > 0 || errors.Is(statErr, os.ErrNotExist) {
+		err = AppendFile(summaryPath, buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to %s: %w", name, err)
+	}
+
+	// The index is saved only once the lines it covers are in the summary
+	err = idx.Save()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save dedup index: %w", err)
+	}
+
+	slog.Info("Updated summary", "path", summaryPath, "new_lines", len(written))
+	return written, nil
+}
+
+// IndexPath is where the dedup index for the named summary lives
+func IndexPath(stateDir, name string) string {
+	return filepath.Join(stateDir, "index", name+".idx")
+}
+
+// ReadLines returns the lines of filename and how many there are,
+// decompressing it if needed. Bash timestamp comments are joined to the
+// command they belong to.
+func ReadLines(filename string) (int, []string, error) {
+	return readLines(filename, true)
+}
+
+// readLines is ReadLines, leaving the timestamp comments alone unless pair
+// is set
+func readLines(filename string, pair bool) (int, []string, error) {
+	file, err := Open(filename)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	var pairer TimestampPairer
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, ok := scanner.Text(), true
+		if pair {
+			line, ok = pairer.Pair(line)
+		}
+		if ok {
+			lines = append(lines, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return len(lines), lines, nil
+}
+
+// UniqueLines returns every unique history line under logDir accepted by
+// keep, sorted; a nil keep accepts every file
+func UniqueLines(logDir string, keep func(path string) bool) ([]string, error) {
+	uniqueLines := make(map[string]struct{})
+
+	err := filepath.Walk(logDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk through files: %w", err)
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			return nil
+		}
+
+		if !IsHistoryFile(path) || (keep != nil && !keep(path)) {
+			return nil
+		}
+
+		// Open the file
+		file, err := Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+
+		// Scan the lines and add unique lines to the map
+		var pairer TimestampPairer
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line, ok := pairer.Pair(scanner.Text()); ok {
+				uniqueLines[NormalizeLine(line)] = struct{}{}
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to scan %s: %w", path, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for line := range uniqueLines {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	return lines, nil
+}
+
+// UniqueEntries is UniqueLines keeping the earliest
+// time each command was seen, sorted oldest first with ties broken by
+// command. Commands without any known time sort first.
+func UniqueEntries(logDir string, keep func(path string) bool) ([]Entry, error) {
+	first := make(map[string]time.Time)
+
+	err := filepath.Walk(logDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk through files: %w", err)
+		}
+		if info.IsDir() || !IsHistoryFile(path) || (keep != nil && !keep(path)) {
+			return nil
+		}
+
+		taken, _ := SnapshotTime(path)
+		_, lines, err := ReadLines(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			entry := ParseLine(line)
+			when := entry.Timestamp
+			if when.IsZero() {
+				when = taken
+			}
+			prev, ok := first[entry.Command]
+			if !ok || prev.IsZero() || (!when.IsZero() && when.Before(prev)) {
+				first[entry.Command] = when
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(first))
+	for command, when := range first {
+		entries = append(entries, Entry{Timestamp: when, Command: command})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Timestamp.Equal(entries[j].Timestamp) {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		}
+		return entries[i].Command < entries[j].Command
+	})
+	return entries, nil
+}
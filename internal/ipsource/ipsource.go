@@ -0,0 +1,669 @@
+// Package ipsource finds the addresses of the hosts whose history is
+// collected: given directly, from the environment or a hosts file, or
+// looked up with terraform, OpenTofu, pulumi, the aws, gcloud or az CLIs or
+// tailscale.
+package ipsource
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"inet.af/netaddr"
+)
+
+// Source yields the addresses of the hosts whose history is collected
+type Source interface {
+	IPs() ([]string, error)
+}
+
+// staticSource returns the addresses given on the command line or in the config file
+type staticSource struct {
+	ips []string
+}
+
+func (s staticSource) IPs() ([]string, error) {
+	if len(s.ips) == 0 {
+		return nil, fmt.Errorf("no ip given, use --ip or --hosts")
+	}
+	return validateIPs(s.ips)
+}
+
+// envSource reads a comma separated list of addresses from an environment variable
+type envSource struct {
+	name string
+}
+
+func (s envSource) IPs() ([]string, error) {
+	value := os.Getenv(s.name)
+	if value == "" {
+		return nil, fmt.Errorf("%s is not set", s.name)
+	}
+	return validateIPs(strings.Split(value, ","))
+}
+
+// fileSource reads one address per line from a hosts file, ignoring blank
+// lines and # comments
+type fileSource struct {
+	path string
+}
+
+func (s fileSource) IPs() ([]string, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ips []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ips = append(ips, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no hosts listed in %s", s.path)
+	}
+	return validateIPs(ips)
+}
+
+// terraformSource reads addresses from an output of a terraform
+// configuration, by default instance_public_ip in ./terraform. tool is
+// terraform, tofu or pulumi, which all expose outputs the same way.
+type terraformSource struct {
+	tool      string
+	dir       string
+	workspace string
+	output    string
+	cmdRunner runner.Runner
+}
+
+func (s terraformSource) IPs() ([]string, error) {
+	return terraformIPs(s.cmdRunner, s.tool, s.dir, s.workspace, s.output)
+}
+
+// ec2Source finds running EC2 instances whose tag matches "Key=Value" using
+// the aws CLI, the same way terraformSource shells out to terraform
+type ec2Source struct {
+	tag       string
+	region    string
+	cmdRunner runner.Runner
+}
+
+func (s ec2Source) IPs() ([]string, error) {
+	key, value, ok := strings.Cut(s.tag, "=")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("ec2 tag filter must look like Key=Value, got %q", s.tag)
+	}
+
+	args := []string{
+		"ec2", "describe-instances",
+		"--filters", fmt.Sprintf("Name=tag:%s,Values=%s", key, value), "Name=instance-state-name,Values=running",
+		"--query", "Reservations[].Instances[].PublicIpAddress",
+		"--output", "json",
+	}
+	if s.region != "" {
+		args = append(args, "--region", s.region)
+	}
+
+	slog.Debug("Executing command", "cmd", "aws "+strings.Join(args, " "))
+
+	out, err := runner.Output(s.cmdRunner, "aws", args...)
+	if err != nil {
+		return nil, fmt.Errorf("aws ec2 describe-instances: %w", err)
+	}
+
+	var addrs []*string
+	err = json.Unmarshal(out, &addrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse aws output: %w", err)
+	}
+
+	// Instances without a public address come back as null
+	var ips []string
+	for _, addr := range addrs {
+		if addr != nil && *addr != "" {
+			ips = append(ips, *addr)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no running instances tagged %s", s.tag)
+	}
+
+	return validateIPs(ips)
+}
+
+// gceSource finds running Compute Engine instances whose label matches
+// "key=value" using the gcloud CLI, optionally within one zone
+type gceSource struct {
+	label     string
+	zone      string
+	project   string
+	cmdRunner runner.Runner
+}
+
+// gceInstance is the part of `gcloud compute instances list` used here
+type gceInstance struct {
+	NetworkInterfaces []struct {
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+}
+
+func (s gceSource) IPs() ([]string, error) {
+	key, value, ok := strings.Cut(s.label, "=")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("gce label filter must look like key=value, got %q", s.label)
+	}
+
+	args := []string{
+		"compute", "instances", "list",
+		"--filter", fmt.Sprintf("labels.%s=%s AND status=RUNNING", key, value),
+		"--format", "json",
+	}
+	if s.zone != "" {
+		args = append(args, "--zones", s.zone)
+	}
+	if s.project != "" {
+		args = append(args, "--project", s.project)
+	}
+
+	slog.Debug("Executing command", "cmd", "gcloud "+strings.Join(args, " "))
+
+	out, err := runner.Output(s.cmdRunner, "gcloud", args...)
+	if err != nil {
+		return nil, fmt.Errorf("gcloud compute instances list: %w", err)
+	}
+
+	var instances []gceInstance
+	err = json.Unmarshal(out, &instances)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gcloud output: %w", err)
+	}
+
+	// Instances without an external address have no natIP
+	var ips []string
+	for _, instance := range instances {
+		for _, nic := range instance.NetworkInterfaces {
+			for _, ac := range nic.AccessConfigs {
+				if ac.NatIP != "" {
+					ips = append(ips, ac.NatIP)
+				}
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no running instances labeled %s", s.label)
+	}
+
+	return validateIPs(ips)
+}
+
+// azureSource finds running Azure VMs whose tag matches "Key=Value" using
+// the az CLI, optionally within one resource group
+type azureSource struct {
+	tag           string
+	resourceGroup string
+	cmdRunner     runner.Runner
+}
+
+func (s azureSource) IPs() ([]string, error) {
+	key, value, ok := strings.Cut(s.tag, "=")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("azure tag filter must look like Key=Value, got %q", s.tag)
+	}
+
+	args := []string{
+		"vm", "list", "--show-details",
+		"--query", fmt.Sprintf("[?tags.%s=='%s' && powerState=='VM running'].publicIps", key, value),
+		"--output", "json",
+	}
+	if s.resourceGroup != "" {
+		args = append(args, "--resource-group", s.resourceGroup)
+	}
+
+	slog.Debug("Executing command", "cmd", "az "+strings.Join(args, " "))
+
+	out, err := runner.Output(s.cmdRunner, "az", args...)
+	if err != nil {
+		return nil, fmt.Errorf("az vm list: %w", err)
+	}
+
+	var addrs []string
+	err = json.Unmarshal(out, &addrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse az output: %w", err)
+	}
+
+	// publicIps is empty for VMs without one and comma separated for VMs
+	// with several
+	var ips []string
+	for _, addr := range addrs {
+		for _, ip := range strings.Split(addr, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no running VMs tagged %s", s.tag)
+	}
+
+	return validateIPs(ips)
+}
+
+// tailscaleSource finds tailnet devices through the local tailscale CLI,
+// for hosts that have no public address. device is a hostname, or
+// tag:<name> to select every device carrying that ACL tag.
+type tailscaleSource struct {
+	device     string
+	preferIPv6 bool
+	cmdRunner  runner.Runner
+}
+
+// tailscaleStatus is the part of `tailscale status --json` used here
+type tailscaleStatus struct {
+	Peer map[string]struct {
+		HostName     string   `json:"HostName"`
+		DNSName      string   `json:"DNSName"`
+		TailscaleIPs []string `json:"TailscaleIPs"`
+		Tags         []string `json:"Tags"`
+		Online       bool     `json:"Online"`
+	} `json:"Peer"`
+}
+
+func (s tailscaleSource) IPs() ([]string, error) {
+	if s.device == "" {
+		return nil, fmt.Errorf("no device given, use --tailscale-device")
+	}
+
+	slog.Debug("Executing command", "cmd", "tailscale status --json")
+	out, err := runner.Output(s.cmdRunner, "tailscale", "status", "--json")
+	if err != nil {
+		return nil, fmt.Errorf("tailscale status: %w", err)
+	}
+
+	var status tailscaleStatus
+	err = json.Unmarshal(out, &status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tailscale output: %w", err)
+	}
+
+	var ips []string
+	for _, peer := range status.Peer {
+		matched := false
+		if strings.HasPrefix(s.device, "tag:") {
+			for _, tag := range peer.Tags {
+				matched = matched || tag == s.device
+			}
+		} else {
+			matched = strings.EqualFold(peer.HostName, s.device) ||
+				strings.EqualFold(strings.Split(peer.DNSName, ".")[0], s.device)
+		}
+		if !matched || !peer.Online {
+			continue
+		}
+
+		// Use the 100.x address unless IPv6 is preferred or the only one
+		var chosen string
+		for _, ip := range peer.TailscaleIPs {
+			if chosen == "" || isValidIPv4(ip) != s.preferIPv6 && isValidIPv4(chosen) == s.preferIPv6 {
+				chosen = ip
+			}
+		}
+		if chosen != "" {
+			ips = append(ips, chosen)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no online tailnet device matches %s", s.device)
+	}
+
+	sort.Strings(ips)
+	return validateIPs(ips)
+}
+
+// validateIPs checks that every target is an IPv4 or IPv6 address or a
+// syntactically valid hostname
+func validateIPs(ips []string) ([]string, error) {
+	var valid []string
+	for _, ip := range ips {
+		ip = strings.TrimSpace(ip)
+		if !isValidIP(ip) && !isValidHostname(ip) {
+			return nil, fmt.Errorf("'%s' is not a valid ip or hostname", ip)
+		}
+		valid = append(valid, ip)
+	}
+	return valid, nil
+}
+
+// hostnameLabelRe matches one DNS label
+var hostnameLabelRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+func isValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabelRe.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveHostnames checks that every hostname among targets resolves, or
+// is a Host alias from ~/.ssh/config, which ssh resolves itself. Hostnames
+// are kept as they are, so ssh, known_hosts and file names see the name,
+// unless preferIPv6 is set and the name has an IPv6 address, which then
+// replaces it.
+func resolveHostnames(targets []string, preferIPv6 bool, cmdRunner runner.Runner) ([]string, error) {
+	resolved := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if isValidIP(target) {
+			resolved = append(resolved, target)
+			continue
+		}
+
+		addrs, err := net.LookupIP(target)
+		if err != nil {
+			if c, sshErr := fetch.ReadSSHConfig(cmdRunner, target); sshErr == nil && c.IsAlias(target) {
+				slog.Debug("Host is an ssh config alias", "host", target, "hostname", c.HostName)
+				resolved = append(resolved, target)
+				continue
+			}
+			return nil, fmt.Errorf("failed to resolve %s: %w", target, err)
+		}
+
+		chosen := target
+		if preferIPv6 {
+			for _, addr := range addrs {
+				if addr.To4() == nil {
+					chosen = addr.String()
+					break
+				}
+			}
+		}
+		slog.Debug("Resolved host", "host", target, "addrs", addrs, "target", chosen)
+		resolved = append(resolved, chosen)
+	}
+	return resolved, nil
+}
+
+// Options selects and configures a Source
+type Options struct {
+	// Source is static, env, file, terraform, tofu, pulumi, ec2, gce, azure
+	// or tailscale
+	Source string
+
+	// IP and Hosts are the addresses for the static source
+	IP    string
+	Hosts []string
+
+	HostsFile       string
+	EC2Tag          string
+	AWSRegion       string
+	GCELabel        string
+	GCEZone         string
+	GCPProject      string
+	AzureTag        string
+	AzureGroup      string
+	TailscaleDevice string
+
+	// TFDir, TFWorkspace and TFOutput select the configuration, workspace
+	// (the stack with pulumi) and output, a dotted path into it, for the
+	// terraform, tofu and pulumi sources
+	TFDir       string
+	TFWorkspace string
+	TFOutput    string
+
+	// PreferIPv6 makes hostnames and tailnet devices resolve to their IPv6
+	// address when they have one
+	PreferIPv6 bool
+}
+
+// New picks the source named by opts.Source. When none is named,
+// addresses given directly win and the infrastructure as code tool
+// DetectIaC finds in opts.TFDir remains the fallback.
+func New(opts Options, cmdRunner runner.Runner) (Source, error) {
+	static := append([]string{}, opts.Hosts...)
+	if opts.IP != "" {
+		static = append(static, opts.IP)
+	}
+
+	switch opts.Source {
+	case "":
+		if len(static) > 0 {
+			return staticSource{ips: static}, nil
+		}
+		return terraformSource{tool: DetectIaC(opts.TFDir), dir: opts.TFDir, workspace: opts.TFWorkspace, output: opts.TFOutput, cmdRunner: cmdRunner}, nil
+	case "static":
+		return staticSource{ips: static}, nil
+	case "env":
+		return envSource{name: "TARSNAP_IP"}, nil
+	case "file":
+		return fileSource{path: opts.HostsFile}, nil
+	case "terraform", "tofu", "pulumi":
+		return terraformSource{tool: opts.Source, dir: opts.TFDir, workspace: opts.TFWorkspace, output: opts.TFOutput, cmdRunner: cmdRunner}, nil
+	case "ec2":
+		return ec2Source{tag: opts.EC2Tag, region: opts.AWSRegion, cmdRunner: cmdRunner}, nil
+	case "gce":
+		return gceSource{label: opts.GCELabel, zone: opts.GCEZone, project: opts.GCPProject, cmdRunner: cmdRunner}, nil
+	case "azure":
+		return azureSource{tag: opts.AzureTag, resourceGroup: opts.AzureGroup, cmdRunner: cmdRunner}, nil
+	case "tailscale":
+		return tailscaleSource{device: opts.TailscaleDevice, preferIPv6: opts.PreferIPv6, cmdRunner: cmdRunner}, nil
+	default:
+		return nil, fmt.Errorf("unknown ip source %q", opts.Source)
+	}
+}
+
+// Resolve returns the targets from the Source opts selects, with hostnames
+// checked to resolve
+func Resolve(opts Options, cmdRunner runner.Runner) ([]string, error) {
+	source, err := New(opts, cmdRunner)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := source.IPs()
+	if err != nil {
+		return nil, err
+	}
+	return resolveHostnames(ips, opts.PreferIPv6, cmdRunner)
+}
+
+// DefaultTerraformOutput is the output read when none is configured
+const DefaultTerraformOutput = "instance_public_ip"
+
+// terraformOutput is one entry of `terraform output -json`
+type terraformOutput struct {
+	Value any `json:"value"`
+}
+
+// DetectIaC returns the tool whose outputs list the hosts when no source
+// is selected: pulumi for a Pulumi project in dir, otherwise terraform, or
+// tofu when only OpenTofu is installed
+func DetectIaC(dir string) string {
+	if dir == "" {
+		dir = "terraform"
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Pulumi.yaml")); err == nil {
+		return "pulumi"
+	}
+	if _, err := exec.LookPath("terraform"); err != nil {
+		if _, err := exec.LookPath("tofu"); err == nil {
+			return "tofu"
+		}
+	}
+	return "terraform"
+}
+
+// outputCommand returns the command printing the outputs of the
+// configuration in dir as JSON
+func outputCommand(tool, dir, workspace string) runner.Command {
+	if tool == "pulumi" {
+		args := []string{"stack", "output", "--json", "--cwd", dir}
+		if workspace != "" {
+			args = append(args, "--stack", workspace)
+		}
+		return runner.Command{Name: "pulumi", Args: args}
+	}
+
+	cmd := runner.Command{Name: tool, Args: []string{fmt.Sprintf("-chdir=%s", dir), "output", "-json"}}
+	if workspace != "" {
+		cmd.Env = []string{"TF_WORKSPACE=" + workspace}
+	}
+	return cmd
+}
+
+// terraformIPs reads the addresses at path in the outputs of the
+// configuration in dir, using workspace when it's set
+func terraformIPs(cmdRunner runner.Runner, tool, dir, workspace, path string) ([]string, error) {
+	if dir == "" {
+		dir = "terraform"
+	}
+	tfpath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if path == "" {
+		path = DefaultTerraformOutput
+	}
+
+	cmd := outputCommand(tool, tfpath, workspace)
+
+	slog.Debug("Executing command", "cmd", cmd.String(), "workspace", workspace)
+
+	out, err := cmdRunner.Run(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute %s: %w", tool, err)
+	}
+
+	// pulumi prints the values themselves, terraform and tofu wrap each
+	// in an object along with its type
+	outputs := make(map[string]any)
+	if tool == "pulumi" {
+		err = json.Unmarshal(out, &outputs)
+	} else {
+		var wrapped map[string]terraformOutput
+		err = json.Unmarshal(out, &wrapped)
+		for name, output := range wrapped {
+			outputs[name] = output.Value
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s output: %w", tool, err)
+	}
+
+	name, rest, _ := strings.Cut(path, ".")
+	value, ok := outputs[name]
+	if !ok {
+		return nil, fmt.Errorf("%s has no output named %q", tool, name)
+	}
+
+	var keys []string
+	if rest != "" {
+		keys = strings.Split(rest, ".")
+	}
+	ips, err := lookupOutput(value, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s output %s: %w", tool, path, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s output %s is empty", tool, path)
+	}
+	return validateIPs(ips)
+}
+
+// lookupOutput follows keys into value, an object or list decoded from a
+// terraform output, and returns the strings found there. A numeric key
+// indexes a list; any other key applied to a list is applied to each of
+// its elements, so "instances.public_ip" yields every instance's address.
+func lookupOutput(value any, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		switch v := value.(type) {
+		case string:
+			return []string{v}, nil
+		case []any:
+			var ips []string
+			for _, elem := range v {
+				found, err := lookupOutput(elem, nil)
+				if err != nil {
+					return nil, err
+				}
+				ips = append(ips, found...)
+			}
+			return ips, nil
+		case nil:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("want a string or a list of strings, got %T", value)
+		}
+	}
+
+	key := keys[0]
+	switch v := value.(type) {
+	case map[string]any:
+		elem, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("no key %q", key)
+		}
+		return lookupOutput(elem, keys[1:])
+	case []any:
+		if i, err := strconv.Atoi(key); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("index %d out of range, the list has %d elements", i, len(v))
+			}
+			return lookupOutput(v[i], keys[1:])
+		}
+		var ips []string
+		for _, elem := range v {
+			found, err := lookupOutput(elem, keys)
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, found...)
+		}
+		return ips, nil
+	default:
+		return nil, fmt.Errorf("can't look up %q in a %T", key, value)
+	}
+}
+
+// isValidIP accepts IPv4 and IPv6 literals
+func isValidIP(ip string) bool {
+	_, err := netaddr.ParseIP(ip)
+	return err == nil
+}
+
+func isValidIPv4(ip string) bool {
+	parsedIP, err := netaddr.ParseIP(ip)
+	if err != nil {
+		return false
+	}
+	return parsedIP.Is4()
+}
@@ -0,0 +1,251 @@
+package ipsource
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+func TestSourceIPs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TARSNAP_IP", "10.0.0.1,10.0.0.2")
+
+	const tailscaleStatus = `{"Peer": {
+		"a": {"HostName": "web1", "DNSName": "web1.tail.ts.net.", "TailscaleIPs": ["100.64.0.1", "fd7a::1"], "Tags": ["tag:web"], "Online": true},
+		"b": {"HostName": "web2", "DNSName": "web2.tail.ts.net.", "TailscaleIPs": ["100.64.0.2", "fd7a::2"], "Tags": ["tag:web"], "Online": false},
+		"c": {"HostName": "db1", "DNSName": "db1.tail.ts.net.", "TailscaleIPs": ["100.64.0.3"], "Tags": ["tag:db"], "Online": true}
+	}}`
+
+	tests := []struct {
+		name    string
+		opts    Options
+		outputs map[string]string
+		errors  map[string]error
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "static",
+			opts: Options{IP: "10.0.0.9", Hosts: []string{"web1.example.com", "fe80::1"}},
+			want: []string{"web1.example.com", "fe80::1", "10.0.0.9"},
+		},
+		{
+			name:    "static rejects invalid hosts",
+			opts:    Options{Source: "static", Hosts: []string{"not a host"}},
+			wantErr: true,
+		},
+		{
+			name:    "static needs a host",
+			opts:    Options{Source: "static"},
+			wantErr: true,
+		},
+		{
+			name: "env",
+			opts: Options{Source: "env"},
+			want: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name: "ec2 skips instances without a public address",
+			opts: Options{Source: "ec2", EC2Tag: "role=web", AWSRegion: "us-east-1"},
+			outputs: map[string]string{
+				"aws ec2 describe-instances --filters Name=tag:role,Values=web Name=instance-state-name,Values=running --query Reservations[].Instances[].PublicIpAddress --output json --region us-east-1": `["1.2.3.4", null, "5.6.7.8"]`,
+			},
+			want: []string{"1.2.3.4", "5.6.7.8"},
+		},
+		{
+			name:    "ec2 tag must be key=value",
+			opts:    Options{Source: "ec2", EC2Tag: "web"},
+			wantErr: true,
+		},
+		{
+			name: "ec2 with no running instances",
+			opts: Options{Source: "ec2", EC2Tag: "role=web"},
+			outputs: map[string]string{
+				"aws ec2 describe-instances --filters Name=tag:role,Values=web Name=instance-state-name,Values=running --query Reservations[].Instances[].PublicIpAddress --output json": `[]`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "aws failing",
+			opts: Options{Source: "ec2", EC2Tag: "role=web"},
+			errors: map[string]error{
+				"aws ec2 describe-instances --filters Name=tag:role,Values=web Name=instance-state-name,Values=running --query Reservations[].Instances[].PublicIpAddress --output json": errors.New("exit status 255"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "gce",
+			opts: Options{Source: "gce", GCELabel: "role=web", GCEZone: "us-central1-a", GCPProject: "p"},
+			outputs: map[string]string{
+				"gcloud compute instances list --filter labels.role=web AND status=RUNNING --format json --zones us-central1-a --project p": `[
+					{"networkInterfaces": [{"accessConfigs": [{"natIP": "34.1.1.1"}]}]},
+					{"networkInterfaces": [{"accessConfigs": [{}]}]}
+				]`,
+			},
+			want: []string{"34.1.1.1"},
+		},
+		{
+			name: "azure splits VMs with several addresses",
+			opts: Options{Source: "azure", AzureTag: "role=web", AzureGroup: "rg"},
+			outputs: map[string]string{
+				"az vm list --show-details --query [?tags.role=='web' && powerState=='VM running'].publicIps --output json --resource-group rg": `["20.0.0.1, 20.0.0.2", ""]`,
+			},
+			want: []string{"20.0.0.1", "20.0.0.2"},
+		},
+		{
+			name:    "tailscale picks online devices by tag",
+			opts:    Options{Source: "tailscale", TailscaleDevice: "tag:web"},
+			outputs: map[string]string{"tailscale status --json": tailscaleStatus},
+			want:    []string{"100.64.0.1"},
+		},
+		{
+			name:    "tailscale prefers IPv6 when asked",
+			opts:    Options{Source: "tailscale", TailscaleDevice: "WEB1", PreferIPv6: true},
+			outputs: map[string]string{"tailscale status --json": tailscaleStatus},
+			want:    []string{"fd7a::1"},
+		},
+		{
+			name:    "tailscale with no matching device",
+			opts:    Options{Source: "tailscale", TailscaleDevice: "web2"},
+			outputs: map[string]string{"tailscale status --json": tailscaleStatus},
+			wantErr: true,
+		},
+		{
+			name: "terraform follows a dotted output path",
+			opts: Options{Source: "terraform", TFDir: dir, TFOutput: "instances.public_ip"},
+			outputs: map[string]string{
+				"terraform -chdir=" + dir + " output -json": `{"instances": {"type": "list", "value": [{"public_ip": "3.3.3.3"}, {"public_ip": "4.4.4.4"}]}}`,
+			},
+			want: []string{"3.3.3.3", "4.4.4.4"},
+		},
+		{
+			name: "terraform default output",
+			opts: Options{Source: "tofu", TFDir: dir},
+			outputs: map[string]string{
+				"tofu -chdir=" + dir + " output -json": `{"instance_public_ip": {"value": "3.3.3.3"}}`,
+			},
+			want: []string{"3.3.3.3"},
+		},
+		{
+			name: "terraform missing output",
+			opts: Options{Source: "terraform", TFDir: dir, TFOutput: "ips"},
+			outputs: map[string]string{
+				"terraform -chdir=" + dir + " output -json": `{"instance_public_ip": {"value": "3.3.3.3"}}`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "pulumi stack outputs are unwrapped",
+			opts: Options{Source: "pulumi", TFDir: dir, TFWorkspace: "dev"},
+			outputs: map[string]string{
+				"pulumi stack output --json --cwd " + dir + " --stack dev": `{"instance_public_ip": ["5.5.5.5"]}`,
+			},
+			want: []string{"5.5.5.5"},
+		},
+		{
+			name:    "unknown source",
+			opts:    Options{Source: "consul"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &runner.Fake{Outputs: tt.outputs, Errors: tt.errors}
+			source, err := New(tt.opts, fake)
+			var got []string
+			if err == nil {
+				got, err = source.IPs()
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerraformWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	fake := &runner.Fake{Outputs: map[string]string{
+		"terraform -chdir=" + dir + " output -json": `{"instance_public_ip": {"value": "3.3.3.3"}}`,
+	}}
+	_, err := terraformIPs(fake, "terraform", dir, "staging", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Calls) != 1 || !reflect.DeepEqual(fake.Calls[0].Env, []string{"TF_WORKSPACE=staging"}) {
+		t.Errorf("workspace not passed through the environment: %+v", fake.Calls)
+	}
+}
+
+func TestLookupOutput(t *testing.T) {
+	value := map[string]any{
+		"web": []any{
+			map[string]any{"ip": "1.1.1.1"},
+			map[string]any{"ip": "2.2.2.2"},
+		},
+		"count": 2.0,
+	}
+
+	tests := []struct {
+		keys    []string
+		want    []string
+		wantErr bool
+	}{
+		{keys: []string{"web", "ip"}, want: []string{"1.1.1.1", "2.2.2.2"}},
+		{keys: []string{"web", "1", "ip"}, want: []string{"2.2.2.2"}},
+		{keys: []string{"web", "2", "ip"}, wantErr: true},
+		{keys: []string{"db"}, wantErr: true},
+		{keys: []string{"count"}, wantErr: true},
+		{keys: []string{"count", "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := lookupOutput(value, tt.keys)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("lookupOutput(%v) = %v, want an error", tt.keys, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lookupOutput(%v): %v", tt.keys, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookupOutput(%v) = %v, want %v", tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestValidateIPs(t *testing.T) {
+	tests := []struct {
+		target string
+		valid  bool
+	}{
+		{"10.0.0.1", true},
+		{"fe80::1", true},
+		{"web-1.example.com", true},
+		{"web-1.example.com.", true},
+		{"-web", false},
+		{"web_1", false},
+		{"a b", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, err := validateIPs([]string{tt.target})
+		if (err == nil) != tt.valid {
+			t.Errorf("validateIPs(%q) error = %v, want valid %v", tt.target, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShellQuote quotes s for display in a copy-pasteable command line
+func ShellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`*?~;&|<>()[]{}#!") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// PrintDryRun shows the command --dry-run skipped on stdout
+func PrintDryRun(name string, args ...string) {
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, name)
+	for _, arg := range args {
+		quoted = append(quoted, ShellQuote(arg))
+	}
+	fmt.Println("[dry-run]", strings.Join(quoted, " "))
+}
+
+// SplitArgs splits s into arguments the way a POSIX shell would, honoring
+// single and double quotes and backslash escapes but expanding nothing
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,119 @@
+// Package runner runs the external commands tarsnap shells out to, behind
+// an interface that tests can fake.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Command is an external command for a Runner
+type Command struct {
+	Name string
+	Args []string
+
+	// Stdin is fed to the command when set
+	Stdin io.Reader
+
+	// Stdout receives the output instead of it being returned when set
+	Stdout io.Writer
+
+	// Stderr receives stderr when set. Otherwise, with Combined, stderr is
+	// returned interleaved with stdout, and without it it's discarded.
+	Stderr   io.Writer
+	Combined bool
+
+	// Env holds KEY=value pairs added to the environment tarsnap runs in
+	Env []string
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Runner runs external commands: ssh, scp, launchctl, terraform and the
+// rest. Everything that shells out takes one, so those paths can be
+// exercised with a Fake instead of the real tools.
+type Runner interface {
+	// Run runs c to completion and returns what it wrote to stdout
+	Run(c Command) ([]byte, error)
+}
+
+// Exec runs commands for real. Commands still running when Context is
+// done are killed.
+type Exec struct {
+	Context context.Context
+}
+
+func (e Exec) Run(c Command) ([]byte, error) {
+	ctx := e.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	cmd.Stdin = c.Stdin
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if c.Stdout != nil {
+		cmd.Stdout = c.Stdout
+	}
+	switch {
+	case c.Stderr != nil:
+		cmd.Stderr = c.Stderr
+	case c.Combined:
+		cmd.Stderr = cmd.Stdout
+	}
+
+	err := cmd.Run()
+	return out.Bytes(), err
+}
+
+// Output runs name and returns its stdout
+func Output(r Runner, name string, args ...string) ([]byte, error) {
+	return r.Run(Command{Name: name, Args: args})
+}
+
+// Combined runs name and returns its stdout and stderr together
+func Combined(r Runner, name string, args ...string) ([]byte, error) {
+	return r.Run(Command{Name: name, Args: args, Combined: true})
+}
+
+// Fake records the commands it is given and answers them from
+// Outputs, keyed by the command line, instead of running anything. It
+// stands in for Exec in tests, and like Exec is safe to share between
+// goroutines.
+type Fake struct {
+	Outputs map[string]string
+	Errors  map[string]error
+	Calls   []Command
+
+	mu sync.Mutex
+}
+
+func (f *Fake) Run(c Command) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, c)
+	if err, ok := f.Errors[c.String()]; ok {
+		return nil, err
+	}
+	out, ok := f.Outputs[c.String()]
+	if !ok {
+		return nil, fmt.Errorf("runner.Fake: no output for %q", c.String())
+	}
+	if c.Stdout != nil {
+		_, err := io.WriteString(c.Stdout, out)
+		return nil, err
+	}
+	return []byte(out), nil
+}
@@ -0,0 +1,242 @@
+// Package schedule installs the job that runs tarsnap periodically: a
+// launchd agent on macOS, a systemd user timer on Linux or a Task Scheduler
+// task on Windows.
+package schedule
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalendarInterval is one launchd StartCalendarInterval dict. Unset fields
+// match every value, like * in cron.
+type CalendarInterval struct {
+	Minute  *int
+	Hour    *int
+	Day     *int
+	Weekday *int
+	Month   *int
+}
+
+// CalendarEntry is one key of a StartCalendarInterval dict
+type CalendarEntry struct {
+	Key   string
+	Value int
+}
+
+// Entries returns the keys set on c in the order launchd documents them
+func (c CalendarInterval) Entries() []CalendarEntry {
+	var entries []CalendarEntry
+	for _, f := range []struct {
+		key   string
+		value *int
+	}{{"Month", c.Month}, {"Day", c.Day}, {"Weekday", c.Weekday}, {"Hour", c.Hour}, {"Minute", c.Minute}} {
+		if f.value != nil {
+			entries = append(entries, CalendarEntry{Key: f.key, Value: *f.value})
+		}
+	}
+	return entries
+}
+
+// Matches reports whether c fires at the minute t falls in. Cron's weekday
+// 7 is Sunday like 0.
+func (c CalendarInterval) Matches(t time.Time) bool {
+	match := func(want *int, got int) bool { return want == nil || *want == got }
+	weekday := c.Weekday
+	if weekday != nil && *weekday == 7 {
+		weekday = intPtr(0)
+	}
+	return match(c.Minute, t.Minute()) && match(c.Hour, t.Hour()) && match(c.Day, t.Day()) &&
+		match(c.Month, int(t.Month())) && match(weekday, int(t.Weekday()))
+}
+
+// Due counts the minutes after from, up to and including to, at which one
+// of intervals fires
+func Due(intervals []CalendarInterval, from, to time.Time) int {
+	n := 0
+	for t := from.Truncate(time.Minute).Add(time.Minute); !t.After(to); t = t.Add(time.Minute) {
+		for _, c := range intervals {
+			if c.Matches(t) {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+var weekdays = map[string]int{
+	"sunday": 0, "monday": 1, "tuesday": 2, "wednesday": 3,
+	"thursday": 4, "friday": 5, "saturday": 6,
+}
+
+var (
+	hourlyRe = regexp.MustCompile(`^hourly(?: at :(\d{1,2}))?$`)
+	dailyRe  = regexp.MustCompile(`^daily(?: at (\d{1,2}):(\d{2}))?$`)
+	weeklyRe = regexp.MustCompile(`^weekly on (\w+)(?: at (\d{1,2}):(\d{2}))?$`)
+)
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func atoiPtr(s string) *int {
+	if s == "" {
+		return intPtr(0)
+	}
+	n, _ := strconv.Atoi(s)
+	return &n
+}
+
+// Parse turns "hourly at :15", "daily at 09:00", "weekly on monday
+// at 08:30" or a five field cron expression into calendar intervals
+func Parse(expr string) ([]CalendarInterval, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+
+	if m := hourlyRe.FindStringSubmatch(expr); m != nil {
+		return validateCalendar([]CalendarInterval{{Minute: atoiPtr(m[1])}})
+	}
+	if m := dailyRe.FindStringSubmatch(expr); m != nil {
+		return validateCalendar([]CalendarInterval{{Hour: atoiPtr(m[1]), Minute: atoiPtr(m[2])}})
+	}
+	if m := weeklyRe.FindStringSubmatch(expr); m != nil {
+		day, ok := weekdays[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", m[1])
+		}
+		return validateCalendar([]CalendarInterval{{Weekday: intPtr(day), Hour: atoiPtr(m[2]), Minute: atoiPtr(m[3])}})
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) == 5 {
+		return parseCron(fields)
+	}
+
+	return nil, fmt.Errorf("unrecognized schedule %q", expr)
+}
+
+// cronField expands one cron field into its values; nil means *
+func cronField(field string, min, max int) ([]int, error) {
+	if field == "*" {
+		return nil, nil
+	}
+
+	var values []int
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			a, b, isRange := strings.Cut(rangePart, "-")
+			n, err := strconv.Atoi(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cron value %q", part)
+			}
+			lo, hi = n, n
+			if isRange {
+				hi, err = strconv.Atoi(b)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cron range %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("cron value %q out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			values = append(values, v)
+		}
+	}
+
+	return values, nil
+}
+
+// parseCron expands "minute hour day month weekday" into the cartesian
+// product of calendar intervals, since launchd has no lists or ranges
+func parseCron(fields []string) ([]CalendarInterval, error) {
+	limits := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+	expanded := make([][]int, len(fields))
+	for i, field := range fields {
+		values, err := cronField(field, limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, err
+		}
+		expanded[i] = values
+	}
+
+	intervals := []CalendarInterval{{}}
+	for i, values := range expanded {
+		if values == nil {
+			continue
+		}
+		var next []CalendarInterval
+		for _, c := range intervals {
+			for _, v := range values {
+				v := v
+				switch i {
+				case 0:
+					c.Minute = &v
+				case 1:
+					c.Hour = &v
+				case 2:
+					c.Day = &v
+				case 3:
+					c.Month = &v
+				case 4:
+					c.Weekday = &v
+				}
+				next = append(next, c)
+			}
+		}
+		intervals = next
+	}
+
+	return validateCalendar(intervals)
+}
+
+func validateCalendar(intervals []CalendarInterval) ([]CalendarInterval, error) {
+	if len(intervals) > 1000 {
+		return nil, fmt.Errorf("schedule expands to %d calendar intervals, simplify it", len(intervals))
+	}
+	for _, c := range intervals {
+		if c.Minute != nil && *c.Minute > 59 {
+			return nil, fmt.Errorf("minute %d out of range", *c.Minute)
+		}
+		if c.Hour != nil && *c.Hour > 23 {
+			return nil, fmt.Errorf("hour %d out of range", *c.Hour)
+		}
+	}
+	return intervals, nil
+}
+
+// EnvVar is an environment variable exported to the scheduled job
+type EnvVar struct {
+	Key   string
+	Value string
+}
+
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ParseEnv parses KEY=VALUE
+func ParseEnv(s string) (EnvVar, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || !envKeyRe.MatchString(key) {
+		return EnvVar{}, fmt.Errorf("invalid environment variable %q, want KEY=VALUE", s)
+	}
+	return EnvVar{Key: key, Value: value}, nil
+}
@@ -0,0 +1,149 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describe prints intervals compactly, with * for unset fields, in cron's
+// minute hour day month weekday order
+func describe(intervals []CalendarInterval) string {
+	field := func(v *int) string {
+		if v == nil {
+			return "*"
+		}
+		return fmt.Sprint(*v)
+	}
+	var parts []string
+	for _, c := range intervals {
+		parts = append(parts, strings.Join([]string{field(c.Minute), field(c.Hour), field(c.Day), field(c.Month), field(c.Weekday)}, " "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "hourly", want: "0 * * * *"},
+		{expr: "hourly at :15", want: "15 * * * *"},
+		{expr: "daily", want: "0 0 * * *"},
+		{expr: "Daily at 09:30", want: "30 9 * * *"},
+		{expr: "weekly on monday at 08:30", want: "30 8 * * 1"},
+		{expr: "weekly on sunday", want: "0 0 * * 0"},
+		{expr: "*/20 * * * *", want: "0 * * * *, 20 * * * *, 40 * * * *"},
+		{expr: "0 9-10 * * 1,5", want: "0 9 * * 1, 0 9 * * 5, 0 10 * * 1, 0 10 * * 5"},
+		{expr: "30 2 1 */6 *", want: "30 2 1 1 *, 30 2 1 7 *"},
+		{expr: "weekly on someday", wantErr: true},
+		{expr: "daily at 25:00", wantErr: true},
+		{expr: "hourly at :75", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * *", want: "* * * * *"},
+		{expr: "*/1 */1 * * *", wantErr: true},
+		{expr: "every tuesday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.expr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %s, want an error", tt.expr, describe(got))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		if describe(got) != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.expr, describe(got), tt.want)
+		}
+	}
+}
+
+func TestDue(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	mustParse := func(expr string) []CalendarInterval {
+		intervals, err := Parse(expr)
+		if err != nil {
+			panic(err)
+		}
+		return intervals
+	}
+
+	tests := []struct {
+		name     string
+		schedule string
+		from, to string
+		want     int
+	}{
+		{name: "ran on time", schedule: "daily at 09:00", from: "2024-01-01 09:00", to: "2024-01-02 08:59", want: 0},
+		{name: "due once", schedule: "daily at 09:00", from: "2024-01-01 09:00", to: "2024-01-02 09:00", want: 1},
+		{name: "missed a week", schedule: "daily at 09:00", from: "2024-01-01 09:00", to: "2024-01-08 10:00", want: 7},
+		{name: "hourly", schedule: "hourly at :30", from: "2024-01-01 00:00", to: "2024-01-01 05:59", want: 6},
+		{name: "weekly", schedule: "weekly on monday", from: "2024-01-01 00:00", to: "2024-01-22 00:00", want: 3},
+		{name: "cron sunday as 7", schedule: "0 12 * * 7", from: "2024-01-01 00:00", to: "2024-01-08 00:00", want: 1},
+		{name: "overlapping intervals count once", schedule: "0 12 * * 0,7", from: "2024-01-01 00:00", to: "2024-01-08 00:00", want: 1},
+	}
+	for _, tt := range tests {
+		if got := Due(mustParse(tt.schedule), at(tt.from), at(tt.to)); got != tt.want {
+			t.Errorf("%s: Due = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOnCalendar(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"hourly at :15", "*-*-* *:15:00"},
+		{"daily at 09:30", "*-*-* 09:30:00"},
+		{"weekly on friday at 17:00", "Fri *-*-* 17:00:00"},
+		{"0 0 1 1 *", "*-01-01 00:00:00"},
+	}
+	for _, tt := range tests {
+		intervals, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := intervals[0].OnCalendar(); got != tt.want {
+			t.Errorf("OnCalendar(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    EnvVar
+		wantErr bool
+	}{
+		{s: "PATH=/usr/bin:/bin", want: EnvVar{Key: "PATH", Value: "/usr/bin:/bin"}},
+		{s: "EMPTY=", want: EnvVar{Key: "EMPTY"}},
+		{s: "A=b=c", want: EnvVar{Key: "A", Value: "b=c"}},
+		{s: "NOVALUE", wantErr: true},
+		{s: "1BAD=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseEnv(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseEnv(%q) = %+v, %v", tt.s, got, err)
+		}
+	}
+}
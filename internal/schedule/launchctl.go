@@ -0,0 +1,108 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// Launchctl loads and unloads agents with bootstrap and bootout, which
+// replaced load and unload in macOS 10.11, falling back to load and unload
+// on older releases or when asked to
+type Launchctl struct {
+	Runner runner.Runner
+
+	bootstrap bool
+}
+
+// NewLaunchctl returns a Launchctl for the running macOS. With legacy set
+// load and unload are always used.
+func NewLaunchctl(cmdRunner runner.Runner, legacy bool) Launchctl {
+	l := Launchctl{Runner: cmdRunner}
+	if !legacy {
+		l.bootstrap = hasBootstrap(cmdRunner)
+	}
+	return l
+}
+
+// hasBootstrap reports whether sw_vers says the system is macOS 10.11 or
+// later
+func hasBootstrap(cmdRunner runner.Runner) bool {
+	out, err := runner.Output(cmdRunner, "sw_vers", "-productVersion")
+	if err != nil {
+		slog.Debug("Failed to detect macOS version, using launchctl load", "err", err)
+		return false
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(out)), ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major > 10 || (major == 10 && minor >= 11)
+}
+
+// domain is the launchd domain of the logged in user's agents
+func domain() string {
+	return fmt.Sprintf("gui/%d", os.Getuid())
+}
+
+// LoadArgs are the launchctl arguments Load runs
+func (l Launchctl) LoadArgs(plist string) []string {
+	if l.bootstrap {
+		return []string{"bootstrap", domain(), plist}
+	}
+	return []string{"load", plist}
+}
+
+func (l Launchctl) unloadArgs(label, plist string) []string {
+	if l.bootstrap {
+		return []string{"bootout", domain() + "/" + label}
+	}
+	return []string{"unload", plist}
+}
+
+func (l Launchctl) kickstartArgs(label string) []string {
+	if l.bootstrap {
+		return []string{"kickstart", domain() + "/" + label}
+	}
+	return []string{"start", label}
+}
+
+func (l Launchctl) run(args ...string) error {
+	slog.Debug("Executing command", "cmd", "launchctl "+strings.Join(args, " "))
+	out, err := runner.Combined(l.Runner, "launchctl", args...)
+	msg := strings.TrimSpace(string(out))
+
+	// load can report a failure and still exit 0
+	if err == nil && (strings.Contains(msg, "failed") || strings.Contains(msg, "Invalid")) {
+		err = errors.New("reported an error")
+	}
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %w: %s", strings.Join(args, " "), err, msg)
+	}
+	return nil
+}
+
+// Load loads the plist into launchd
+func (l Launchctl) Load(plist string) error {
+	return l.run(l.LoadArgs(plist)...)
+}
+
+// Unload removes the job label, loaded from plist, from launchd
+func (l Launchctl) Unload(label, plist string) error {
+	return l.run(l.unloadArgs(label, plist)...)
+}
+
+// Kickstart starts the loaded job label right away
+func (l Launchctl) Kickstart(label string) error {
+	return l.run(l.kickstartArgs(label)...)
+}
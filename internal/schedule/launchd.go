@@ -0,0 +1,542 @@
+package schedule
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// labelUnsafeRe matches the characters that don't belong in a launchd label
+// or plist file name, such as the colons of an IPv6 address
+var labelUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// SanitizeHost makes host safe to use in a label or file name
+func SanitizeHost(host string) string {
+	return strings.Trim(labelUnsafeRe.ReplaceAllString(host, "-"), ".-")
+}
+
+// JobLabel is the launchd label for the job fetching from host
+func JobLabel(prefix, host string) string {
+	part := SanitizeHost(host)
+	if part == "" {
+		return prefix
+	}
+	return prefix + "." + part
+}
+
+// Job is a tarsnap plist found in LaunchAgents
+type Job struct {
+	Label   string `json:"label"`
+	Path    string `json:"path"`
+	Cwd     string `json:"working_directory"`
+	Program string `json:"program"`
+
+	// Schedule describes StartInterval or StartCalendarInterval
+	Schedule string `json:"schedule,omitempty"`
+
+	// Args are the whole command line, Program included, and LogPath where
+	// its output goes
+	Args    []string `json:"args,omitempty"`
+	LogPath string   `json:"log_path,omitempty"`
+}
+
+// Flag returns the value the job passes for the flag named name, such as
+// "--state-dir", or "" when it doesn't pass it
+func (j Job) Flag(name string) string {
+	for i, arg := range j.Args {
+		if arg == name && i+1 < len(j.Args) {
+			return j.Args[i+1]
+		}
+		if v, ok := strings.CutPrefix(arg, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// Orphaned reports why the job can no longer run, or "" if it can
+func (j Job) Orphaned() string {
+	if j.Program != "" {
+		if _, err := os.Stat(j.Program); err != nil {
+			return "program missing"
+		}
+	}
+	if j.Cwd != "" {
+		if _, err := os.Stat(j.Cwd); err != nil {
+			return "working directory missing"
+		}
+	}
+	return ""
+}
+
+// LaunchAgentsDir is ~/Library/LaunchAgents
+func LaunchAgentsDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(home, "Library/LaunchAgents"), nil
+}
+
+// ReadJob pulls the label, working directory and program out of the
+// top level dict of a plist
+func ReadJob(path string) (Job, error) {
+	job := Job{Path: path}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return job, err
+	}
+	defer f.Close()
+
+	dec := xml.NewDecoder(f)
+	depth, key, calendar := 0, "", 0
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return job, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 4 && key == "StartCalendarInterval" && t.Name.Local == "dict" {
+				calendar++
+			}
+			if t.Name.Local != "key" && t.Name.Local != "string" && t.Name.Local != "integer" {
+				continue
+			}
+			var text string
+			err := dec.DecodeElement(&text, &t)
+			if err != nil {
+				return job, fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+			depth--
+
+			switch {
+			case t.Name.Local == "key" && depth == 2:
+				key = text
+			case depth == 2 && key == "Label":
+				job.Label = text
+			case depth == 2 && key == "StartInterval":
+				if secs, err := strconv.Atoi(strings.TrimSpace(text)); err == nil {
+					job.Schedule = "every " + (time.Duration(secs) * time.Second).String()
+				}
+			case depth == 2 && key == "WorkingDirectory":
+				job.Cwd = text
+			case depth == 2 && key == "StandardOutPath":
+				job.LogPath = text
+			case depth == 3 && key == "ProgramArguments":
+				if job.Program == "" {
+					job.Program = text
+				}
+				job.Args = append(job.Args, text)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if calendar > 0 {
+		job.Schedule = fmt.Sprintf("calendar, %d entries", calendar)
+	}
+	return job, nil
+}
+
+// ListJobs returns the jobs in dir whose label starts with prefix
+func ListJobs(dir, prefix string) ([]Job, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, prefix+".*.plist"))
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	for _, path := range paths {
+		job, err := ReadJob(path)
+		if err != nil {
+			slog.Warn("Failed to read plist", "path", path, "err", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// RemoveJob unloads the job and deletes its plist
+func RemoveJob(l Launchctl, job Job, dryRun bool) error {
+	if dryRun {
+		runner.PrintDryRun("launchctl", l.unloadArgs(job.Label, job.Path)...)
+		runner.PrintDryRun("rm", job.Path)
+		return nil
+	}
+
+	err := l.Unload(job.Label, job.Path)
+	if err != nil {
+		// Not loaded is fine, the plist still has to go
+		slog.Debug("launchctl unload failed", "path", job.Path, "err", err)
+	}
+
+	err = os.Remove(job.Path)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", job.Path, err)
+	}
+	slog.Info("Removed launchd job", "label", job.Label, "path", job.Path)
+	return nil
+}
+
+// ReplaceStaleJobs removes the plists an earlier install wrote for the same
+// working directory under a different label, typically because the host's
+// address changed since
+func ReplaceStaleJobs(l Launchctl, dir, prefix, label, cwd string, dryRun bool) error {
+	jobs, err := ListJobs(dir, prefix)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, job := range jobs {
+		if job.Label == label || job.Cwd != cwd {
+			continue
+		}
+		slog.Info("Replacing launchd job for the same target", "old", job.Label, "new", label)
+		errs = append(errs, RemoveJob(l, job, dryRun))
+	}
+	return errors.Join(errs...)
+}
+
+// PlistData holds the data to be filled in the plist template
+type PlistData struct {
+	Label         string
+	IP            string
+	Args          []string
+	Path          string
+	Cwd           string
+	LogPath       string
+	StartInterval string
+
+	// Env is exported to the job; a PATH in it replaces the default one
+	Env []EnvVar
+
+	// CalendarIntervals replaces StartInterval when a -schedule is given
+	CalendarIntervals []CalendarInterval
+
+	RunAtLoad bool
+	KeepAlive KeepAlive
+
+	// ThrottleInterval and Nice are left to launchd's defaults when 0
+	ThrottleInterval int
+	Nice             int
+	LowPriorityIO    bool
+}
+
+// EnvHas reports whether d.Env sets key
+func (d PlistData) EnvHas(key string) bool {
+	for _, e := range d.Env {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the values launchd would reject or silently clamp
+func (d PlistData) Validate() error {
+	if d.ThrottleInterval < 0 {
+		return fmt.Errorf("throttle interval %d must not be negative", d.ThrottleInterval)
+	}
+	if d.Nice < -20 || d.Nice > 20 {
+		return fmt.Errorf("nice %d out of range -20 to 20", d.Nice)
+	}
+	return nil
+}
+
+// KeepAlive is launchd's KeepAlive key: restart the job always, or only
+// under Conditions. The zero value leaves the key out, so the job only runs
+// on its schedule.
+type KeepAlive struct {
+	Always     bool
+	Conditions []KeepAliveCondition
+}
+
+// KeepAliveCondition is one key of a KeepAlive dict
+type KeepAliveCondition struct {
+	Key   string
+	Value bool
+}
+
+// ParseKeepAlive turns "always", or a comma separated list of "crashed"
+// (restart after a crash) and "failed" (restart after a non-zero exit),
+// into a KeepAlive. An empty spec or "never" leaves KeepAlive unset.
+func ParseKeepAlive(spec string) (KeepAlive, error) {
+	var k KeepAlive
+	for _, part := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(part) {
+		case "", "never":
+		case "always":
+			k.Always = true
+		case "crashed":
+			k.Conditions = append(k.Conditions, KeepAliveCondition{Key: "Crashed", Value: true})
+		case "failed":
+			k.Conditions = append(k.Conditions, KeepAliveCondition{Key: "SuccessfulExit", Value: false})
+		default:
+			return KeepAlive{}, fmt.Errorf("unknown keep-alive condition %q, want never, always, crashed or failed", part)
+		}
+	}
+	if k.Always && len(k.Conditions) > 0 {
+		return KeepAlive{}, fmt.Errorf("keep-alive %q: always can't be combined with conditions", spec)
+	}
+	return k, nil
+}
+
+// PlistTemplate is the boilerplate for the .plist file. Strings that come
+// from the user go through html, whose escaping is also valid XML.
+const PlistTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>Label</key>
+  <string>{{.Label}}</string>
+
+  <key>ProgramArguments</key>
+  <array>
+{{- range .Args}}
+    <string>{{html .}}</string>
+{{- end}}
+  </array>
+
+  <key>EnvironmentVariables</key>
+<dict>
+{{- if not (.EnvHas "PATH")}}
+  <key>PATH</key>
+  <string>/usr/local/bin:{{html .Path}}:/usr/bin:/bin:/usr/sbin:/sbin:</string>
+{{- end}}
+{{- range .Env}}
+  <key>{{html .Key}}</key>
+  <string>{{html .Value}}</string>
+{{- end}}
+</dict>
+{{if .CalendarIntervals}}
+  <key>StartCalendarInterval</key>
+  <array>
+{{- range .CalendarIntervals}}
+    <dict>
+{{- range .Entries}}
+      <key>{{.Key}}</key>
+      <integer>{{.Value}}</integer>
+{{- end}}
+    </dict>
+{{- end}}
+  </array>
+{{else}}
+  <key>StartInterval</key>
+  <integer>{{.StartInterval}}</integer>
+{{end}}
+  <key>StandardOutPath</key>
+  <string>{{html .LogPath}}</string>
+
+  <key>StandardErrorPath</key>
+  <string>{{html .LogPath}}</string>
+
+  <key>WorkingDirectory</key>
+  <string>{{html .Cwd}}</string>
+
+  <key>RunAtLoad</key>
+  <{{.RunAtLoad}}/>
+{{- if .KeepAlive.Always}}
+
+  <key>KeepAlive</key>
+  <true/>
+{{- else if .KeepAlive.Conditions}}
+
+  <key>KeepAlive</key>
+  <dict>
+{{- range .KeepAlive.Conditions}}
+    <key>{{.Key}}</key>
+    <{{.Value}}/>
+{{- end}}
+  </dict>
+{{- end}}
+{{- if .ThrottleInterval}}
+
+  <key>ThrottleInterval</key>
+  <integer>{{.ThrottleInterval}}</integer>
+{{- end}}
+{{- if .Nice}}
+
+  <key>Nice</key>
+  <integer>{{.Nice}}</integer>
+{{- end}}
+{{- if .LowPriorityIO}}
+
+  <key>LowPriorityIO</key>
+  <true/>
+{{- end}}
+</dict>
+</plist>
+`
+
+// ListEntry is one line of `launchctl list`
+type ListEntry struct {
+	PID    string
+	Status string
+}
+
+// List returns the `launchctl list` entries by label
+func List(cmdRunner runner.Runner) (map[string]ListEntry, error) {
+	slog.Debug("Executing command", "cmd", "launchctl list")
+
+	out, err := runner.Output(cmdRunner, "launchctl", "list")
+	if err != nil {
+		return nil, fmt.Errorf("launchctl list: %w", err)
+	}
+
+	entries := make(map[string]ListEntry)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] == "PID" {
+			continue
+		}
+		entries[fields[2]] = ListEntry{PID: strings.Trim(fields[0], "-"), Status: fields[1]}
+	}
+	return entries, nil
+}
+
+// Loaded reports whether launchctl list shows the job
+func Loaded(cmdRunner runner.Runner, label string) (bool, error) {
+	out, err := runner.Output(cmdRunner, "launchctl", "list")
+	if err != nil {
+		return false, fmt.Errorf("launchctl list: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[2] == label {
+			slog.Debug("launchctl list", "entry", line)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Lint checks the plist at path with plutil -lint. Where plutil isn't
+// available the file is only checked to be well-formed XML.
+func Lint(cmdRunner runner.Runner, path string) error {
+	slog.Debug("Executing command", "cmd", "plutil -lint "+path)
+	out, err := runner.Combined(cmdRunner, "plutil", "-lint", path)
+	if errors.Is(err, exec.ErrNotFound) {
+		return lintXML(path)
+	}
+	if err != nil {
+		return fmt.Errorf("plutil -lint: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func lintXML(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dec := xml.NewDecoder(file)
+	for {
+		_, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not a valid plist: %w", path, err)
+		}
+	}
+}
+
+// InstallPlist replaces the plist at path with data and loads it as label.
+// The new plist is linted before it replaces anything, and when it doesn't
+// load the previous version, if any, is put back and reloaded, so a broken
+// agent is never left behind.
+func InstallPlist(l Launchctl, label, path string, data []byte) error {
+	previous, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := atomicfile.Create(path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer tmp.Abort()
+	_, err = tmp.Write(data)
+	if err != nil {
+		return err
+	}
+	err = Lint(l.Runner, tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	// A loaded previous version has to go before the new one can load
+	if previous != nil {
+		err = l.Unload(label, path)
+		if err != nil {
+			slog.Debug("Failed to unload previous plist", "path", path, "err", err)
+		}
+	}
+	err = tmp.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to create .plist file: %w", err)
+	}
+	slog.Info("Created launchd plist", "path", path)
+
+	err = l.Load(path)
+	if err == nil {
+		// launchd may drop a job that exits right away, so look twice
+		var loaded bool
+		for i := 0; i < 2 && err == nil; i++ {
+			if i > 0 {
+				time.Sleep(500 * time.Millisecond)
+			}
+			loaded, err = Loaded(l.Runner, label)
+			if err == nil && !loaded {
+				err = fmt.Errorf("job %s not in launchctl list after loading", label)
+			}
+		}
+	}
+	if err == nil {
+		slog.Info("Job loaded", "label", label)
+		return nil
+	}
+
+	return errors.Join(err, rollbackPlist(l, label, path, previous))
+}
+
+// rollbackPlist unloads the plist at path and restores previous, reloading
+// it, or removes the plist when there was none
+func rollbackPlist(l Launchctl, label, path string, previous []byte) error {
+	l.Unload(label, path)
+	if previous == nil {
+		slog.Warn("Removing plist that failed to load", "path", path)
+		return os.Remove(path)
+	}
+
+	slog.Warn("Restoring previous plist", "path", path)
+	err := atomicfile.WriteFile(path, previous, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	return l.Load(path)
+}
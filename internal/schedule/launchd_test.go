@@ -0,0 +1,242 @@
+package schedule
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// runFunc is a runner.Runner answering every command with a function, for
+// commands whose arguments, such as temporary file names, aren't known in
+// advance
+type runFunc func(c runner.Command) ([]byte, error)
+
+func (f runFunc) Run(c runner.Command) ([]byte, error) {
+	return f(c)
+}
+
+func TestHasBootstrap(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"14.4.1", true},
+		{"10.11", true},
+		{"10.10.5", false},
+		{"10.9", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		fake := &runner.Fake{Outputs: map[string]string{"sw_vers -productVersion": tt.version + "\n"}}
+		if got := hasBootstrap(fake); got != tt.want {
+			t.Errorf("hasBootstrap(%s) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+
+	fake := &runner.Fake{Errors: map[string]error{"sw_vers -productVersion": errors.New("not found")}}
+	if hasBootstrap(fake) {
+		t.Error("hasBootstrap without sw_vers = true")
+	}
+}
+
+func TestLaunchctlArgs(t *testing.T) {
+	fake := &runner.Fake{Outputs: map[string]string{"sw_vers -productVersion": "14.0"}}
+	modern := NewLaunchctl(fake, false)
+	legacy := NewLaunchctl(fake, true)
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"bootstrap", modern.LoadArgs("/a.plist"), []string{"bootstrap", domain(), "/a.plist"}},
+		{"bootout", modern.unloadArgs("com.tarsnap.a", "/a.plist"), []string{"bootout", domain() + "/com.tarsnap.a"}},
+		{"kickstart", modern.kickstartArgs("com.tarsnap.a"), []string{"kickstart", domain() + "/com.tarsnap.a"}},
+		{"load", legacy.LoadArgs("/a.plist"), []string{"load", "/a.plist"}},
+		{"unload", legacy.unloadArgs("com.tarsnap.a", "/a.plist"), []string{"unload", "/a.plist"}},
+		{"start", legacy.kickstartArgs("com.tarsnap.a"), []string{"start", "com.tarsnap.a"}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: args = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if len(fake.Calls) != 1 {
+		t.Errorf("legacy launchctl checked the macOS version: %d calls", len(fake.Calls))
+	}
+}
+
+func TestLaunchctlReportedFailure(t *testing.T) {
+	// load prints its failures and still exits 0
+	fake := &runner.Fake{Outputs: map[string]string{"launchctl load /a.plist": "Load failed: 5: Input/output error\n"}}
+	err := Launchctl{Runner: fake}.Load("/a.plist")
+	if err == nil || !strings.Contains(err.Error(), "Input/output error") {
+		t.Errorf("Load = %v, want the reported failure", err)
+	}
+}
+
+func TestLoaded(t *testing.T) {
+	fake := &runner.Fake{Outputs: map[string]string{"launchctl list": "PID\tStatus\tLabel\n-\t0\tcom.tarsnap.a\n412\t0\tcom.apple.b\n"}}
+	for label, want := range map[string]bool{"com.tarsnap.a": true, "com.apple.b": true, "com.tarsnap.c": false} {
+		got, err := Loaded(fake, label)
+		if err != nil || got != want {
+			t.Errorf("Loaded(%s) = %v, %v, want %v", label, got, err, want)
+		}
+	}
+
+	entries, err := List(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ListEntry{"com.tarsnap.a": {Status: "0"}, "com.apple.b": {PID: "412", Status: "0"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("List = %+v, want %+v", entries, want)
+	}
+}
+
+// launchd fakes plutil and launchctl for InstallPlist: plists holding
+// "broken" fail to load, and loaded labels show up in launchctl list
+type launchd struct {
+	loaded map[string]bool
+	calls  []string
+}
+
+func (l *launchd) Run(c runner.Command) ([]byte, error) {
+	l.calls = append(l.calls, c.String())
+	switch {
+	case c.Name == "plutil":
+		data, err := os.ReadFile(c.Args[len(c.Args)-1])
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(string(data), "invalid") {
+			return []byte("Encountered unexpected element"), errors.New("exit status 1")
+		}
+		return nil, nil
+	case c.Name == "launchctl" && c.Args[0] == "load":
+		data, err := os.ReadFile(c.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(string(data), "broken") {
+			return []byte("Load failed: 5: Input/output error"), nil
+		}
+		l.loaded[string(data)] = true
+		return nil, nil
+	case c.Name == "launchctl" && c.Args[0] == "unload":
+		return nil, nil
+	case c.Name == "launchctl" && c.Args[0] == "list":
+		var out strings.Builder
+		for label := range l.loaded {
+			out.WriteString("-\t0\t" + label + "\n")
+		}
+		return []byte(out.String()), nil
+	}
+	return nil, errors.New("unexpected command " + c.String())
+}
+
+func TestInstallPlist(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		data     string
+		want     string
+		wantErr  bool
+	}{
+		{name: "fresh install", data: "com.tarsnap.a", want: "com.tarsnap.a"},
+		{name: "replaces the previous plist", previous: "com.tarsnap.old", data: "com.tarsnap.a", want: "com.tarsnap.a"},
+		{name: "lint failure keeps the previous plist", previous: "com.tarsnap.old", data: "invalid", want: "com.tarsnap.old", wantErr: true},
+		{name: "load failure restores the previous plist", previous: "com.tarsnap.old", data: "broken", want: "com.tarsnap.old", wantErr: true},
+		{name: "load failure without a previous plist removes it", data: "broken", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "com.tarsnap.a.plist")
+			if tt.previous != "" {
+				os.WriteFile(path, []byte(tt.previous), 0o600)
+			}
+			fake := &launchd{loaded: make(map[string]bool)}
+
+			// The plist's content doubles as its label, so the fake can
+			// tell which version launchctl loaded
+			label := tt.data
+			err := InstallPlist(Launchctl{Runner: fake}, label, path, []byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InstallPlist = %v, want error %v; ran %q", err, tt.wantErr, fake.calls)
+			}
+
+			data, err := os.ReadFile(path)
+			if tt.want == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("plist left behind: %q", data)
+				}
+			} else if string(data) != tt.want {
+				t.Errorf("plist = %q, want %q", data, tt.want)
+			}
+			if tt.data == "broken" && tt.previous != "" && !fake.loaded[tt.previous] {
+				t.Error("restored plist wasn't reloaded")
+			}
+
+			entries, _ := os.ReadDir(filepath.Dir(path))
+			for _, e := range entries {
+				if e.Name() != filepath.Base(path) {
+					t.Errorf("temporary file left behind: %s", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestLintWithoutPlutil(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.plist")
+	bad := filepath.Join(dir, "bad.plist")
+	os.WriteFile(good, []byte("<plist><dict></dict></plist>"), 0o600)
+	os.WriteFile(bad, []byte("<plist><dict></plist>"), 0o600)
+
+	notFound := runFunc(func(c runner.Command) ([]byte, error) {
+		return nil, &exec.Error{Name: c.Name, Err: exec.ErrNotFound}
+	})
+	if err := Lint(notFound, good); err != nil {
+		t.Errorf("Lint(good) = %v", err)
+	}
+	if err := Lint(notFound, bad); err == nil {
+		t.Error("Lint(bad) accepted mismatched tags")
+	}
+}
+
+func TestReplaceStaleJobs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(label, cwd string) string {
+		path := filepath.Join(dir, label+".plist")
+		plist := `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>Label</key><string>` + label + `</string>
+<key>ProgramArguments</key><array><string>/usr/local/bin/tarsnap</string></array>
+<key>WorkingDirectory</key><string>` + cwd + `</string>
+</dict></plist>`
+		os.WriteFile(path, []byte(plist), 0o600)
+		return path
+	}
+	current := write("com.tarsnap.10-0-0-2", "/work")
+	stale := write("com.tarsnap.10-0-0-1", "/work")
+	other := write("com.tarsnap.10-0-0-3", "/elsewhere")
+
+	fake := &runner.Fake{Outputs: map[string]string{"launchctl unload " + stale: ""}}
+	err := ReplaceStaleJobs(Launchctl{Runner: fake}, dir, "com.tarsnap", "com.tarsnap.10-0-0-2", "/work", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{current: true, stale: false, other: true} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s exists: %v, want %v", filepath.Base(path), err == nil, want)
+		}
+	}
+}
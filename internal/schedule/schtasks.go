@@ -0,0 +1,187 @@
+package schedule
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf16"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// TaskData holds the data filled into TaskTemplate
+type TaskData struct {
+	Description   string
+	StartBoundary string
+	Interval      string
+	Command       string
+	Arguments     string
+	WorkingDir    string
+}
+
+// TaskTemplate is a Task Scheduler task repeating the fetch every Interval,
+// the Windows counterpart of PlistTemplate
+const TaskTemplate = `<?xml version="1.0" encoding="UTF-16"?>
+<Task version="1.2" xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task">
+  <RegistrationInfo>
+    <Description>{{xml .Description}}</Description>
+  </RegistrationInfo>
+  <Triggers>
+    <TimeTrigger>
+      <StartBoundary>{{.StartBoundary}}</StartBoundary>
+      <Repetition>
+        <Interval>{{.Interval}}</Interval>
+        <StopAtDurationEnd>false</StopAtDurationEnd>
+      </Repetition>
+      <Enabled>true</Enabled>
+    </TimeTrigger>
+  </Triggers>
+  <Settings>
+    <MultipleInstancesPolicy>IgnoreNew</MultipleInstancesPolicy>
+    <DisallowStartIfOnBatteries>false</DisallowStartIfOnBatteries>
+    <StopIfGoingOnBatteries>false</StopIfGoingOnBatteries>
+    <StartWhenAvailable>true</StartWhenAvailable>
+    <Enabled>true</Enabled>
+  </Settings>
+  <Actions>
+    <Exec>
+      <Command>{{xml .Command}}</Command>
+      <Arguments>{{xml .Arguments}}</Arguments>
+      <WorkingDirectory>{{xml .WorkingDir}}</WorkingDirectory>
+    </Exec>
+  </Actions>
+</Task>
+`
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// windowsQuote quotes arg for a Windows command line
+func windowsQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
+
+// taskInterval renders d as the ISO 8601 duration Task Scheduler expects.
+// Repetition intervals must be at least a minute.
+func taskInterval(d time.Duration) (string, error) {
+	if d < time.Minute {
+		return "", fmt.Errorf("-delay %s is shorter than Task Scheduler's one minute minimum", d)
+	}
+	return fmt.Sprintf("PT%dM", int(d.Minutes())), nil
+}
+
+// encodeUTF16 converts s to little endian UTF-16 with a byte order mark,
+// the encoding schtasks /XML reliably accepts
+func encodeUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2+2*len(units))
+	out = append(out, 0xff, 0xfe)
+	for _, u := range units {
+		out = append(out, byte(u), byte(u>>8))
+	}
+	return out
+}
+
+// TaskOptions describes the Task Scheduler task InstallTask registers
+type TaskOptions struct {
+	Name       string
+	Args       []string
+	WorkingDir string
+	Delay      time.Duration
+	Schedule   string
+
+	// The task definition is kept in StateDir
+	StateDir string
+	DryRun   bool
+}
+
+// InstallTask registers o.Args as a Task Scheduler task named o.Name with
+// schtasks, the way a launchd plist is loaded on macOS
+func InstallTask(cmdRunner runner.Runner, o TaskOptions) error {
+	name, args := o.Name, o.Args
+	if o.Schedule != "" {
+		return fmt.Errorf("-schedule is not supported with Task Scheduler yet, use -delay")
+	}
+	interval, err := taskInterval(o.Delay)
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		quoted = append(quoted, windowsQuote(arg))
+	}
+	data := TaskData{
+		Description:   "Fetch shell history with tarsnap",
+		StartBoundary: time.Now().Format("2006-01-02T15:04:05"),
+		Interval:      interval,
+		Command:       args[0],
+		Arguments:     strings.Join(quoted, " "),
+		WorkingDir:    o.WorkingDir,
+	}
+
+	tmpl, err := template.New("task").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(TaskTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to create template: %w", err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	taskFile, err := filepath.Abs(filepath.Join(o.StateDir, name+".xml"))
+	if err != nil {
+		return err
+	}
+
+	if o.DryRun {
+		fmt.Printf("[dry-run] would write %s:\n%s", taskFile, buf.String())
+		runner.PrintDryRun("schtasks", "/Create", "/TN", name, "/XML", taskFile, "/F")
+		runner.PrintDryRun("schtasks", "/Query", "/TN", name)
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(taskFile), 0o755)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(taskFile, encodeUTF16(buf.String()), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write task file: %w", err)
+	}
+	slog.Info("Created Task Scheduler definition", "path", taskFile)
+
+	schtasks := func(args ...string) error {
+		slog.Debug("Executing command", "cmd", "schtasks "+strings.Join(args, " "))
+		out, err := runner.Combined(cmdRunner, "schtasks", args...)
+		if err != nil {
+			return fmt.Errorf("schtasks %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	err = schtasks("/Create", "/TN", name, "/XML", taskFile, "/F")
+	if err != nil {
+		return err
+	}
+	err = schtasks("/Query", "/TN", name)
+	if err != nil {
+		return err
+	}
+	slog.Info("Task registered", "name", name)
+	return nil
+}
@@ -0,0 +1,100 @@
+package schedule
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// decodeUTF16 reverses encodeUTF16
+func decodeUTF16(t *testing.T, data []byte) string {
+	t.Helper()
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xfe {
+		t.Fatalf("no UTF-16 byte order mark: % x", data[:min(len(data), 2)])
+	}
+	units := make([]uint16, 0, len(data)/2)
+	for i := 2; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])|uint16(data[i+1])<<8)
+	}
+	return string(utf16.Decode(units))
+}
+
+func TestInstallTask(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TaskOptions
+		fail     string
+		contains []string
+		wantErr  bool
+	}{
+		{
+			name:     "every hour",
+			opts:     TaskOptions{Delay: time.Hour},
+			contains: []string{"<Interval>PT60M</Interval>", `<Arguments>--data-dir &#34;C:\Users\me\my data&#34; --ip 10.0.0.1</Arguments>`, `<Command>C:\tarsnap.exe</Command>`},
+		},
+		{
+			name:    "shorter than a minute",
+			opts:    TaskOptions{Delay: 30 * time.Second},
+			wantErr: true,
+		},
+		{
+			name:    "calendar schedules aren't supported",
+			opts:    TaskOptions{Delay: time.Hour, Schedule: "daily"},
+			wantErr: true,
+		},
+		{
+			name:    "schtasks failing",
+			opts:    TaskOptions{Delay: time.Hour},
+			fail:    "/Create",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			taskFile := filepath.Join(dir, "tarsnap-web1.xml")
+			fake := &runner.Fake{Outputs: map[string]string{
+				"schtasks /Create /TN tarsnap-web1 /XML " + taskFile + " /F": "SUCCESS",
+				"schtasks /Query /TN tarsnap-web1":                           "tarsnap-web1  Ready",
+			}}
+			if tt.fail != "" {
+				fake.Errors = map[string]error{"schtasks /Create /TN tarsnap-web1 /XML " + taskFile + " /F": errors.New("exit status 1")}
+			}
+			tt.opts.Name = "tarsnap-web1"
+			tt.opts.StateDir = dir
+			tt.opts.Args = []string{`C:\tarsnap.exe`, "--data-dir", `C:\Users\me\my data`, "--ip", "10.0.0.1"}
+
+			err := InstallTask(fake, tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(taskFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			task := decodeUTF16(t, data)
+			for _, want := range tt.contains {
+				if !strings.Contains(task, want) {
+					t.Errorf("task lacks %q:\n%s", want, task)
+				}
+			}
+			if len(fake.Calls) != 2 {
+				t.Errorf("ran %d commands, want /Create and /Query", len(fake.Calls))
+			}
+		})
+	}
+}
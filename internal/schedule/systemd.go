@@ -0,0 +1,342 @@
+package schedule
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// UnitData holds the data filled into ServiceTemplate and TimerTemplate
+type UnitData struct {
+	Name       string
+	ExecStart  string
+	WorkingDir string
+
+	// Env holds the quoted KEY=VALUE assignments of Environment= lines
+	Env []string
+
+	// OnCalendar holds the calendar events; without any the timer repeats
+	// every Interval seconds instead
+	OnCalendar []string
+	Interval   int
+	Persistent bool
+}
+
+// ServiceTemplate is the oneshot systemd user service running the fetch
+const ServiceTemplate = `[Unit]
+Description=Fetch shell history with tarsnap
+
+[Service]
+Type=oneshot
+WorkingDirectory={{.WorkingDir}}
+{{- range .Env}}
+Environment={{.}}
+{{- end}}
+ExecStart={{.ExecStart}}
+`
+
+// TimerTemplate starts the service on a schedule, the Linux counterpart of
+// PlistTemplate. Persistent only applies to OnCalendar: runs missed while
+// the machine was off or asleep happen as soon as it's back.
+const TimerTemplate = `[Unit]
+Description=Run {{.Name}} periodically
+
+[Timer]
+{{- range .OnCalendar}}
+OnCalendar={{.}}
+{{- end}}
+{{- if not .OnCalendar}}
+OnBootSec={{.Interval}}s
+OnUnitActiveSec={{.Interval}}s
+{{- end}}
+Persistent={{.Persistent}}
+Unit={{.Name}}.service
+
+[Install]
+WantedBy=timers.target
+`
+
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// OnCalendar renders c as a systemd calendar event
+func (c CalendarInterval) OnCalendar() string {
+	field := func(v *int, format string) string {
+		if v == nil {
+			return "*"
+		}
+		return fmt.Sprintf(format, *v)
+	}
+	event := fmt.Sprintf("*-%s-%s %s:%s:00", field(c.Month, "%02d"), field(c.Day, "%02d"), field(c.Hour, "%02d"), field(c.Minute, "%02d"))
+	if c.Weekday != nil {
+		event = weekdayNames[*c.Weekday] + " " + event
+	}
+	return event
+}
+
+// systemdQuote quotes arg for an ExecStart line
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// systemdEnvQuote quotes an assignment for an Environment= line, which
+// expands specifiers but not variables
+func systemdEnvQuote(assignment string) string {
+	assignment = strings.ReplaceAll(assignment, "%", "%%")
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(assignment) + `"`
+}
+
+// UnitDir is where systemd looks for the user's units
+func UnitDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "systemd", "user"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "systemd", "user"), nil
+}
+
+// UnitOptions describes the systemd units InstallUnits writes
+type UnitOptions struct {
+	Name       string
+	Args       []string
+	WorkingDir string
+	Delay      time.Duration
+	Schedule   string
+	Env        []EnvVar
+
+	// OnCalendar is a systemd calendar expression used as is, instead of
+	// Schedule or Delay
+	OnCalendar string
+	Persistent bool
+
+	DryRun bool
+}
+
+// InstallUnits writes o.Args as a systemd user service named o.Name with a
+// timer starting it, and enables the timer, the way a launchd plist is
+// loaded on macOS
+func InstallUnits(cmdRunner runner.Runner, o UnitOptions) error {
+	quoted := make([]string, 0, len(o.Args))
+	for _, arg := range o.Args {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+	data := UnitData{
+		Name:       o.Name,
+		ExecStart:  strings.Join(quoted, " "),
+		WorkingDir: o.WorkingDir,
+		Persistent: o.Persistent,
+	}
+	for _, e := range o.Env {
+		data.Env = append(data.Env, systemdEnvQuote(e.Key+"="+e.Value))
+	}
+
+	switch {
+	case o.OnCalendar != "":
+		data.OnCalendar = []string{o.OnCalendar}
+	case o.Schedule != "":
+		intervals, err := Parse(o.Schedule)
+		if err != nil {
+			return err
+		}
+		for _, c := range intervals {
+			data.OnCalendar = append(data.OnCalendar, c.OnCalendar())
+		}
+	default:
+		if o.Delay < time.Second {
+			return fmt.Errorf("-delay %s is shorter than a second", o.Delay)
+		}
+		data.Interval = int(o.Delay.Seconds())
+	}
+
+	dir, err := UnitDir()
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		path string
+		tmpl string
+	}{
+		{filepath.Join(dir, o.Name+".service"), ServiceTemplate},
+		{filepath.Join(dir, o.Name+".timer"), TimerTemplate},
+	}
+	rendered := make([][]byte, len(files))
+	for i, f := range files {
+		tmpl, err := template.New(filepath.Base(f.path)).Parse(f.tmpl)
+		if err != nil {
+			return fmt.Errorf("failed to create template: %w", err)
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			return fmt.Errorf("failed to execute template: %w", err)
+		}
+		rendered[i] = buf.Bytes()
+	}
+
+	timer := o.Name + ".timer"
+	if o.DryRun {
+		for i, f := range files {
+			fmt.Printf("[dry-run] would write %s:\n%s", f.path, rendered[i])
+		}
+		runner.PrintDryRun("systemctl", "--user", "daemon-reload")
+		runner.PrintDryRun("systemctl", "--user", "enable", "--now", timer)
+		return nil
+	}
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		err = atomicfile.WriteFile(f.path, rendered[i], 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.path, err)
+		}
+		slog.Info("Created systemd unit", "path", f.path)
+	}
+
+	systemctl := func(args ...string) error {
+		args = append([]string{"--user"}, args...)
+		slog.Debug("Executing command", "cmd", "systemctl "+strings.Join(args, " "))
+		out, err := runner.Combined(cmdRunner, "systemctl", args...)
+		if err != nil {
+			return fmt.Errorf("systemctl %s: %w: %s", args[1], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	err = systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+	err = systemctl("enable", "--now", timer)
+	if err != nil {
+		return err
+	}
+	slog.Info("Timer enabled", "name", timer)
+	return nil
+}
+
+// splitExecStart splits an ExecStart line written by InstallUnits back into
+// its arguments
+func splitExecStart(line string) []string {
+	var args []string
+	var cur strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	unescape := strings.NewReplacer("%%", "%", "$$", "$")
+	for i := range args {
+		args[i] = unescape.Replace(args[i])
+	}
+	return args
+}
+
+// ReadUnit pulls the job out of a service written by InstallUnits
+func ReadUnit(path string) (Job, error) {
+	job := Job{Path: path, Label: strings.TrimSuffix(filepath.Base(path), ".service")}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return job, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ExecStart":
+			job.Args = splitExecStart(value)
+			if len(job.Args) > 0 {
+				job.Program = job.Args[0]
+			}
+		case "WorkingDirectory":
+			job.Cwd = value
+		}
+	}
+	return job, nil
+}
+
+// ListUnits returns the services in dir whose name starts with prefix
+func ListUnits(dir, prefix string) ([]Job, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, prefix+".*.service"))
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	for _, path := range paths {
+		job, err := ReadUnit(path)
+		if err != nil {
+			slog.Warn("Failed to read unit", "path", path, "err", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// StartUnit starts the service name without waiting for it to finish
+func StartUnit(cmdRunner runner.Runner, name string) error {
+	out, err := runner.Combined(cmdRunner, "systemctl", "--user", "start", "--no-block", name+".service")
+	if err != nil {
+		return fmt.Errorf("systemctl start: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// UnitState returns the ActiveState and Result of the service name
+func UnitState(cmdRunner runner.Runner, name string) (string, string, error) {
+	out, err := runner.Output(cmdRunner, "systemctl", "--user", "show", "--property=ActiveState,Result", name+".service")
+	if err != nil {
+		return "", "", fmt.Errorf("systemctl show: %w", err)
+	}
+	var state, result string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "ActiveState":
+			state = value
+		case "Result":
+			result = value
+		}
+	}
+	return state, result, nil
+}
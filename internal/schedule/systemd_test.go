@@ -0,0 +1,136 @@
+package schedule
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+func TestInstallUnits(t *testing.T) {
+	enable := map[string]string{
+		"systemctl --user daemon-reload":                   "",
+		"systemctl --user enable --now tarsnap-web1.timer": "",
+	}
+
+	tests := []struct {
+		name    string
+		opts    UnitOptions
+		outputs map[string]string
+		errors  map[string]error
+		timer   []string
+		service []string
+		wantErr bool
+	}{
+		{
+			name:    "interval",
+			opts:    UnitOptions{Delay: time.Hour},
+			outputs: enable,
+			timer:   []string{"OnBootSec=3600s", "OnUnitActiveSec=3600s", "Persistent=false"},
+		},
+		{
+			name:    "schedule",
+			opts:    UnitOptions{Schedule: "0 9 * * 1,5", Persistent: true},
+			outputs: enable,
+			timer:   []string{"OnCalendar=Mon *-*-* 09:00:00", "OnCalendar=Fri *-*-* 09:00:00", "Persistent=true"},
+		},
+		{
+			name:    "calendar expression used as is",
+			opts:    UnitOptions{OnCalendar: "Mon..Fri 09:00", Schedule: "hourly"},
+			outputs: enable,
+			timer:   []string{"OnCalendar=Mon..Fri 09:00\n"},
+		},
+		{
+			name:    "quoting",
+			opts:    UnitOptions{Delay: time.Hour, Args: []string{"/usr/bin/tarsnap", "--data-dir", "/home/me/my data", "--tag=100%"}, Env: []EnvVar{{Key: "PATH", Value: `/bin:"x"`}}},
+			outputs: enable,
+			service: []string{`ExecStart=/usr/bin/tarsnap --data-dir "/home/me/my data" --tag=100%%`, `Environment="PATH=/bin:\"x\""`},
+		},
+		{
+			name:    "delay too short",
+			opts:    UnitOptions{Delay: time.Millisecond},
+			wantErr: true,
+		},
+		{
+			name:    "bad schedule",
+			opts:    UnitOptions{Schedule: "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "systemctl failing",
+			opts:    UnitOptions{Delay: time.Hour},
+			outputs: map[string]string{"systemctl --user daemon-reload": ""},
+			errors:  map[string]error{"systemctl --user enable --now tarsnap-web1.timer": errors.New("exit status 1")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			fake := &runner.Fake{Outputs: tt.outputs, Errors: tt.errors}
+			tt.opts.Name = "tarsnap-web1"
+			tt.opts.WorkingDir = "/work"
+			if tt.opts.Args == nil {
+				tt.opts.Args = []string{"/usr/bin/tarsnap"}
+			}
+
+			err := InstallUnits(fake, tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir, _ := UnitDir()
+			for file, want := range map[string][]string{"tarsnap-web1.timer": tt.timer, "tarsnap-web1.service": tt.service} {
+				data, err := os.ReadFile(filepath.Join(dir, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, line := range want {
+					if !strings.Contains(string(data), line) {
+						t.Errorf("%s lacks %q:\n%s", file, line, data)
+					}
+				}
+			}
+			if len(fake.Calls) != 2 {
+				t.Errorf("ran %d commands, want daemon-reload and enable", len(fake.Calls))
+			}
+		})
+	}
+}
+
+func TestInstallUnitsDryRun(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fake := &runner.Fake{}
+	err := InstallUnits(fake, UnitOptions{Name: "tarsnap-web1", Args: []string{"/usr/bin/tarsnap"}, Delay: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := UnitDir()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) || len(fake.Calls) > 0 {
+		t.Errorf("dry run wrote units or ran systemctl: %v, %d calls", err, len(fake.Calls))
+	}
+}
+
+func TestSplitExecStart(t *testing.T) {
+	args := []string{"/usr/bin/tarsnap", "--data-dir", "/home/me/my data", `say "hi"`, `back\slash`, "100%", "$HOME", ""}
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+	got := splitExecStart(strings.Join(quoted, " "))
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("splitExecStart(%s) = %q, want %q", strings.Join(quoted, " "), got, args)
+	}
+}
@@ -0,0 +1,93 @@
+// Package secrets reads passwords, tokens and keys from the system's
+// secret store, so they don't have to be written into the config file or
+// the job definition. Settings that accept a secret take either the value
+// itself or a reference:
+//
+//	keychain:<service>[/<account>]        macOS Keychain, via security
+//	secret-service:<attr>=<value>[,...]   Secret Service on Linux, via secret-tool
+//	keyring:<service>[/<account>]         whichever of the two the OS has
+//	env:<NAME>                            an environment variable
+package secrets
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+var schemes = []string{"keychain:", "secret-service:", "keyring:", "env:"}
+
+// IsRef reports whether value refers to a secret instead of being one
+func IsRef(value string) bool {
+	for _, scheme := range schemes {
+		if strings.HasPrefix(value, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the secret value refers to, or value itself when it's
+// not a reference
+func Resolve(cmdRunner runner.Runner, value string) (string, error) {
+	scheme, rest, _ := strings.Cut(value, ":")
+	if !IsRef(value) {
+		return value, nil
+	}
+	if rest == "" {
+		return "", fmt.Errorf("secret reference %q names nothing", value)
+	}
+
+	if scheme == "keyring" {
+		scheme = "keychain"
+		if runtime.GOOS != "darwin" {
+			service, account, _ := strings.Cut(rest, "/")
+			scheme, rest = "secret-service", "service="+service
+			if account != "" {
+				rest += ",account=" + account
+			}
+		}
+	}
+
+	var name string
+	var args []string
+	switch scheme {
+	case "env":
+		secret, ok := os.LookupEnv(rest)
+		if !ok {
+			return "", fmt.Errorf("%s is not set", rest)
+		}
+		return secret, nil
+	case "keychain":
+		service, account, _ := strings.Cut(rest, "/")
+		name, args = "security", []string{"find-generic-password", "-w", "-s", service}
+		if account != "" {
+			args = append(args, "-a", account)
+		}
+	case "secret-service":
+		name, args = "secret-tool", []string{"lookup"}
+		for _, attr := range strings.Split(rest, ",") {
+			k, v, ok := strings.Cut(attr, "=")
+			if !ok {
+				return "", fmt.Errorf("secret-service attribute %q must look like key=value", attr)
+			}
+			args = append(args, k, v)
+		}
+	}
+
+	slog.Debug("Executing command", "cmd", name+" "+strings.Join(args, " "))
+
+	out, err := runner.Output(cmdRunner, name, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", value, err)
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret %s is empty", value)
+	}
+	return secret, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/ipsource"
+)
+
+// IPCache holds the hosts last read from terraform, tofu or pulumi
+// outputs, so scheduled runs don't read the outputs every time
+type IPCache struct {
+	// Key identifies the tool, configuration, workspace and output the
+	// hosts came from; a cache for another key is ignored
+	Key      string    `json:"key"`
+	Hosts    []string  `json:"hosts"`
+	Resolved time.Time `json:"resolved"`
+}
+
+func ipCachePath(stateDir string) string {
+	return filepath.Join(stateDir, "ip_cache.json")
+}
+
+// ipCacheKey returns the key of the output lookup config makes, or ""
+// when its hosts don't come from outputs
+func ipCacheKey(config Config) string {
+	tool := config.IPSource
+	if tool == "" && config.IP == "" && len(config.Hosts) == 0 {
+		tool = ipsource.DetectIaC(config.TFDir)
+	}
+	switch tool {
+	case "terraform", "tofu", "pulumi":
+	default:
+		return ""
+	}
+	dir, err := filepath.Abs(config.TFDir)
+	if err != nil {
+		dir = config.TFDir
+	}
+	return tool + "|" + dir + "|" + config.TFWorkspace + "|" + config.TFOutput
+}
+
+func loadIPCache(stateDir string) (*IPCache, error) {
+	data, err := os.ReadFile(ipCachePath(stateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cache IPCache
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+func saveIPCache(stateDir string, cache IPCache) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(stateDir, 0o700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(ipCachePath(stateDir), append(data, '\n'), 0o600)
+}
+
+// cachedIPs returns the hosts from outputs, read from the cache while it's
+// younger than config.IPCacheTTL unless config.RefreshIP is set. When
+// terraform fails, for instance in the middle of an apply, an expired cache
+// is used rather than failing the run.
+func cachedIPs(config Config, resolve func() ([]string, error), now time.Time) ([]string, error) {
+	key := ipCacheKey(config)
+	if key == "" || config.IPCacheTTL <= 0 {
+		return resolve()
+	}
+
+	cache, err := loadIPCache(config.StateDir)
+	if err != nil {
+		slog.Warn("Failed to read ip cache", "path", ipCachePath(config.StateDir), "err", err)
+	}
+	if cache != nil && cache.Key != key {
+		cache = nil
+	}
+	if cache != nil && !config.RefreshIP && now.Sub(cache.Resolved) < config.IPCacheTTL {
+		slog.Debug("Using cached hosts", "hosts", cache.Hosts, "resolved", cache.Resolved)
+		return cache.Hosts, nil
+	}
+
+	hosts, err := resolve()
+	if err != nil {
+		if cache != nil && len(cache.Hosts) > 0 {
+			slog.Warn("Failed to resolve hosts, using the expired cache", "err", err, "resolved", cache.Resolved)
+			return cache.Hosts, nil
+		}
+		return nil, err
+	}
+
+	if !config.DryRun {
+		err = saveIPCache(config.StateDir, IPCache{Key: key, Hosts: hosts, Resolved: now})
+		if err != nil {
+			slog.Warn("Failed to save ip cache", "err", err)
+		}
+	}
+	return hosts, nil
+}
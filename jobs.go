@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// runJobsCommand implements `tarsnap jobs`, listing the installed launchd
+// jobs and with -gc removing the ones that can no longer run
+func runJobsCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	gc := fs.Bool("gc", false, "Unload and remove jobs whose program or working directory is gone")
+	fs.Parse(args)
+
+	dir, err := schedule.LaunchAgentsDir()
+	if err != nil {
+		return err
+	}
+	jobs, err := schedule.ListJobs(dir, config.Label)
+	if err != nil {
+		return err
+	}
+
+	if *gc {
+		launchctl := schedule.NewLaunchctl(runner.Exec{}, config.LegacyLaunchctl)
+		var errs []error
+		for _, job := range jobs {
+			if job.Orphaned() != "" {
+				errs = append(errs, schedule.RemoveJob(launchctl, job, config.DryRun))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	if config.Output == "json" {
+		return writeJSON(os.Stdout, jobs)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tSTATUS\tWORKING DIRECTORY")
+	for _, job := range jobs {
+		status := job.Orphaned()
+		if status == "" {
+			status = "ok"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", job.Label, status, job.Cwd)
+	}
+	return tw.Flush()
+}
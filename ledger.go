@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// LedgerEntry records one command as run by one user on one host. Unlike
+// summary.txt it keeps who ran the command, where, and when it was seen.
+type LedgerEntry struct {
+	Cmd       string    `json:"cmd"`
+	Host      string    `json:"host"`
+	User      string    `json:"user"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Count is the most times the command appears in a single snapshot.
+	// Snapshots hold the whole history file, so adding them up would count
+	// every run again on each fetch.
+	Count int `json:"count"`
+}
+
+type ledgerKey struct {
+	cmd, host, user string
+}
+
+// Ledger is the set of entries kept in ledger.jsonl, one JSON object per
+// line. It holds every command read, whatever the filter, and the
+// summary.txt files are built from it.
+type Ledger struct {
+	path    string
+	entries map[ledgerKey]*LedgerEntry
+	// order is the keys in the order they were added, which breaks ties
+	// between entries first seen at the same time
+	order []ledgerKey
+}
+
+func ledgerPath(dataDir string) string {
+	return filepath.Join(dataDir, "ledger.jsonl")
+}
+
+// loadLedger reads the ledger at path. A missing ledger is empty.
+func loadLedger(path string) (*Ledger, error) {
+	l := &Ledger{path: path, entries: make(map[ledgerKey]*LedgerEntry)}
+
+	f, err := history.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e LedgerEntry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s line %d: %w", path, n, err)
+		}
+		l.merge(e)
+	}
+	return l, scanner.Err()
+}
+
+// merge folds e into the entry for the same command, host and user
+func (l *Ledger) merge(e LedgerEntry) {
+	key := ledgerKey{e.Cmd, e.Host, e.User}
+	cur, ok := l.entries[key]
+	if !ok {
+		l.entries[key] = &e
+		l.order = append(l.order, key)
+		return
+	}
+	if !e.FirstSeen.IsZero() && (cur.FirstSeen.IsZero() || e.FirstSeen.Before(cur.FirstSeen)) {
+		cur.FirstSeen = e.FirstSeen
+	}
+	if e.LastSeen.After(cur.LastSeen) {
+		cur.LastSeen = e.LastSeen
+	}
+	if e.Count > cur.Count {
+		cur.Count = e.Count
+	}
+}
+
+// addSnapshot records the commands in the lines of a snapshot taken at
+// taken and returns how many times each appears in it. Commands with a
+// shell timestamp use it. The rest are dated by the snapshot only when they
+// are new in it: when prev, the counts of the snapshot before it from the
+// same history, holds fewer of them, since every snapshot repeats the whole
+// history. A nil prev makes every command new. Adding the same snapshot
+// twice changes nothing. It returns the entries it added.
+func (l *Ledger) addSnapshot(host, user string, taken time.Time, lines []string, prev map[string]int) (map[string]int, []LedgerEntry) {
+	type seen struct {
+		first, last time.Time
+		count       int
+		timed       bool
+	}
+	cmds := make(map[string]*seen)
+	var order []string
+	for _, line := range lines {
+		if history.IsGarbage(line) {
+			continue
+		}
+		entry := history.ParseLine(line)
+		s, ok := cmds[entry.Command]
+		if !ok {
+			s = &seen{}
+			cmds[entry.Command] = s
+			order = append(order, entry.Command)
+		}
+		s.count++
+		when := entry.Timestamp
+		if when.IsZero() {
+			continue
+		}
+		if !s.timed || when.Before(s.first) {
+			s.first = when
+		}
+		if !s.timed || when.After(s.last) {
+			s.last = when
+		}
+		s.timed = true
+	}
+
+	counts := make(map[string]int, len(cmds))
+	var added []LedgerEntry
+	for _, cmd := range order {
+		s := cmds[cmd]
+		counts[cmd] = s.count
+		key := ledgerKey{cmd, host, user}
+		_, known := l.entries[key]
+		if !s.timed && (!known || prev == nil || s.count > prev[cmd]) {
+			s.first, s.last = taken, taken
+		}
+		l.merge(LedgerEntry{Cmd: cmd, Host: host, User: user, FirstSeen: s.first, LastSeen: s.last, Count: s.count})
+		if !known {
+			added = append(added, *l.entries[key])
+		}
+	}
+	return counts, added
+}
+
+// Kept returns the entries whose command filter keeps, oldest first
+func (l *Ledger) Kept(filter history.Filter) []LedgerEntry {
+	var kept []LedgerEntry
+	for _, e := range l.Entries() {
+		if filter.Keep(e.Cmd) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// Entries returns the entries oldest first
+func (l *Ledger) Entries() []LedgerEntry {
+	entries := make([]LedgerEntry, 0, len(l.order))
+	for _, key := range l.order {
+		entries = append(entries, *l.entries[key])
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].FirstSeen.Before(entries[j].FirstSeen)
+	})
+	return entries
+}
+
+// Save rewrites the ledger in one step so a crash leaves the old one
+// intact, encrypted when -encrypt-key is set
+func (l *Ledger) Save() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for _, e := range l.Entries() {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(l.path), 0o700)
+	if err != nil {
+		return err
+	}
+	return history.WriteFile(l.path, buf.Bytes(), 0o600)
+}
+
+// snapshotUser returns the remote user whose history the snapshot at p
+// holds, the first directory below dataDir
+func snapshotUser(dataDir, p string) string {
+	rel, err := filepath.Rel(dataDir, p)
+	if err != nil {
+		return "unknown"
+	}
+	user, _, ok := strings.Cut(filepath.ToSlash(rel), "/")
+	if !ok {
+		return "unknown"
+	}
+	return user
+}
+
+// commandCounts returns how many times each command appears in lines
+func commandCounts(lines []string) map[string]int {
+	counts := make(map[string]int)
+	for _, line := range lines {
+		if !history.IsGarbage(line) {
+			counts[history.NormalizeLine(line)]++
+		}
+	}
+	return counts
+}
+
+// updateLedger adds the snapshots in dataDir that the ledger hasn't seen
+// yet, read through cache, which may be nil. Each history's snapshots are
+// added oldest first, after the one before them, so only what changed
+// between them is dated. It returns the ledger, the entries it gained and,
+// per host, the commands the new snapshots hold more often than the ones
+// before them: what was run since, whatever the filter.
+func updateLedger(config Config, dataDir string, cache history.LineCache) (*Ledger, []LedgerEntry, map[string][]string, error) {
+	idx, err := history.LoadDedupIndex(history.IndexPath(config.StateDir, "ledger"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load dedup index: %w", err)
+	}
+	ledger, err := loadLedger(ledgerPath(dataDir))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	type snapshot struct {
+		path  string
+		taken time.Time
+	}
+	streams := make(map[string][]snapshot)
+	var keys []string
+	err = filepath.Walk(dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !history.IsSnapshotFile(p) {
+			return nil
+		}
+		taken, ok := history.SnapshotTime(p)
+		if !ok {
+			taken = info.ModTime()
+		}
+		key := filepath.Dir(p) + "\x00" + snapshotHost(p)
+		if _, ok := streams[key]; !ok {
+			keys = append(keys, key)
+		}
+		streams[key] = append(streams[key], snapshot{p, taken})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to walk through files: %w", err)
+	}
+
+	var added []LedgerEntry
+	ran := make(map[string][]string)
+	snapshots := 0
+	for _, key := range keys {
+		stream := streams[key]
+		sort.SliceStable(stream, func(i, j int) bool { return stream[i].taken.Before(stream[j].taken) })
+
+		var prev map[string]int
+		prevPath := ""
+		for _, s := range stream {
+			if idx.Seen(s.path) {
+				prevPath, prev = s.path, nil
+				continue
+			}
+			if prev == nil && prevPath != "" {
+				lines, err := cache.Read(prevPath)
+				if err != nil {
+					slog.Warn("Failed to read previous snapshot, dating every command", "path", prevPath, "err", err)
+				} else {
+					prev = commandCounts(lines)
+				}
+			}
+
+			lines, err := cache.Read(s.path)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			host := snapshotHost(s.path)
+			counts, gained := ledger.addSnapshot(host, snapshotUser(dataDir, s.path), s.taken, lines, prev)
+			added = append(added, gained...)
+			for cmd, n := range counts {
+				if n > prev[cmd] {
+					ran[host] = append(ran[host], cmd)
+				}
+			}
+			prev, prevPath = counts, s.path
+			idx.MarkSeen(s.path)
+			snapshots++
+		}
+	}
+	if snapshots == 0 {
+		return ledger, nil, nil, nil
+	}
+
+	err = ledger.Save()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to write ledger: %w", err)
+	}
+	// The index is saved only once the snapshots it covers are in the ledger
+	err = idx.Save()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to save dedup index: %w", err)
+	}
+
+	sort.SliceStable(added, func(i, j int) bool { return added[i].FirstSeen.Before(added[j].FirstSeen) })
+	for _, cmds := range ran {
+		sort.Strings(cmds)
+	}
+	slog.Info("Updated ledger", "path", ledger.path, "snapshots", snapshots, "entries", len(ledger.entries))
+	return ledger, added, ran, nil
+}
+
+// runLedgerCommand implements `tarsnap ledger`, printing the ledger
+// entries, oldest first. -summary prints each command once instead, the
+// view summary.txt keeps.
+func runLedgerCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("ledger", flag.ExitOnError)
+	host := fs.String("host", config.Host, "Only show commands run on this host")
+	user := fs.String("user", "", "Only show commands run by this user")
+	summary := fs.Bool("summary", false, "Print every command once, in the order first seen")
+	fs.Parse(args)
+
+	filter, err := newCommandFilter(config)
+	if err != nil {
+		return err
+	}
+	ledger, err := loadLedger(ledgerPath(config.DataDir))
+	if err != nil {
+		return err
+	}
+
+	var entries []LedgerEntry
+	for _, e := range ledger.Kept(filter) {
+		if (*host == "" || e.Host == *host) && (*user == "" || e.User == *user) {
+			entries = append(entries, e)
+		}
+	}
+
+	if *summary {
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			if !seen[e.Cmd] {
+				seen[e.Cmd] = true
+				fmt.Println(e.Cmd)
+			}
+		}
+		return nil
+	}
+
+	if config.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, e := range entries {
+			err := enc.Encode(e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\t%d\t%s\t%s\t%s\n", e.FirstSeen.Local().Format(time.RFC3339), e.LastSeen.Local().Format(time.RFC3339), e.Count, e.Host, e.User, e.Cmd)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errLocked is returned by tryLock when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+func runLockPath(stateDir string) string {
+	return filepath.Join(stateDir, "tarsnap.lock")
+}
+
+// acquireRunLock takes the exclusive lock guarding the data and state
+// directories, retrying for up to wait while another run holds it. The
+// returned func releases it.
+func acquireRunLock(stateDir string, wait time.Duration) (func(), error) {
+	err := os.MkdirAll(stateDir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	path := runLockPath(stateDir)
+	deadline := time.Now().Add(wait)
+	for {
+		unlock, err := tryLock(path)
+		if err == nil {
+			return unlock, nil
+		}
+		if !errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseLogLevel maps debug, info, warn or error to a slog level
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// newLogger builds a text or JSON slog logger writing to w
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+}
+
+// setupLogging makes the configured logger the default, so slog calls and
+// the standard log package both go through it. With config.LogFile set the
+// log goes to that file, rotated by size, instead of stderr.
+func setupLogging(config Config) error {
+	var w io.Writer = os.Stderr
+	if config.LogFile != "" {
+		f, err := openRotatingFile(config.LogFile, int64(config.LogMaxSize), config.LogKeep, config.LogMaxAge)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = f
+	}
+
+	logger, err := newLogger(w, config.LogLevel, config.LogFormat)
+	if err != nil {
+		return err
+	}
+	// A log file is usually written by the scheduled job, so each line says
+	// which binary the job was running
+	if config.LogFile != "" {
+		logger = logger.With("version", buildInfo().Version)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1 (and
+// the older ones shifted up to path.<keep>) once it grows past maxSize.
+// Rotated files last modified more than maxAge ago are removed.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep, maxAge: maxAge}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.removeExpired()
+	return r, nil
+}
+
+// removeExpired deletes rotated files older than maxAge. The live file is
+// never removed.
+func (r *rotatingFile) removeExpired() {
+	if r.maxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-r.maxAge)
+	for i := 1; i <= r.keep; i++ {
+		name := fmt.Sprintf("%s.%d", r.path, i)
+		info, err := os.Stat(name)
+		if err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(name)
+		}
+	}
+}
+
+func (r *rotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(r.path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.keep > 0 {
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = r.open()
+	if err != nil {
+		return err
+	}
+	r.removeExpired()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
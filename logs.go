@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logsPath returns the log of the installed job labeled label: -log-file
+// when given, otherwise the one the plist or unit names
+func logsPath(config Config, label string) (string, error) {
+	if config.LogFile != "" {
+		return config.LogFile, nil
+	}
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		return "", fmt.Errorf("can't find the job's log on %s, pass -log-file", runtime.GOOS)
+	}
+	job, err := installedJob(config, label)
+	if err != nil {
+		return "", err
+	}
+	path := jobLogPath(job)
+	if path == "" {
+		return "", fmt.Errorf("%s doesn't log to a file", job.Label)
+	}
+	return path, nil
+}
+
+// rotatedLogs returns the files rotated away from path, oldest first
+func rotatedLogs(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	rotated := make(map[string]int)
+	var files []string
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(m, path+"."))
+		if err == nil {
+			rotated[m] = n
+			files = append(files, m)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return rotated[files[i]] > rotated[files[j]] })
+	return files
+}
+
+// lastLines returns the last n lines of data, or all of it when n is 0
+func lastLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return data
+	}
+	end := bytes.TrimRight(data, "\n")
+	for i := 0; i < n; i++ {
+		nl := bytes.LastIndexByte(end, '\n')
+		if nl < 0 {
+			return data
+		}
+		end = end[:nl]
+	}
+	return data[len(end)+1:]
+}
+
+// logTextRe picks the time and level out of a line of the text log format
+var logTextRe = regexp.MustCompile(`^time=(\S+) level=(\S+)`)
+
+// parseLogLine returns the time and level of a line written by the text or
+// JSON handler; ok is false for anything else, such as a panic that went
+// straight to launchd's stderr capture
+func parseLogLine(line []byte) (t time.Time, level slog.Level, ok bool) {
+	var timeStr, levelStr string
+	if bytes.HasPrefix(line, []byte("{")) {
+		var rec struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+		}
+		if json.Unmarshal(line, &rec) != nil {
+			return t, level, false
+		}
+		timeStr, levelStr = rec.Time, rec.Level
+	} else if m := logTextRe.FindSubmatch(line); m != nil {
+		timeStr, levelStr = string(m[1]), string(m[2])
+	} else {
+		return t, level, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timeStr)
+	if err != nil {
+		return t, level, false
+	}
+	err = level.UnmarshalText([]byte(levelStr))
+	return t, level, err == nil
+}
+
+// logFilter passes on the log lines at or above minLevel written at or
+// after since. Lines it can't parse go with the line before them.
+type logFilter struct {
+	w        io.Writer
+	since    time.Time
+	minLevel slog.Level
+	keep     bool
+	partial  []byte
+}
+
+func newLogFilter(w io.Writer, since time.Time, minLevel slog.Level) *logFilter {
+	return &logFilter{w: w, since: since, minLevel: minLevel, keep: true}
+}
+
+func (f *logFilter) Write(p []byte) (int, error) {
+	data := append(f.partial, p...)
+	for {
+		nl := bytes.IndexByte(data, '\n')
+		if nl < 0 {
+			break
+		}
+		line := data[:nl+1]
+		data = data[nl+1:]
+		if t, level, ok := parseLogLine(line); ok {
+			f.keep = level >= f.minLevel && (f.since.IsZero() || !t.Before(f.since))
+		}
+		if f.keep {
+			_, err := f.w.Write(line)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	f.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// parseSince accepts a duration back from now, such as 2h, or a time
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return parseTimeArg(value)
+}
+
+// runLogsCommand implements `tarsnap logs [label]`, printing the end of
+// the installed job's log and, with -f, following it
+func runLogsCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "Keep printing lines as the job writes them")
+	lines := fs.Int("n", 50, "Number of lines to print from the end of the log; 0 prints all of it")
+	sinceArg := fs.String("since", "", "Only print lines logged after this time, or this long ago such as 2h; reads the rotated logs too")
+	levelArg := fs.String("level", "debug", "Only print lines at or above this level: debug, info, warn or error")
+	fs.Parse(args)
+
+	var since time.Time
+	var err error
+	if *sinceArg != "" {
+		since, err = parseSince(*sinceArg, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	minLevel, err := parseLogLevel(*levelArg)
+	if err != nil {
+		return err
+	}
+
+	path, err := logsPath(config, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	files := []string{path}
+	if !since.IsZero() {
+		files = append(rotatedLogs(path), path)
+	}
+	var matched bytes.Buffer
+	filter := newLogFilter(&matched, since, minLevel)
+	var offset int64
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) && file == path && *follow {
+			fmt.Fprintf(os.Stderr, "Waiting for %s\n", path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		filter.Write(data)
+		if file == path {
+			offset = int64(len(data))
+		}
+	}
+	_, err = os.Stdout.Write(lastLines(matched.Bytes(), *lines))
+	if err != nil {
+		return err
+	}
+
+	filter.w = os.Stdout
+	for *follow {
+		time.Sleep(500 * time.Millisecond)
+		offset = copyLogFrom(filter, path, offset)
+	}
+	return nil
+}
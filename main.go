@@ -1,558 +1,334 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
-	"inet.af/netaddr"
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/ipsource"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
 )
 
-// TerraformOutput is used to unmarshal the JSON output of the terraform command
-type TerraformOutput struct {
-	InstancePublicIP struct {
-		Value string `json:"value"`
-	} `json:"instance_public_ip"`
-}
-
-// PlistData holds the data to be filled in the plist template
-type PlistData struct {
-	Label         string
-	IP            string
-	Args          string
-	Path          string
-	Cwd           string
-	LogPath       string
-	StartInterval string
-}
-
-// PlistTemplate is the boilerplate for the .plist file
-const PlistTemplate = `
-<?xml version="1.0" encoding="UTF-8"?>
-<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
-<plist version="1.0">
-<dict>
-  <key>Label</key>
-  <string>{{.Label}}</string>
-
-  <key>ProgramArguments</key>
-  <array>
-    <string>{{.Args}}</string>
-  </array>
-
-  <key>EnvironmentVariables</key>
-<dict>
-  <key>PATH</key>
-  <string>/usr/local/bin:{{.Path}}:/usr/bin:/bin:/usr/sbin:/sbin:</string>
-</dict>
-
-  <key>StartInterval</key>
-  <integer>{{.StartInterval}}</integer>
-
-  <key>StandardOutPath</key>
-  <string>{{.LogPath}}</string>
-
-  <key>StandardErrorPath</key>
-  <string>{{.LogPath}}</string>
-
-  <key>WorkingDirectory</key>
-  <string>{{.Cwd}}</string>
-
-  <key>RunAtLoad</key>
-  <false/>
-</dict>
-</plist>
-`
-
-// Generate data/bash_history/summary.txt that contains the unique list of bash lines
-func generateSummaryFile(logDir string) {
-	uniqueLines := getUniqueBashLines(logDir)
-
-	summaryFile, err := os.Create(filepath.Join(logDir, "summary.txt"))
-	if err != nil {
-		log.Fatalf("Failed to create summary.txt: %v", err)
-	}
-	defer summaryFile.Close()
-
-	MAX_LEN := 10
-	for _, line := range uniqueLines {
-		if len(line) < MAX_LEN {
-			continue
-		}
-		_, err := fmt.Fprintln(summaryFile, line)
-		if err != nil {
-			log.Fatalf("Failed to write to summary.txt: %v", err)
-		}
-	}
-
-	log.Println("Successfully generated summary.txt.")
-}
-
-func readLines(filename string) (int, []string, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return 0, nil, err
-	}
-	defer file.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-
-	if err := scanner.Err(); err != nil {
-		return 0, nil, err
-	}
-
-	return len(lines), lines, nil
-}
-
-func getUniqueLineCount(lines []string) int {
-	uniqueLines := make(map[string]struct{})
-	for _, line := range lines {
-		uniqueLines[line] = struct{}{}
-	}
-	return len(uniqueLines)
-}
-
-func getUniqueBashLines(logDir string) []string {
-	uniqueLines := make(map[string]struct{})
-
-	filepath.Walk(logDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatalf("Failed to walk through files: %v", err)
-		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
-		// Open the file
-		file, err := os.Open(path)
+func main() {
+	// ssh runs tarsnap again as its askpass program to read a password
+	if os.Getenv(fetch.AskpassEnv) != "" {
+		err := fetch.RunAskpass(strings.Join(os.Args[1:], " "))
 		if err != nil {
-			log.Fatalf("Failed to open file: %v", err)
+			log.Fatalf("Failed to get password: %v", err)
 		}
-		defer file.Close()
-
-		// Scan the lines and add unique lines to the map
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			uniqueLines[line] = struct{}{}
-		}
-
-		if err := scanner.Err(); err != nil {
-			log.Fatalf("Failed to scan file: %v", err)
-		}
-
-		return nil
-	})
-
-	var lines []string
-	for line := range uniqueLines {
-		lines = append(lines, line)
+		return
 	}
 
-	return lines
-}
-
-type Config struct {
-	IP       string
-	Label    string
-	CWD      string
-	ShowFull bool
-	Install  bool
-	Delay    time.Duration
-}
-
-func main() {
-	config := Config{}
+	var config Config
+	dirs := defaultDataDirs()
+	configPath := flag.String("config", defaultConfigPath(), "Path to a YAML config file; flags override its values")
+	flag.StringVar(&config.DataDir, "data-dir", dirs.Data, "Directory holding the fetched snapshots and summary.txt")
+	flag.BoolVar(&config.FixPerms, "fix-perms", false, "Take group and world access away from stored history instead of only warning about it")
+	flag.StringVar(&config.StateDir, "state-dir", dirs.State, "Directory holding run records, indexes and the run lock")
 	flag.StringVar(&config.Label, "label", "com.tarsnap", "The label for the .plist file")
 	flag.StringVar(&config.CWD, "cwd", ".", "Working directory for the launchd task")
 	flag.BoolVar(&config.ShowFull, "show-full", false, "Show the unique list of lines to stdout")
+	flag.BoolVar(&config.Chronological, "chronological", false, "With -show-full, sort commands by when they were first run and prefix each with its ISO 8601 time")
 	flag.BoolVar(&config.Install, "install", false, "Install launchd plist and exit")
+	flag.Var(&config.JobEnv, "job-env", "KEY=VALUE exported to the installed job, e.g. AWS_PROFILE=prod; repeat for several")
+	flag.StringVar(&config.JobArgs, "job-args", "", `Arguments for the installed job, quoted as in a shell, e.g. "--config /etc/tarsnap.yaml --users root,admin"; defaults to the flags given to -install`)
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Print the plist, launchctl, ssh and scp commands instead of running them; host addresses are still resolved")
+	flag.BoolVar(&config.ForceFlags, "force-flags", false, "On -install, let flags win over conflicting config file values without asking")
+	flag.BoolVar(&config.ForceConfig, "force-config", false, "On -install, let config file values win over conflicting flags without asking")
 	flag.DurationVar(&config.Delay, "delay", 10*time.Minute, "Delay between successive fetches")
+	flag.StringVar(&config.Schedule, "schedule", "", `Calendar schedule instead of -delay, e.g. "daily at 09:00", "hourly at :15" or "15 9 * * 1-5"`)
+	flag.StringVar(&config.OnCalendar, "on-calendar", "", `systemd OnCalendar expression for the timer on Linux, instead of -schedule or -delay, e.g. "Mon..Fri 09:00"`)
+	flag.BoolVar(&config.Persistent, "persistent", true, "On Linux, catch up on scheduled runs missed while the machine was off or asleep")
+	flag.BoolVar(&config.Scheduled, "scheduled", false, "Set by the installed job, so the run is checked against the schedule for runs missed while asleep")
+	flag.BoolVar(&config.RunAtLoad, "run-at-load", false, "On macOS, also run the job as soon as it's loaded")
+	flag.StringVar(&config.KeepAlive, "keep-alive", "", "On macOS, when launchd restarts the job: never, always, or crashed and/or failed, comma separated")
+	flag.IntVar(&config.ThrottleInterval, "throttle-interval", 0, "On macOS, minimum seconds between launches of the job; 0 keeps launchd's default")
+	flag.IntVar(&config.Nice, "nice", 0, "On macOS, scheduling priority of the job, -20 to 20")
+	flag.BoolVar(&config.LowPriorityIO, "low-priority-io", false, "On macOS, throttle the job's disk I/O")
+	flag.BoolVar(&config.LegacyLaunchctl, "legacy-launchctl", false, "On macOS, use launchctl load and unload instead of bootstrap and bootout")
+	flag.BoolVar(&config.Analytics, "analytics", false, "Export sampled, noise-perturbed command usage counts to stdout and exit; (epsilon, delta)-differentially private per command run")
+	flag.Float64Var(&config.Epsilon, "epsilon", 1.0, "Privacy budget for -analytics; smaller values add more noise")
+	flag.Float64Var(&config.Delta, "delta", 1e-6, "Chance -analytics may reveal a rarely used command; sets how often a command must be run before it's listed")
+	flag.Float64Var(&config.SampleRate, "sample-rate", 1.0, "Fraction of command runs sampled for -analytics")
+	config.Users = stringList{"root"}
+	flag.Var(&config.Users, "users", "Comma separated list of remote users whose history is fetched; by default root, or the User an ~/.ssh/config alias sets")
+	flag.Var(&config.Hosts, "hosts", "Comma separated list of hosts, or ~/.ssh/config aliases, to fetch from instead of the terraform output")
+	flag.Var(&config.Quota, "quota", "Maximum size of the data directory, e.g. 500MB; 0 disables the quota")
+	flag.StringVar(&config.EvictionPolicy, "eviction-policy", "oldest", "How snapshots are evicted when over -quota: oldest or none")
+	flag.BoolVar(&config.Results, "results", false, "Also fetch the ~/.tarsnap_results exit status log installed by onboard --results")
+	flag.IntVar(&config.PruneKeepDays, "prune-keep-days", 0, "After each fetch remove summarized snapshots older than this many days; 0 disables")
+	flag.IntVar(&config.PruneKeepLast, "prune-keep-last", 0, "After each fetch keep only this many summarized snapshots per host and user; 0 disables")
+	flag.IntVar(&config.ManifestKeep, "manifest-keep", 30, "Number of summary checksum manifests to keep")
+	flag.BoolVar(&config.GitCommit, "git-commit", false, "Keep the data directory in a git repository, committing what each run changed")
+	flag.StringVar(&config.GitPush, "git-push", "", "Push each -git-commit commit to this git remote, such as origin")
+	flag.StringVar(&config.Archive, "archive", "", "After each run archive the data directory with tar (into -archive-dir) or the tarsnap client")
+	flag.StringVar(&config.ArchiveDir, "archive-dir", dirs.Archives, "Where -archive=tar writes its .tar.gz files")
+	flag.IntVar(&config.ArchiveKeep, "archive-keep", 7, "Number of archives to keep; 0 keeps all")
+	flag.BoolVar(&config.Metadata, "metadata", false, "Record uname, shell version and uptime of each host in the run record")
+	flag.StringVar(&config.HealthcheckURL, "healthcheck-url", "", "healthchecks.io style URL pinged at /start, on success and at /fail after each fetch")
+	flag.StringVar(&config.WebhookURL, "webhook-url", "", "Webhook notified when a fetch fails or a watched command is collected")
+	flag.StringVar(&config.WebhookFormat, "webhook-format", "json", "Webhook payload: json or slack")
+	flag.Var(&config.Watch, "watch", "Notify the webhook when a command run since the last fetch matches this regexp, whatever -min-length and the summary filter, e.g. 'rm -rf|curl .*\\| *sh'; repeat for several")
+	flag.StringVar(&config.Store, "store", "", "Mirror fetched snapshots and summaries to s3://bucket/prefix, sftp://user@host/dir or a directory")
+	flag.StringVar(&config.KnownHosts, "known-hosts", "", "known_hosts file used to verify host keys; defaults to ssh's own")
+	flag.BoolVar(&config.TrustOnFirstUse, "trust-on-first-use", false, "Record the host key of hosts not yet in known_hosts instead of refusing them")
+	flag.Var(&config.Artifacts, "artifact", "Also collect a remote file, as name=path; repeat for several, e.g. zsh=~/.zsh_history")
+	flag.StringVar(&config.Collect, "collect", "scp", "How history is copied: scp, ssh to print it over a plain ssh session where scp and SFTP are disabled, rsync to transfer only what was appended, or auditd or journald to read the commands from execve audit records instead")
+	flag.IntVar(&config.BWLimit, "bwlimit", 0, "Limit each copy from a host to this many KiB/s, like rsync's --bwlimit; 0 is unlimited")
+	flag.BoolVar(&config.SSHMultiplex, "ssh-multiplex", true, "Reuse one ssh connection per user and host for every copy and command of a run, instead of connecting for each")
+	flag.StringVar(&config.Collect, "transfer", "scp", "Same as -collect")
+	flag.StringVar(&config.Shell, "shell", "auto", "Whose history is fetched from unix hosts: bash, zsh, fish, or auto to detect each user's shell once and remember it")
+	flag.StringVar(&config.AuditUser, "audit-user", "", "With -collect auditd or journald, connect as this privileged user to read the audit records instead of as each audited user")
+	flag.BoolVar(&config.AuditSudo, "audit-sudo", true, "With -collect auditd or journald, read the audit records through sudo -n, since they're only readable by root")
+	flag.StringVar(&config.IdentityAgent, "identity-agent", "", "ssh-agent socket to authenticate with instead of SSH_AUTH_SOCK, e.g. for 1Password or Secretive; none uses identity files only")
+	flag.BoolVar(&config.PasswordAuth, "password-auth", false, "Allow password and keyboard-interactive authentication for hosts that don't accept keys")
+	flag.StringVar(&config.PasswordCommand, "password-command", "", "With -password-auth, a command printing the password, e.g. from a secret store, instead of ssh prompting for it")
+	flag.StringVar(&config.JumpHost, "jump-host", "", "Bastion to connect through, as user@host[:port]; comma separate to chain")
+	flag.IntVar(&config.AlertAfter, "alert-after", 3, "Notify the webhook once a host has failed this many fetches in a row, 0 to never")
+	flag.DurationVar(&config.LockWait, "wait", 0, "How long to wait for a run already in progress to finish")
+	flag.BoolVar(&config.SkipIfRunning, "skip-if-running", true, "Skip this run, instead of failing, when another is still in progress after -wait")
+	flag.BoolVar(&config.FlushHistory, "flush-history", false, "Before copying, signal the remote shells set up by onboard to write their in-memory history")
+	flag.BoolVar(&config.SkipUnchanged, "skip-unchanged", false, "Checksum remote history over ssh first and skip the copy when it matches the last fetch")
+	flag.IntVar(&config.Concurrency, "concurrency", 4, "Maximum number of hosts fetched in parallel")
+	flag.StringVar(&config.IP, "ip", "", "Address or hostname of the host to fetch from")
+	flag.StringVar(&config.RemoteOS, "remote-os", "unix", "OS of the remote hosts: unix (bash, zsh or fish history, see -shell) or windows (PowerShell PSReadLine history)")
+	flag.StringVar(&config.IPSource, "ip-source", "", "Where host addresses come from: static, env (TARSNAP_IP), file, terraform, tofu, pulumi, ec2, gce, azure or tailscale")
+	flag.StringVar(&config.HostsFile, "hosts-file", "hosts.txt", "File listing one host per line for -ip-source=file")
+	flag.StringVar(&config.EC2Tag, "ec2-tag", "", "Tag filter such as Role=devbox selecting instances for -ip-source=ec2")
+	flag.StringVar(&config.GCELabel, "gce-label", "", "Label filter such as role=devbox selecting instances for -ip-source=gce")
+	flag.StringVar(&config.GCEZone, "gce-zone", "", "Zone to list instances in for -ip-source=gce; defaults to every zone")
+	flag.StringVar(&config.GCPProject, "gcp-project", "", "Project for -ip-source=gce; defaults to the gcloud configuration")
+	flag.StringVar(&config.AzureTag, "azure-tag", "", "Tag filter such as Role=devbox selecting VMs for -ip-source=azure")
+	flag.StringVar(&config.AzureGroup, "azure-resource-group", "", "Resource group to list VMs in for -ip-source=azure; defaults to the whole subscription")
+	flag.BoolVar(&config.PreferIPv6, "prefer-ipv6", false, "Connect to hostnames, and tailnet devices, over IPv6 when they have an IPv6 address")
+	flag.StringVar(&config.TailscaleDevice, "tailscale-device", "", "Hostname, or tag:<name> for every tagged device, selecting tailnet peers for -ip-source=tailscale")
+	flag.StringVar(&config.AWSRegion, "aws-region", "", "AWS region for -ip-source=ec2; defaults to the aws CLI configuration")
+	flag.StringVar(&config.TFDir, "tf-dir", "terraform", "Terraform, OpenTofu or Pulumi project whose outputs list the hosts")
+	flag.StringVar(&config.TFWorkspace, "tf-workspace", "", "Terraform workspace, or Pulumi stack, to read outputs from; defaults to the selected one")
+	flag.StringVar(&config.TFOutput, "tf-output-name", ipsource.DefaultTerraformOutput, "Output holding the hosts, with a dotted path into maps and lists such as web.instances.public_ip")
+	flag.DurationVar(&config.IPCacheTTL, "ip-cache-ttl", time.Hour, "Reuse the hosts read from terraform, tofu or pulumi outputs for this long; 0 reads the outputs every time")
+	flag.BoolVar(&config.RefreshIP, "refresh-ip", false, "Read the hosts from the outputs again even if the cached ones haven't expired")
+	flag.StringVar(&config.Compress, "compress", "none", "Compress fetched snapshots: none, gzip or zstd (needs the zstd CLI)")
+	flag.StringVar(&config.EncryptKey, "encrypt-key", "", "age identity, as a file or a secrets reference such as keychain:tarsnap-age, to encrypt stored history with and read it back; can't be combined with -collect rsync, whose mirror is plaintext")
+	flag.StringVar(&config.Output, "output", "text", "Output format for fetch and summarize: text or json")
+	flag.IntVar(&config.MinLength, "min-length", 10, "Leave commands shorter than this out of the summaries")
+	config.Normalize = history.NormalizationNames
+	flag.Var(&config.Normalize, "normalize", "Rewrites applied to commands before deduplicating them: whitespace, env, sudo and semicolon, or none")
+	flag.BoolVar(&config.Exact, "exact", false, "Deduplicate commands exactly as recorded, turning off -normalize")
+	flag.BoolVar(&config.Changelog, "changelog", false, "Keep CHANGELOG.md in the data directory with the commands first seen on each host, by day")
+	flag.Var(&config.Include, "include", "Only store and summarize commands matching this regexp; repeat for several")
+	flag.Var(&config.Exclude, "exclude", "Never store or summarize commands matching this regexp, e.g. '^(ls|cd|pwd)\\b'; repeat for several")
+	flag.StringVar(&config.Tag, "tag", "", "Restrict -show-full and -analytics to snapshots with this tag")
+	flag.StringVar(&config.Host, "host", "", "Restrict -show-full and -analytics to snapshots fetched from this host")
+	flag.StringVar(&config.LogLevel, "log-level", "info", "Minimum level logged: debug, info, warn or error")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "Log format: text or json")
+	flag.StringVar(&config.LogFile, "log-file", "", "Write logs to this file, rotated by size, instead of stderr")
+	config.LogMaxSize = 10 << 20
+	flag.Var(&config.LogMaxSize, "log-max-size", "Rotate -log-file once it grows past this size, e.g. 10MiB; 0 never rotates")
+	flag.IntVar(&config.LogKeep, "log-keep", 5, "Number of rotated log files to keep")
+	flag.DurationVar(&config.LogMaxAge, "log-max-age", 0, "Remove rotated log files older than this, e.g. 168h; 0 keeps them until -log-keep drops them")
 	flag.Parse()
 
-	// deleteOldFiles()
-	moveOldFilesToTemp()
-
-	if config.Install {
-		err := setup(config)
-		if err != nil {
-			panic(err)
-		}
-		return
-	}
-
-	dowork()
-}
-
-func getip() (string, error) {
-	log.Println("Running Terraform command to get output...")
-
-	cwd, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Error getting current working directory:", err)
-		return "", err
-	}
-
-	tfpath := filepath.Join(cwd, "./terraform")
-
-	cmdName := "terraform"
-	args := []string{fmt.Sprintf("-chdir=%s", tfpath), "output", "-json"}
-
-	// Prepare the command
-	cmd := exec.Command(cmdName, args...)
-
-	// Print string representation of the command
-	log.Printf("Executing command: %s %s", cmdName, strings.Join(args, " "))
-
-	// Run the command
-	out, err := cmd.Output()
+	// Values from the config file replace the defaults, then parsing the
+	// command line again lets explicitly passed flags win over the file
+	err := loadConfigFile(*configPath, &config)
 	if err != nil {
-		log.Fatalf("Failed to execute command: %v", err)
+		log.Fatalf("Failed to load config file: %v", err)
 	}
+	flag.Parse()
 
-	// Process output
-	// log.Println(string(out))
-
-	log.Println("Parsing JSON output...")
-
-	var tfOutput TerraformOutput
-	err = json.Unmarshal(out, &tfOutput)
+	err = setupLogging(config)
 	if err != nil {
-		log.Fatalf("Failed to parse JSON: %v", err)
-	}
-
-	if !isValidIPv4(tfOutput.InstancePublicIP.Value) {
-		log.Fatalf("'%s' is not a valid ip", tfOutput.InstancePublicIP.Value)
+		log.Fatal(err)
 	}
 
-	return tfOutput.InstancePublicIP.Value, err
-}
-
-func setup(config Config) error {
-	// func setup(config struct) (string, error) {
-	log.SetFlags(log.LstdFlags | log.Llongfile)
-	log.Println("This is a test message")
-
-	var absCwd string
-
-	// If --show-full flag is provided, only show the unique list of bash lines
-	if config.ShowFull {
-		logDir := "./data/bash_history"
-		uniqueLines := getUniqueBashLines(logDir)
-		for _, line := range uniqueLines {
-			fmt.Println(line)
+	if !config.Exact {
+		norm, err := history.ParseNormalization(config.Normalize)
+		if err != nil {
+			log.Fatal(err)
 		}
-		return nil
-	}
-
-	// Expand cwd into an absolute path
-	absCwd, err := filepath.Abs(config.CWD)
-	if err != nil {
-		log.Fatalf("Failed to get absolute path: %v", err)
-	}
-
-	ip, err := getip()
-	if err != nil {
-		panic(err)
-	}
-
-	if ip == "" {
-		log.Fatal("cound not get ip, quitting")
-	}
-
-	log.Println("Creating launchd .plist file...")
-
-	tmpl, err := template.New("plist").Parse(PlistTemplate)
-	if err != nil {
-		log.Fatalf("Failed to create template: %v", err)
+		history.SetNormalization(norm)
 	}
 
-	exePath, err := os.Executable()
-	if err != nil {
-		panic(err)
-	}
-
-	absExePath, err := filepath.Abs(exePath)
-	if err != nil {
-		panic(err)
-	}
-
-	exeDir := filepath.Dir(absExePath)
-	fmt.Println("Executable Path:", absExePath)
-	fmt.Println("Executable Directory:", exeDir)
-
-	exeName := filepath.Base(exePath)
-	fmt.Println(exeName)
-
-	launctlTask := fmt.Sprintf("%s.%s", config.Label, ip)
-
-	// get current working directory
-	cwd, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Error getting current directory:", err)
-		return err
-	}
-	fmt.Println("CWD:", cwd)
-
-	// Get the user's home directory
-	home, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Println("Error getting home directory:", err)
-		return err
+	if config.EncryptKey != "" {
+		err = setEncryptKey(config.EncryptKey, runner.Exec{})
+		if err != nil {
+			log.Fatalf("Failed to load -encrypt-key: %v", err)
+		}
 	}
 
-	// Join the home directory with the target path
-	LaunchAgentsDir := filepath.Join(home, "Library/LaunchAgents/")
-
-	fmt.Println(LaunchAgentsDir)
-
-	// concatenate cwd with the plist file name
-	plist := fmt.Sprintf("%s/%s.plist", LaunchAgentsDir, launctlTask)
-
-	// Get the base name
-	baseName := filepath.Base(plist)
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
 
-	// Remove the extension
-	baseNameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-
-	fmt.Println(baseNameWithoutExt)
-
-	data := PlistData{
-		Label:         baseNameWithoutExt,
-		IP:            ip,
-		StartInterval: strconv.Itoa(int(config.Delay.Seconds())),
-		Args:          absExePath,
-		Path:          exeDir,
-		Cwd:           absCwd,
-		LogPath:       fmt.Sprintf("/tmp/%s.log", "tarsnap"),
-	}
-
-	file, err := os.Create(plist)
-	if err != nil {
-		log.Fatalf("Failed to create .plist file: %v", err)
-	}
-	defer file.Close()
+	// Left at the default, users give way to the User of ssh config aliases
+	config.DefaultUsers = !setFlags["users"] && len(config.Users) == 1 && config.Users[0] == "root"
 
-	err = tmpl.Execute(file, data)
+	// Everything below reports failures by returning an error, and this is
+	// the one place that decides to exit because of it
+	err = run(config, *configPath, setFlags)
 	if err != nil {
-		log.Fatalf("Failed to execute template: %v", err)
+		slog.Error(err.Error())
+		os.Exit(exitCode(err))
 	}
-
-	log.Println("Successfully created launchd .plist file.")
-
-	// removeLaunchdTarsnap(launctlTask)
-	loadLaunchdTarsnap(launctlTask, plist)
-	searchLaunchdList(launctlTask)
-	time.Sleep(500 * time.Millisecond)
-	searchLaunchdList(launctlTask)
-
-	return nil
 }
 
-func dowork() {
-	// Set SSH user
-	user := "root"
-
-	ip, err := getip()
-	if err != nil {
-		panic(err)
-	}
-
-	// Create local directory if it does not exist
-	localDir := "./data/bash_history"
-
-	localDir, err = filepath.Abs(localDir)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	fmt.Println(localDir)
-
-	// Append current timestamp to the filename
-	localFile := fmt.Sprintf("%s/bash_history_%s.txt", localDir, time.Now().Format("20060102_150405"))
-	absLocalFile, err := filepath.Abs(localFile)
-	if err != nil {
-		log.Fatalf("Failed to get absolute path: %v", err)
-	}
-
-	err = os.MkdirAll(localDir, 0o755)
-	if err != nil {
-		log.Fatalf("Failed to create directory: %v", err)
-	}
-
-	// Create the command with scp and arguments
-	cmd := exec.Command("scp", "-o", "ConnectTimeout=10", fmt.Sprintf("%s@%s:~/.bash_history", user, ip), absLocalFile)
-
-	log.Println("Copying remote bash history file to the local machine...")
-
-	// Logging the command
-	log.Printf("Executing command: scp -o ConnectTimeout=10 %s@%s:~/.bash_history %s\n", user, ip, absLocalFile)
+// Exit codes: a run that fetched from some hosts but not others exits
+// exitPartial, so fleet scripts can tell it from a broken setup
+const (
+	exitOK      = 0
+	exitFatal   = 1
+	exitPartial = 2
+)
 
-	// Run the command and capture the combined output
-	outBytes, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Fatalf("Failed to execute command: %v", err)
+func exitCode(err error) int {
+	var partial *partialFailureError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &partial):
+		return exitPartial
+	default:
+		return exitFatal
 	}
+}
 
-	// First, declare a bytes.Buffer
-	var out bytes.Buffer
-
-	// Then, write the output to the buffer
-	_, err = out.Write(outBytes)
-	if err != nil {
-		log.Fatalf("Failed to write to buffer: %v", err)
-	}
-
-	// To print the content of the buffer, you can convert it to a string:
-	log.Println(out.String())
-
-	log.Println(out) // Print the output
-
-	if err != nil {
-		log.Fatalf("Failed to execute command: %v", err)
+func run(config Config, configPath string, setFlags map[string]bool) error {
+	if flag.NArg() > 0 {
+		var err error
+		switch flag.Arg(0) {
+		case "tag":
+			err = runTagCommand(config, flag.Args()[1:])
+		case "onboard":
+			err = runOnboardCommand(config, flag.Args()[1:])
+		case "fetch":
+			err = runFetchCommand(config, flag.Args()[1:])
+		case "daemon":
+			err = runDaemonCommand(config, flag.Args()[1:])
+		case "summarize":
+			err = runSummarizeCommand(config, flag.Args()[1:])
+		case "top":
+			err = runTopCommand(config, flag.Args()[1:])
+		case "browse":
+			err = runBrowseCommand(config, flag.Args()[1:])
+		case "search":
+			err = runSearchCommand(config, flag.Args()[1:])
+		case "compact":
+			err = runCompactCommand(config, flag.Args()[1:])
+		case "store":
+			err = runStoreCommand(config, flag.Args()[1:])
+		case "prune":
+			err = runPruneCommand(config, flag.Args()[1:])
+		case "status":
+			err = runStatusCommand(config)
+		case "import":
+			err = runImportCommand(config, flag.Args()[1:])
+		case "export":
+			err = runExportCommand(config, flag.Args()[1:])
+		case "jobs":
+			err = runJobsCommand(config, flag.Args()[1:])
+		case "run-now":
+			err = runRunNowCommand(config, flag.Args()[1:])
+		case "ledger":
+			err = runLedgerCommand(config, flag.Args()[1:])
+		case "tools":
+			err = runToolsCommand(config, flag.Args()[1:])
+		case "report":
+			err = runReportCommand(config, flag.Args()[1:])
+		case "encrypt":
+			err = runEncryptCommand(config, flag.Args()[1:])
+		case "logs":
+			err = runLogsCommand(config, flag.Args()[1:])
+		case "diff":
+			err = runDiffCommand(config, flag.Args()[1:])
+		case "version":
+			err = printVersion(os.Stdout, config.Output)
+		case "failed":
+			err = printFailedCommands(os.Stdout, config.DataDir)
+		default:
+			err = fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		return err
 	}
 
-	log.Println("Successfully copied remote bash history file to the local machine.")
-
-	log.Println("Output from the scp command:")
-
-	// Loop over all the files in the data/bash_history directory
-	log.Println("Summary of data files:")
-	lineCounts := make(map[string]int)
-	aggregateLines := []string{}
-
-	err = filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+	if config.Analytics {
+		lines, err := selectCommandRuns(config)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to select history: %w", err)
 		}
-		if !info.IsDir() {
-			// Only consider regular files
-			fileLines, lines, err := readLines(path)
-			if err != nil {
-				return err
-			}
-			lineCounts[path] = fileLines
-			aggregateLines = append(aggregateLines, lines...)
+		err = exportAnalytics(os.Stdout, lines, config.SampleRate, config.Epsilon, config.Delta)
+		if err != nil {
+			return fmt.Errorf("failed to export analytics: %w", err)
 		}
 		return nil
-	})
-	if err != nil {
-		log.Fatalf("Failed to walk through files: %v", err)
-	}
-
-	// Display the summary of data files
-	for path, count := range lineCounts {
-		log.Printf("File: %s, Line Count: %d", path, count)
-	}
-
-	// Get the unique line count for the aggregate of all files
-	uniqueLineCount := getUniqueLineCount(aggregateLines)
-	log.Printf("Unique Line Count for Aggregate of All Files: %d", uniqueLineCount)
-
-	log.Println("Finished.")
-
-	// Generate summary.txt file containing unique list of bash lines
-	generateSummaryFile(localDir)
-}
-
-func searchLaunchdList(launctlTask string) {
-	cmd := exec.Command("launchctl", "list")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
 	}
 
-	lines := strings.Split(out.String(), "\n")
-	found := false
-	for _, line := range lines {
-		if strings.Contains(line, launctlTask) {
-			fmt.Printf("%s\n", line)
-			found = true
-			break
+	if config.Install {
+		err := resolveInstallConflicts(&config, configPath, setFlags)
+		if err != nil {
+			return err
 		}
+		return setup(config, runner.Exec{})
 	}
 
-	if found {
-		fmt.Printf("%s found, load was successful\n", launctlTask)
-	} else {
-		fmt.Printf("%s not found, load failed\n", launctlTask)
-	}
+	return dowork(config)
 }
 
-func loadLaunchdTarsnap(launctlTask, plist string) {
-	fmt.Printf("running command launchctl load %s\n", plist)
-	cmd := exec.Command("launchctl", "load", plist)
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
+// runFetchCommand implements `tarsnap fetch`, one fetch like running
+// without a command
+func runFetchCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	fs.StringVar(&config.Output, "output", config.Output, "Output format: text or json")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q, usage: tarsnap fetch [-output text|json]", fs.Arg(0))
 	}
+	return dowork(config)
 }
 
-func isValidIPv4(ip string) bool {
-	parsedIP, err := netaddr.ParseIP(ip)
-	if err != nil {
-		return false
+// dowork runs one fetch, reporting its start and outcome to the
+// configured healthcheck and failures to the webhook. Runs are serialized by
+// a lock in the state directory so a fetch outlasting its interval doesn't
+// race the next scheduled one.
+func dowork(config Config) error {
+	if !config.DryRun {
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if errors.Is(err, errLocked) && config.SkipIfRunning {
+			slog.Info("Another run is in progress, skipping this one")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
 	}
-	return parsedIP.Is4()
-}
 
-func moveOldFilesToTemp() {
-	homeDir, err := os.UserHomeDir()
+	config, err := resolveSecrets(config, runner.Exec{})
 	if err != nil {
-		fmt.Println("Error getting user's home directory:", err)
-		return
+		return err
 	}
 
-	matchingPattern := filepath.Join(homeDir, "Library", "LaunchAgents", "com.tarsnap.*.*.*.*.plist")
-
-	files, err := filepath.Glob(matchingPattern)
+	err = checkPermissions(storedPaths(config), config.FixPerms && !config.DryRun)
 	if err != nil {
-		fmt.Println("Error matching files:", err)
-		return
-	}
-
-	now := time.Now()
-	twoDaysAgo := now.Add(-48 * time.Hour)
-
-	tmpDir := "/tmp" // Change this to the desired destination directory
-
-	for _, file := range files {
-		moveOldFileToTemp(file, tmpDir, twoDaysAgo)
+		slog.Error("Failed to check permissions", "err", err)
 	}
-}
 
-func moveOldFileToTemp(filePath, destDir string, cutoff time.Time) {
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		fmt.Println("Error getting file info:", err)
-		return
+	hc := newHealthcheck(config.HealthcheckURL)
+	if config.DryRun {
+		hc = newHealthcheck("")
 	}
 
-	if fileInfo.ModTime().Before(cutoff) {
-		newPath := filepath.Join(destDir, filepath.Base(filePath))
-		err := os.Rename(filePath, newPath)
-		if err != nil {
-			fmt.Println("Error moving file:", err)
-		} else {
-			fmt.Println("Moved:", filePath, "to", newPath)
-		}
+	hc.start()
+	err = fetchAndSummarize(config, runner.Exec{})
+	hc.finish(err)
+	if err != nil && !config.DryRun {
+		newNotifier(config).fetchFailed(err)
 	}
+	return err
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// Manifest records the state of summary.txt after it was regenerated.
+// summary.txt only ever grows, so a manifest with fewer unique lines than
+// its predecessor means data was lost or truncated.
+type Manifest struct {
+	Time          time.Time `json:"time"`
+	Summary       string    `json:"summary"`
+	SHA256        string    `json:"sha256"`
+	SnapshotCount int       `json:"snapshot_count"`
+	UniqueCount   int       `json:"unique_count"`
+}
+
+func manifestDir(stateDir string) string {
+	return filepath.Join(stateDir, "manifests")
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listManifests returns the manifest files in stateDir, oldest first
+func listManifests(stateDir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(manifestDir(stateDir), "manifest_*.json"))
+	sort.Strings(paths)
+	return paths, err
+}
+
+func readManifest(path string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// writeManifest snapshots the integrity of the summary in logDir, warns when
+// it shrank since the previous manifest and keeps only the newest keep
+// manifests
+func writeManifest(stateDir, logDir string, keep int) error {
+	summaryPath := history.ResolvePath(filepath.Join(logDir, "summary.txt"))
+
+	sum, err := sha256File(summaryPath)
+	if err != nil {
+		return err
+	}
+	unique, _, err := history.ReadLines(summaryPath)
+	if err != nil {
+		return err
+	}
+
+	snapshots, _, err := listSnapshots(logDir)
+	if err != nil {
+		return err
+	}
+
+	m := Manifest{
+		Time:          time.Now(),
+		Summary:       summaryPath,
+		SHA256:        sum,
+		SnapshotCount: len(snapshots),
+		UniqueCount:   unique,
+	}
+
+	existing, err := listManifests(stateDir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		prev, err := readManifest(existing[len(existing)-1])
+		if err == nil && m.UniqueCount < prev.UniqueCount {
+			slog.Warn("summary.txt shrank", "previous_unique", prev.UniqueCount, "unique", m.UniqueCount, "since", prev.Time.Format(time.RFC3339))
+		}
+	}
+
+	err = os.MkdirAll(manifestDir(stateDir), 0o700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("manifest_%s.json", m.Time.Format("20060102_150405"))
+	err = atomicfile.WriteFile(filepath.Join(manifestDir(stateDir), name), data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	existing, err = listManifests(stateDir)
+	if err != nil {
+		return err
+	}
+	for keep > 0 && len(existing) > keep {
+		err = os.Remove(existing[0])
+		if err != nil {
+			return err
+		}
+		existing = existing[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+)
+
+// HostMetadata describes the OS and shell of a host at fetch time
+type HostMetadata struct {
+	Uname        string `json:"uname"`
+	Shell        string `json:"shell"`
+	ShellVersion string `json:"shell_version"`
+	Uptime       string `json:"uptime"`
+}
+
+// hostMetadataScript prints one field per line in HostMetadata order
+const hostMetadataScript = `uname -a; echo "$SHELL"; "$SHELL" --version 2>/dev/null | head -n 1; uptime`
+
+// collectHostMetadata gathers HostMetadata over a single ssh connection.
+// Metadata is best effort, so failures are logged and yield nil.
+func collectHostMetadata(remote fetch.Remote, user, ip string) *HostMetadata {
+	out, err := remote.Run(user+"@"+ip, hostMetadataScript, "")
+	if err != nil {
+		slog.Warn("Failed to collect metadata", "target", user+"@"+ip, "err", err)
+		return nil
+	}
+
+	fields := strings.Split(out, "\n")
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+
+	return &HostMetadata{
+		Uname:        strings.TrimSpace(fields[0]),
+		Shell:        strings.TrimSpace(fields[1]),
+		ShellVersion: strings.TrimSpace(fields[2]),
+		Uptime:       strings.TrimSpace(fields[3]),
+	}
+}
+
+// fetchMetadata maps each host to the metadata collected for it
+func fetchMetadata(results []FetchResult) map[string]HostMetadata {
+	metadata := make(map[string]HostMetadata)
+	for _, r := range results {
+		if r.Metadata != nil {
+			metadata[r.Host] = *r.Metadata
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
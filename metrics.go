@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fetchMetrics accumulates counters across the runs of a long-lived process
+// for the daemon's /metrics endpoint
+type fetchMetrics struct {
+	mu               sync.Mutex
+	runs             int
+	fetches          int
+	failures         int
+	bytesTransferred int64
+	uniqueCommands   int
+	lastSuccess      time.Time
+}
+
+var metrics = &fetchMetrics{}
+
+// recordFetch adds the outcome of one run's fetches
+func (m *fetchMetrics) recordFetch(results []FetchResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.runs++
+	for _, r := range results {
+		m.fetches++
+		if r.Err != nil {
+			m.failures++
+			continue
+		}
+		m.bytesTransferred += r.Bytes
+	}
+}
+
+// recordSummary notes a run that got as far as updating the summaries
+func (m *fetchMetrics) recordSummary(report SummaryReport, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uniqueCommands = report.UniqueLines
+	if ok {
+		m.lastSuccess = time.Now()
+	}
+}
+
+// WriteTo renders the metrics in the Prometheus text exposition format
+func (m *fetchMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var lastSuccess float64
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+
+	var total int64
+	for _, metric := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"tarsnap_runs_total", "counter", "Runs that attempted fetches.", float64(m.runs)},
+		{"tarsnap_fetches_total", "counter", "History fetches attempted, one per host and user.", float64(m.fetches)},
+		{"tarsnap_fetch_failures_total", "counter", "History fetches that failed.", float64(m.failures)},
+		{"tarsnap_bytes_transferred_total", "counter", "Bytes of history copied from remote hosts.", float64(m.bytesTransferred)},
+		{"tarsnap_unique_commands", "gauge", "Unique commands across all collected history.", float64(m.uniqueCommands)},
+		{"tarsnap_last_success_timestamp_seconds", "gauge", "Unix time of the last run in which every fetch succeeded.", lastSuccess},
+	} {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// serveMetrics exposes /metrics on addr in the background
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w)
+	})
+
+	go func() {
+		slog.Info("Serving metrics", "addr", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			slog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+}
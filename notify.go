@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notification is the body posted to a generic webhook
+type Notification struct {
+	Event    string   `json:"event"`
+	Text     string   `json:"text"`
+	Error    string   `json:"error,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+}
+
+// notifier posts notifications to a webhook, either as Notification JSON
+// or, with format "slack", as a Slack incoming webhook message
+type notifier struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+func newNotifier(config Config) notifier {
+	return notifier{url: config.WebhookURL, format: config.WebhookFormat, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n notifier) payload(note Notification) ([]byte, error) {
+	switch n.format {
+	case "", "json":
+		return json.Marshal(note)
+	case "slack":
+		text := note.Text
+		if note.Error != "" {
+			text += "\n```" + note.Error + "```"
+		}
+		if len(note.Commands) > 0 {
+			text += "\n```" + strings.Join(note.Commands, "\n") + "```"
+		}
+		return json.Marshal(map[string]string{"text": text})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q, want json or slack", n.format)
+	}
+}
+
+// send delivers note. Like healthcheck pings, delivery problems are logged
+// and never fail the run.
+func (n notifier) send(note Notification) {
+	if n.url == "" {
+		return
+	}
+	body, err := n.payload(note)
+	if err != nil {
+		slog.Warn("Failed to build notification", "err", err)
+		return
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to send notification", "event", note.Event, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Notification rejected", "event", note.Event, "status", resp.Status)
+	}
+}
+
+// fetchFailed notifies that a run failed, fully or for some hosts
+func (n notifier) fetchFailed(err error) {
+	n.send(Notification{Event: "fetch_failed", Text: "tarsnap fetch failed", Error: err.Error()})
+}
+
+// hostFailing notifies that fetches from host have failed failures times
+// in a row
+func (n notifier) hostFailing(host string, failures int, lastSuccess time.Time, lastErr string) {
+	since := "never succeeded"
+	if !lastSuccess.IsZero() {
+		since = "last success " + lastSuccess.Format(time.RFC3339)
+	}
+	n.send(Notification{Event: "host_failing", Text: fmt.Sprintf("tarsnap failed to fetch from %s %d times in a row, %s", host, failures, since), Error: lastErr})
+}
+
+// watchedCommands notifies, once per host, about the commands each host ran
+// since its last fetch that match one of the watch patterns. Commands are
+// matched whether or not a summary keeps them, and each time they are run.
+func (n notifier) watchedCommands(patterns []string, ranByHost map[string][]string) error {
+	if len(patterns) == 0 || len(ranByHost) == 0 {
+		return nil
+	}
+	watch, err := compilePatterns(patterns)
+	if err != nil {
+		return err
+	}
+
+	hosts := make([]string, 0, len(ranByHost))
+	for host := range ranByHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		var hits []string
+		for _, c := range ranByHost[host] {
+			if matchesAny(watch, c) {
+				hits = append(hits, c)
+			}
+		}
+		if len(hits) > 0 {
+			n.send(Notification{Event: "watched_commands", Text: fmt.Sprintf("tarsnap collected %d watched commands run on %s", len(hits), host), Host: host, Commands: hits})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+const onboardMarker = "# >>> tarsnap >>>"
+
+// onboardSnippets are appended to the remote rc file so history is written
+// immediately and carries timestamps. Each shell also registers itself in
+// fetch.SessionDir and appends its history on SIGUSR1, for --flush-history. ResultsHelper is added with --results
+// and appends "epoch<TAB>exit code<TAB>seconds<TAB>command" lines to
+// ~/.tarsnap_results after every command.
+var onboardSnippets = map[string]struct {
+	RCFile        string
+	Snippet       string
+	ResultsHelper string
+}{
+	"bash": {
+		RCFile: ".bashrc",
+		Snippet: `export HISTTIMEFORMAT='%F %T '
+shopt -s histappend
+PROMPT_COMMAND="history -a${PROMPT_COMMAND:+; $PROMPT_COMMAND}"
+mkdir -p ~/.tarsnap_sessions && : > ~/.tarsnap_sessions/$$
+trap 'history -a' USR1`,
+		ResultsHelper: `__tarsnap_arm() { __tarsnap_ready=1; }
+__tarsnap_preexec() { [ -n "$__tarsnap_ready" ] || return; unset __tarsnap_ready; __tarsnap_t0=$SECONDS; }
+__tarsnap_log() {
+  local rc=$? num cmd
+  read -r num cmd <<< "$(HISTTIMEFORMAT= history 1)"
+  if [ -n "$__tarsnap_t0" ] && [ "$num" != "$__tarsnap_last" ]; then
+    printf '%s\t%s\t%s\t%s\n' "$(date +%s)" "$rc" "$((SECONDS - __tarsnap_t0))" "$cmd" >> ~/.tarsnap_results
+  fi
+  __tarsnap_last=$num
+  unset __tarsnap_t0
+}
+trap '__tarsnap_preexec' DEBUG
+PROMPT_COMMAND="__tarsnap_log${PROMPT_COMMAND:+; $PROMPT_COMMAND}; __tarsnap_arm"`,
+	},
+	"zsh": {
+		RCFile: ".zshrc",
+		Snippet: `setopt EXTENDED_HISTORY
+setopt INC_APPEND_HISTORY
+mkdir -p ~/.tarsnap_sessions && : > ~/.tarsnap_sessions/$$
+TRAPUSR1() { fc -AI }`,
+		ResultsHelper: `autoload -Uz add-zsh-hook
+__tarsnap_preexec() { __tarsnap_cmd=${1//$'\n'/ }; __tarsnap_t0=$SECONDS; }
+__tarsnap_precmd() {
+  local rc=$?
+  [ -n "$__tarsnap_t0" ] || return
+  printf '%s\t%s\t%s\t%s\n' "$(date +%s)" "$rc" "$((SECONDS - __tarsnap_t0))" "$__tarsnap_cmd" >> ~/.tarsnap_results
+  unset __tarsnap_t0
+}
+add-zsh-hook preexec __tarsnap_preexec
+add-zsh-hook precmd __tarsnap_precmd`,
+	},
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// runOnboardCommand implements `tarsnap onboard user@host`
+func runOnboardCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("onboard", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Modify the remote rc file without asking")
+	results := fs.Bool("results", false, "Also log exit codes and durations to ~/.tarsnap_results")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: tarsnap onboard [--yes] [--results] user@host")
+	}
+	target := fs.Arg(0)
+	_, host, _ := strings.Cut(target, "@")
+	remote := newRemote(config, host, runner.Exec{})
+
+	shellPath, err := remote.Run(target, `echo "$SHELL"`, "")
+	if err != nil {
+		return fmt.Errorf("failed to detect remote shell: %w", err)
+	}
+	shell := path.Base(shellPath)
+
+	setup, ok := onboardSnippets[shell]
+	if !ok {
+		return fmt.Errorf("unsupported remote shell %q", shellPath)
+	}
+	slog.Info("Configuring remote shell", "shell", shell, "rc_file", "~/"+setup.RCFile)
+
+	_, err = remote.Run(target, fmt.Sprintf("grep -qF '%s' ~/%s", onboardMarker, setup.RCFile), "")
+	if err == nil {
+		slog.Info("Already onboarded", "target", target, "rc_file", "~/"+setup.RCFile)
+		return nil
+	}
+
+	snippet := setup.Snippet
+	if *results {
+		snippet += "\n" + setup.ResultsHelper
+	}
+
+	block := fmt.Sprintf("\n%s\n%s\n# <<< tarsnap <<<\n", onboardMarker, snippet)
+	fmt.Printf("The following will be appended to ~/%s on %s:\n%s\n", setup.RCFile, target, block)
+	if !*yes && !confirm("Continue?") {
+		return errors.New("onboarding cancelled")
+	}
+
+	backup := fmt.Sprintf("~/%s.tarsnap-%s.bak", setup.RCFile, time.Now().Format("20060102_150405"))
+	_, err = remote.Run(target, fmt.Sprintf("touch ~/%s && cp ~/%s %s", setup.RCFile, setup.RCFile, backup), "")
+	if err != nil {
+		return fmt.Errorf("failed to back up ~/%s: %w", setup.RCFile, err)
+	}
+	slog.Info("Backed up rc file", "rc_file", "~/"+setup.RCFile, "backup", backup)
+
+	_, err = remote.Run(target, fmt.Sprintf("cat >> ~/%s", setup.RCFile), block)
+	if err != nil {
+		return fmt.Errorf("failed to update ~/%s: %w", setup.RCFile, err)
+	}
+
+	slog.Info("Onboarded", "target", target)
+	return nil
+}
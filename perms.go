@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// storedPaths are the files and directories holding collected history or
+// what was derived from it
+func storedPaths(config Config) []string {
+	paths := []string{config.DataDir, config.StateDir}
+	if config.Archive == "tar" {
+		paths = append(paths, config.ArchiveDir)
+	}
+	if config.LogFile != "" {
+		paths = append(paths, config.LogFile)
+	}
+	return paths
+}
+
+// checkPermissions warns about files under paths that other users can
+// read, or with fix takes their group and world permissions away. Data
+// written from now on is created 0600 in 0700 directories anyway; this
+// catches what older versions, or tar and git, left behind.
+func checkPermissions(paths []string, fix bool) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	var exposed []string
+	var errs []error
+	seen := make(map[string]bool)
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, os.ErrNotExist) && path == root {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if seen[path] {
+				return nil
+			}
+			seen[path] = true
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 || info.Mode().Perm()&0o077 == 0 {
+				return nil
+			}
+			if !fix {
+				exposed = append(exposed, path)
+				return nil
+			}
+			err = os.Chmod(path, info.Mode().Perm()&^0o077)
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			slog.Info("Restricted permissions", "path", path, "was", info.Mode().Perm().String())
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(exposed) > 0 {
+		slog.Warn("Stored history is readable by other users, run with -fix-perms to restrict it", "paths", len(exposed), "first", exposed[0])
+	}
+	return errors.Join(errs...)
+}
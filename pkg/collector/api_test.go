@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateAPI = flag.Bool("update-api", false, "Record the current API in testdata/api.txt")
+
+// apiFile lists the exported API, one identifier per line, the way Go's
+// own api/*.txt files do
+const apiFile = "testdata/api.txt"
+
+// exportedAPI describes every exported identifier of the package in dir.
+// Parameter names are left out, since renaming one breaks no caller.
+func exportedAPI(t *testing.T, dir string) []string {
+	t.Helper()
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expr := func(e ast.Expr) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, e)
+		return buf.String()
+	}
+	types := func(fl *ast.FieldList) string {
+		if fl == nil {
+			return ""
+		}
+		var parts []string
+		for _, f := range fl.List {
+			n := max(len(f.Names), 1)
+			for i := 0; i < n; i++ {
+				parts = append(parts, expr(f.Type))
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+	signature := func(ft *ast.FuncType) string {
+		sig := "(" + types(ft.Params) + ")"
+		if results := types(ft.Results); results != "" {
+			if ft.Results.NumFields() > 1 {
+				results = "(" + results + ")"
+			}
+			sig += " " + results
+		}
+		return sig
+	}
+
+	var api []string
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				switch d := decl.(type) {
+				case *ast.FuncDecl:
+					if !d.Name.IsExported() {
+						continue
+					}
+					if d.Recv == nil {
+						api = append(api, "func "+d.Name.Name+signature(d.Type))
+						continue
+					}
+					recv := expr(d.Recv.List[0].Type)
+					if !ast.IsExported(strings.TrimPrefix(recv, "*")) {
+						continue
+					}
+					api = append(api, "method ("+recv+") "+d.Name.Name+signature(d.Type))
+				case *ast.GenDecl:
+					for _, spec := range d.Specs {
+						switch s := spec.(type) {
+						case *ast.TypeSpec:
+							if !s.Name.IsExported() {
+								continue
+							}
+							switch tt := s.Type.(type) {
+							case *ast.StructType:
+								api = append(api, "type "+s.Name.Name+" struct")
+								for _, f := range tt.Fields.List {
+									for _, name := range f.Names {
+										if name.IsExported() {
+											api = append(api, "type "+s.Name.Name+" struct, "+name.Name+" "+expr(f.Type))
+										}
+									}
+								}
+							case *ast.InterfaceType:
+								api = append(api, "type "+s.Name.Name+" interface")
+								for _, m := range tt.Methods.List {
+									for _, name := range m.Names {
+										api = append(api, "type "+s.Name.Name+" interface, "+name.Name+signature(m.Type.(*ast.FuncType)))
+									}
+								}
+							default:
+								api = append(api, "type "+s.Name.Name+" "+expr(s.Type))
+							}
+						case *ast.ValueSpec:
+							kind := "var"
+							if d.Tok == token.CONST {
+								kind = "const"
+							}
+							for _, name := range s.Names {
+								if name.IsExported() {
+									api = append(api, kind+" "+name.Name)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(api)
+	return api
+}
+
+// TestAPICompatibility fails when anything recorded in testdata/api.txt was
+// removed or changed, which v1 doesn't allow, and when something new wasn't
+// recorded yet: run go test -run TestAPICompatibility -update-api then.
+func TestAPICompatibility(t *testing.T) {
+	current := exportedAPI(t, ".")
+	if *updateAPI {
+		err := os.WriteFile(filepath.FromSlash(apiFile), []byte(strings.Join(current, "\n")+"\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(filepath.FromSlash(apiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		recorded[line] = true
+	}
+	now := make(map[string]bool)
+	for _, line := range current {
+		now[line] = true
+		if !recorded[line] {
+			t.Errorf("new API not recorded in %s, run with -update-api: %s", apiFile, line)
+		}
+	}
+	for line := range recorded {
+		if !now[line] {
+			t.Errorf("incompatible change, v1 API removed or changed: %s", line)
+		}
+	}
+}
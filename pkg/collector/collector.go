@@ -0,0 +1,141 @@
+// Package collector lets other programs collect shell history the way the
+// tarsnap binary does, without shelling out to it: Collector copies the
+// history of remote users into a data directory and Store summarizes what
+// has been collected there.
+//
+// The exported API is stable at v1 and follows semantic versioning: within
+// v1, nothing exported is removed, renamed or given a different signature,
+// and new Options fields keep their zero value meaning what it meant
+// before. An identifier that is to go away is first marked with a
+// "Deprecated:" paragraph naming its replacement and kept for the rest of
+// v1. TestAPICompatibility enforces this against testdata/api.txt.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// Options configure a Collector. The zero value copies root's bash history
+// from unix hosts with scp into ./data/bash_history.
+type Options struct {
+	// DataDir gets a subdirectory of snapshots per remote user
+	DataDir string
+
+	// Users are the remote accounts whose history is copied
+	Users []string
+
+	// RemoteOS is unix or windows
+	RemoteOS string
+
+	// Collect is scp, ssh to print the history over ssh on hosts where scp
+	// and SFTP are disabled, or rsync to transfer only what was appended
+	Collect string
+
+	// Compress is none, gzip or zstd
+	Compress string
+
+	TrustOnFirstUse bool
+	KnownHosts      string
+
+	// JumpHost is a bastion, as user@host[:port], or a comma separated chain
+	JumpHost string
+
+	// IdentityAgent is the ssh-agent socket to use instead of SSH_AUTH_SOCK
+	IdentityAgent string
+}
+
+// Snapshot is one history file copied by Fetch
+type Snapshot struct {
+	Host string
+	User string
+	Path string
+}
+
+// Collector copies shell history from remote hosts
+type Collector struct {
+	opts       Options
+	remotePath string
+}
+
+// New returns a Collector for opts, failing on settings it doesn't know
+func New(opts Options) (*Collector, error) {
+	if opts.DataDir == "" {
+		opts.DataDir = "./data/bash_history"
+	}
+	if len(opts.Users) == 0 {
+		opts.Users = []string{"root"}
+	}
+	switch opts.Collect {
+	case "":
+		opts.Collect = "scp"
+	case "scp", "ssh", "rsync":
+	default:
+		return nil, fmt.Errorf("unknown collect mode %q, want scp, ssh or rsync", opts.Collect)
+	}
+	if _, ok := history.CompressedSuffixes[opts.Compress]; !ok && opts.Compress != "" && opts.Compress != "none" {
+		return nil, fmt.Errorf("unknown compression %q, want none, gzip or zstd", opts.Compress)
+	}
+	remotePath, err := fetch.HistoryPath(opts.RemoteOS)
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir, err := filepath.Abs(opts.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	opts.DataDir = dataDir
+
+	return &Collector{opts: opts, remotePath: remotePath}, nil
+}
+
+// Fetch copies the history of every configured user on host, returning the
+// snapshots it stored. Users that fail don't stop the others; their errors
+// are joined into the returned error. ssh and scp still running when ctx is
+// done are killed.
+func (c *Collector) Fetch(ctx context.Context, host string) ([]Snapshot, error) {
+	remote := fetch.NewRemote(fetch.Options{
+		TrustOnFirstUse: c.opts.TrustOnFirstUse,
+		KnownHosts:      c.opts.KnownHosts,
+		JumpHost:        c.opts.JumpHost,
+		IdentityAgent:   c.opts.IdentityAgent,
+	}, runner.Exec{Context: ctx})
+
+	var snapshots []Snapshot
+	var errs []error
+	for _, user := range c.opts.Users {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		path, err := fetch.UserHistory(remote, user, host, filepath.Join(c.opts.DataDir, user), c.remotePath, c.opts.RemoteOS, c.opts.Collect)
+		if err == nil {
+			_, err = history.Quarantine(path)
+		}
+		if err == nil {
+			path, err = history.Compress(path, c.opts.Compress)
+		}
+		if err == nil {
+			path, err = history.Encrypt(path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s@%s: %w", user, host, err))
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Host: host, User: user, Path: path})
+	}
+	return snapshots, errors.Join(errs...)
+}
+
+// Store returns the Store reading what the Collector fetched
+func (c *Collector) Store() *Store {
+	return NewStore(c.opts.DataDir)
+}
@@ -0,0 +1,45 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// Entry is a command and the earliest time it was seen, zero when unknown
+type Entry struct {
+	Timestamp time.Time
+	Command   string
+}
+
+// Store reads the history collected into a data directory, by a Collector
+// or the tarsnap binary
+type Store struct {
+	dir string
+}
+
+// NewStore returns the Store for dataDir
+func NewStore(dataDir string) *Store {
+	return &Store{dir: dataDir}
+}
+
+// Summary returns every unique command in the store, sorted. zsh and fish
+// decoration is stripped, so a command recorded by several shells appears
+// once.
+func (s *Store) Summary() ([]string, error) {
+	return history.UniqueLines(s.dir, nil)
+}
+
+// Entries returns every unique command with the earliest time it was seen,
+// oldest first
+func (s *Store) Entries() ([]Entry, error) {
+	found, err := history.UniqueEntries(s.dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, len(found))
+	for i, e := range found {
+		entries[i] = Entry{Timestamp: e.Timestamp, Command: e.Command}
+	}
+	return entries, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// pruneSnapshots removes raw snapshots whose lines are already in the
+// ledger, keeping per host and user the newest keepLast snapshots and every
+// snapshot taken within keepDays. A zero keepDays or keepLast leaves that
+// rule out; with both zero nothing is removed. Snapshots the ledger hasn't
+// recorded are never removed, since their lines would be lost.
+func pruneSnapshots(dataDir, stateDir string, keepDays, keepLast int, dryRun bool) ([]string, error) {
+	if keepDays <= 0 && keepLast <= 0 {
+		return nil, nil
+	}
+
+	absDataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := history.LoadDedupIndex(history.IndexPath(stateDir, "ledger"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, _, err := listSnapshots(absDataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := func(s snapshotFile) time.Time {
+		if t, ok := history.SnapshotTime(s.path); ok {
+			return t
+		}
+		return s.info.ModTime()
+	}
+
+	streams := make(map[string][]snapshotFile)
+	for _, s := range snapshots {
+		key := filepath.Dir(s.path) + "\x00" + snapshotHost(s.path)
+		streams[key] = append(streams[key], s)
+	}
+	for _, stream := range streams {
+		sort.SliceStable(stream, func(i, j int) bool { return taken(stream[i]).Before(taken(stream[j])) })
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -keepDays)
+	var removed []string
+	for _, stream := range streams {
+		for i, s := range stream {
+			newest := len(stream) - i
+			if keepLast > 0 && newest <= keepLast {
+				continue
+			}
+			if keepDays > 0 && taken(s).After(cutoff) {
+				continue
+			}
+			if !idx.Seen(s.path) {
+				continue
+			}
+
+			if dryRun {
+				runner.PrintDryRun("rm", s.path)
+			} else {
+				err := os.Remove(s.path)
+				if err != nil {
+					return removed, err
+				}
+				slog.Info("Pruned snapshot", "path", s.path)
+			}
+			removed = append(removed, s.path)
+		}
+	}
+	return removed, nil
+}
+
+// runPruneCommand implements `tarsnap prune`
+func runPruneCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	keepDays := fs.Int("keep-days", config.PruneKeepDays, "Keep snapshots taken within this many days")
+	keepLast := fs.Int("keep-last", config.PruneKeepLast, "Keep this many of the newest snapshots per host and user")
+	fs.Parse(args)
+
+	if *keepDays <= 0 && *keepLast <= 0 {
+		return fmt.Errorf("set -keep-days or -keep-last")
+	}
+
+	// A summary reading the snapshots being removed would lose them
+	if !config.DryRun {
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
+	}
+
+	removed, err := pruneSnapshots(config.DataDir, config.StateDir, *keepDays, *keepLast, config.DryRun)
+	if err != nil {
+		return err
+	}
+	if config.DryRun {
+		fmt.Printf("Would prune %d snapshots\n", len(removed))
+		return nil
+	}
+	fmt.Printf("Pruned %d snapshots\n", len(removed))
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+func TestPruneSnapshots(t *testing.T) {
+	day := 24 * time.Hour
+	name := func(host string, age time.Duration) string {
+		return "ops/bash_history_" + host + "_" + time.Now().Add(-age).Format("20060102_150405") + ".txt"
+	}
+	web1Old, web1Mid, web1New := name("web1", 30*day), name("web1", 10*day), name("web1", time.Hour)
+	web2Old, web2New := name("web2", 30*day), name("web2", time.Hour)
+	unseen := name("web3", 40*day)
+	all := []string{web1Old, web1Mid, web1New, web2Old, web2New, unseen, "ops/summary.txt"}
+
+	tests := []struct {
+		name     string
+		keepDays int
+		keepLast int
+		dryRun   bool
+		removed  []string
+	}{
+		{name: "keep the newest per host", keepLast: 1, removed: []string{web1Old, web1Mid, web2Old}},
+		{name: "keep the newest two", keepLast: 2, removed: []string{web1Old}},
+		{name: "keep recent days", keepDays: 7, removed: []string{web1Old, web1Mid, web2Old}},
+		{name: "both rules have to allow removal", keepDays: 20, keepLast: 1, removed: []string{web1Old, web2Old}},
+		{name: "dry run only reports", keepLast: 1, dryRun: true, removed: []string{web1Old, web1Mid, web2Old}},
+		{name: "no rules", removed: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir, stateDir := t.TempDir(), t.TempDir()
+			files := make(map[string]time.Duration)
+			for _, f := range all {
+				files[f] = 0
+			}
+			paths := writeSnapshots(t, dataDir, files, 10)
+
+			// The ledger has read everything but web3's snapshot
+			idx, err := history.LoadDedupIndex(history.IndexPath(stateDir, "ledger"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range all {
+				if f != unseen {
+					idx.MarkSeen(paths[f])
+				}
+			}
+			err = idx.Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := pruneSnapshots(dataDir, stateDir, tt.keepDays, tt.keepLast, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]bool)
+			for _, f := range tt.removed {
+				want[paths[f]] = true
+			}
+			if len(removed) != len(want) {
+				t.Errorf("removed %q, want %d files", removed, len(want))
+			}
+			for _, path := range removed {
+				if !want[path] {
+					t.Errorf("removed %s", filepath.Base(path))
+				}
+			}
+
+			left := strings.Join(remaining(t, dataDir), "\n")
+			for _, f := range all {
+				gone := !strings.Contains(left, f)
+				if gone != (want[paths[f]] && !tt.dryRun) {
+					t.Errorf("%s removed: %v", f, gone)
+				}
+			}
+		})
+	}
+}
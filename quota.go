@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// byteSize is a flag.Value accepting sizes such as 500MB or 2GiB
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.TrimSpace(value)
+	scale := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(value), strings.ToUpper(unit.suffix)) {
+			value = strings.TrimSpace(value[:len(value)-len(unit.suffix)])
+			scale = unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+
+	*b = byteSize(n * float64(scale))
+	return nil
+}
+
+func (b *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return b.Set(value)
+}
+
+type snapshotFile struct {
+	path string
+	size int64
+	info os.FileInfo
+}
+
+// listSnapshots returns the snapshot files under dataDir, oldest first, and
+// the total size of everything under dataDir
+func listSnapshots(dataDir string) ([]snapshotFile, int64, error) {
+	var snapshots []snapshotFile
+	var total int64
+
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		total += info.Size()
+		if history.IsSnapshotFile(path) {
+			snapshots = append(snapshots, snapshotFile{path: path, size: info.Size(), info: info})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].info.ModTime().Before(snapshots[j].info.ModTime())
+	})
+
+	return snapshots, total, nil
+}
+
+// enforceQuota evicts snapshots according to policy until dataDir fits in
+// quota. Only raw snapshots are removed; summaries and the state directory
+// are never touched. A zero quota disables enforcement.
+func enforceQuota(dataDir string, quota int64, policy string) error {
+	if quota <= 0 || policy == "none" {
+		return nil
+	}
+	if policy != "oldest" {
+		return fmt.Errorf("unknown eviction policy %q", policy)
+	}
+
+	snapshots, total, err := listSnapshots(dataDir)
+	if err != nil {
+		return err
+	}
+
+	if total > quota*9/10 {
+		slog.Warn("Data directory is close to its quota", "bytes", total, "quota", quota)
+	}
+
+	for _, s := range snapshots {
+		if total <= quota {
+			break
+		}
+		err := os.Remove(s.path)
+		if err != nil {
+			return err
+		}
+		total -= s.size
+		slog.Info("Evicted snapshot to stay within quota", "path", s.path)
+	}
+
+	if total > quota {
+		slog.Warn("Data directory is over quota after evicting every snapshot", "bytes", total, "quota", quota)
+	}
+
+	return nil
+}
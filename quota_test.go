@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSnapshots creates the files under dir, each holding size bytes and
+// modified age ago, and returns their paths by name
+func writeSnapshots(t *testing.T, dir string, files map[string]time.Duration, size int) map[string]string {
+	t.Helper()
+	paths := make(map[string]string)
+	for name, age := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o600)
+		}
+		if err == nil {
+			mtime := time.Now().Add(-age)
+			err = os.Chtimes(path, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = path
+	}
+	return paths
+}
+
+// remaining lists the files left under dir, relative to it
+func remaining(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func TestEnforceQuota(t *testing.T) {
+	files := map[string]time.Duration{
+		"ops/bash_history_web1_20240101_000000.txt": 3 * time.Hour,
+		"ops/bash_history_web1_20240102_000000.txt": 2 * time.Hour,
+		"ops/bash_history_web2_20240103_000000.txt": time.Hour,
+		"ops/summary.txt": 4 * time.Hour,
+	}
+
+	tests := []struct {
+		name    string
+		quota   int64
+		policy  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "under quota",
+			quota:  400,
+			policy: "oldest",
+			want:   []string{"ops/bash_history_web1_20240101_000000.txt", "ops/bash_history_web1_20240102_000000.txt", "ops/bash_history_web2_20240103_000000.txt", "ops/summary.txt"},
+		},
+		{
+			name:   "evicts the oldest snapshots first",
+			quota:  250,
+			policy: "oldest",
+			want:   []string{"ops/bash_history_web2_20240103_000000.txt", "ops/summary.txt"},
+		},
+		{
+			name:   "never evicts summaries",
+			quota:  10,
+			policy: "oldest",
+			want:   []string{"ops/summary.txt"},
+		},
+		{
+			name:   "disabled",
+			quota:  10,
+			policy: "none",
+			want:   []string{"ops/bash_history_web1_20240101_000000.txt", "ops/bash_history_web1_20240102_000000.txt", "ops/bash_history_web2_20240103_000000.txt", "ops/summary.txt"},
+		},
+		{
+			name:    "unknown policy",
+			quota:   10,
+			policy:  "largest",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeSnapshots(t, dir, files, 100)
+
+			err := enforceQuota(dir, tt.quota, tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := remaining(t, dir); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("left %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "1024", want: 1024},
+		{value: "500MB", want: 500e6},
+		{value: "2GiB", want: 2 << 30},
+		{value: "1.5 k", want: 1536},
+		{value: "10b", want: 10},
+		{value: "-1MB", wantErr: true},
+		{value: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		var b byteSize
+		err := b.Set(tt.value)
+		if (err != nil) != tt.wantErr || !tt.wantErr && int64(b) != tt.want {
+			t.Errorf("Set(%q) = %d, %v, want %d", tt.value, b, err, tt.want)
+		}
+	}
+}
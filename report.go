@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileSummary is the line count of one snapshot read by a run
+type FileSummary struct {
+	Path  string `json:"path"`
+	Lines int    `json:"lines"`
+}
+
+// SummaryReport is what `summarize` emits with --output json
+type SummaryReport struct {
+	Timestamp   time.Time     `json:"timestamp"`
+	Files       []FileSummary `json:"files"`
+	UniqueLines int           `json:"unique_lines"`
+	NewCommands []string      `json:"new_commands"`
+
+	// NewByHost counts the lines each host's summary gained
+	NewByHost map[string]int `json:"new_by_host,omitempty"`
+
+	// AddedByHost holds those lines, for `tarsnap diff`
+	AddedByHost map[string][]string `json:"-"`
+
+	// RanByHost holds the commands each host ran since its last snapshot,
+	// before any filter, for -watch
+	RanByHost map[string][]string `json:"-"`
+}
+
+// FetchReport is what `fetch` emits with --output json
+type FetchReport struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Results   []FetchResult `json:"results"`
+	Summary   SummaryReport `json:"summary"`
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// runSummarizeCommand implements `tarsnap summarize`, which updates the
+// summaries from data already on disk without fetching anything
+func runSummarizeCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("summarize", flag.ExitOnError)
+	fs.StringVar(&config.Output, "output", config.Output, "Output format: text or json")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q, usage: tarsnap summarize [-output text|json]", fs.Arg(0))
+	}
+
+	localDir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		return err
+	}
+
+	// A fetch summarizing at the same time would append the same lines
+	unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+	if err != nil {
+		return fmt.Errorf("another run is in progress: %w", err)
+	}
+	defer unlock()
+
+	report, err := summarize(config, localDir)
+	if err != nil {
+		return err
+	}
+
+	switch config.Output {
+	case "json":
+		return writeJSON(os.Stdout, report)
+	case "text":
+		slog.Info("Summarized", "files", len(report.Files), "unique_lines", report.UniqueLines, "new_commands", len(report.NewCommands))
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", config.Output)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// CommandResult is one line of the ~/.tarsnap_results sidecar written by the
+// helper that onboard --results installs
+type CommandResult struct {
+	Time     time.Time
+	ExitCode int
+	Duration time.Duration
+	Command  string
+}
+
+// fetchUserResults copies the sidecar next to the history snapshot. Hosts
+// without the helper simply have no sidecar, which isn't an error.
+func fetchUserResults(remote fetch.Remote, user, ip, userDir string) {
+	localFile := fmt.Sprintf("%s/results_%s_%s.tsv", userDir, schedule.SanitizeHost(ip), time.Now().Format("20060102_150405"))
+	_, err := remote.Copy(user, ip, "~/.tarsnap_results", localFile)
+	if err != nil && !strings.Contains(err.Error(), "No such file") {
+		slog.Warn("Failed to fetch exit status log", "target", user+"@"+ip, "err", err)
+	}
+}
+
+func isResultsFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, "results_") && strings.HasSuffix(name, ".tsv")
+}
+
+func parseCommandResult(line string) (CommandResult, bool) {
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) != 4 {
+		return CommandResult{}, false
+	}
+
+	epoch, err1 := strconv.ParseInt(fields[0], 10, 64)
+	code, err2 := strconv.Atoi(fields[1])
+	secs, err3 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return CommandResult{}, false
+	}
+
+	return CommandResult{
+		Time:     time.Unix(epoch, 0),
+		ExitCode: code,
+		Duration: time.Duration(secs) * time.Second,
+		Command:  fields[3],
+	}, true
+}
+
+// loadCommandResults reads every sidecar under dataDir. Sidecars are
+// cumulative, so results seen in more than one fetch are returned once.
+func loadCommandResults(dataDir string) ([]CommandResult, error) {
+	seen := make(map[string]struct{})
+	var results []CommandResult
+
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isResultsFile(path) {
+			return nil
+		}
+
+		_, lines, err := history.ReadLines(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if _, ok := seen[line]; ok {
+				continue
+			}
+			seen[line] = struct{}{}
+			if r, ok := parseCommandResult(line); ok {
+				results = append(results, r)
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Time.Before(results[j].Time) })
+	return results, err
+}
+
+// printFailedCommands joins the sidecar results to the collected history and
+// prints the commands whose most recent run exited non-zero
+func printFailedCommands(w io.Writer, dataDir string) error {
+	results, err := loadCommandResults(dataDir)
+	if err != nil {
+		return err
+	}
+
+	latest := make(map[string]CommandResult)
+	for _, r := range results {
+		latest[history.NormalizeLine(r.Command)] = r
+	}
+
+	lines, err := history.UniqueLines(dataDir, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		r, ok := latest[line]
+		if !ok || r.ExitCode == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%s\texit=%d\t%s\t%s\n", r.Time.Format(time.RFC3339), r.ExitCode, r.Duration, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
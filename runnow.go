@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// runRunNowCommand implements `tarsnap run-now [label]`: it starts the
+// installed launchd or systemd job right away and follows its log until the
+// run finishes, to check an install without waiting for the schedule
+func runRunNowCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("run-now", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Minute, "Give up following the run after this long")
+	fs.Parse(args)
+
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		return fmt.Errorf("run-now is not supported on %s", runtime.GOOS)
+	}
+	job, err := installedJob(config, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	logFile := jobLogPath(job)
+	var offset int64
+	if fi, err := os.Stat(logFile); err == nil {
+		offset = fi.Size()
+	}
+
+	if config.DryRun {
+		if runtime.GOOS == "linux" {
+			runner.PrintDryRun("systemctl", "--user", "start", "--no-block", job.Label+".service")
+		} else {
+			runner.PrintDryRun("launchctl", "kickstart", job.Label)
+		}
+		return nil
+	}
+
+	cmdRunner := runner.Exec{}
+	var finished func() (bool, error)
+	if runtime.GOOS == "linux" {
+		err = schedule.StartUnit(cmdRunner, job.Label)
+		finished = func() (bool, error) {
+			state, result, err := schedule.UnitState(cmdRunner, job.Label)
+			if err != nil || state == "activating" || state == "active" {
+				return false, err
+			}
+			if state == "failed" || (result != "" && result != "success") {
+				return true, fmt.Errorf("%s %s: %s", job.Label, state, result)
+			}
+			return true, nil
+		}
+	} else {
+		err = schedule.NewLaunchctl(cmdRunner, config.LegacyLaunchctl).Kickstart(job.Label)
+		// a quick run may be over before the first poll sees its PID
+		started, kicked := false, time.Now()
+		finished = func() (bool, error) {
+			entries, err := schedule.List(cmdRunner)
+			if err != nil {
+				return false, err
+			}
+			entry, ok := entries[job.Label]
+			if !ok {
+				return true, fmt.Errorf("%s is no longer loaded", job.Label)
+			}
+			if entry.PID != "" {
+				started = true
+				return false, nil
+			}
+			if !started && time.Since(kicked) < 5*time.Second {
+				return false, nil
+			}
+			if entry.Status != "0" {
+				return true, fmt.Errorf("%s exited with status %s", job.Label, entry.Status)
+			}
+			return true, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Started %s, following %s\n", job.Label, logFile)
+
+	deadline := time.Now().Add(*timeout)
+	for {
+		done, err := finished()
+		offset = copyLogFrom(os.Stdout, logFile, offset)
+		if done || err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still running after %s", job.Label, *timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// installedJob returns the launchd job or systemd unit labeled label, or
+// the only one installed when label is empty
+func installedJob(config Config, label string) (schedule.Job, error) {
+	listJobs, jobDir := schedule.ListJobs, schedule.LaunchAgentsDir
+	if runtime.GOOS == "linux" {
+		listJobs, jobDir = schedule.ListUnits, schedule.UnitDir
+	}
+	dir, err := jobDir()
+	if err != nil {
+		return schedule.Job{}, err
+	}
+	jobs, err := listJobs(dir, config.Label)
+	if err != nil {
+		return schedule.Job{}, err
+	}
+	return pickJob(jobs, label)
+}
+
+// jobLogPath returns the log the job writes: its --log-file, or launchd's
+// StandardOutPath
+func jobLogPath(job schedule.Job) string {
+	logFile := job.Flag("--log-file")
+	if logFile == "" {
+		logFile = job.LogPath
+	}
+	if logFile != "" && !filepath.IsAbs(logFile) {
+		logFile = filepath.Join(job.Cwd, logFile)
+	}
+	return logFile
+}
+
+// pickJob returns the job labeled label, or the only job when label is empty
+func pickJob(jobs []schedule.Job, label string) (schedule.Job, error) {
+	if len(jobs) == 0 {
+		return schedule.Job{}, errors.New("no job installed, run setup first")
+	}
+
+	var labels []string
+	for _, job := range jobs {
+		if job.Label == label || (label == "" && len(jobs) == 1) {
+			return job, nil
+		}
+		labels = append(labels, job.Label)
+	}
+	if label == "" {
+		return schedule.Job{}, fmt.Errorf("several jobs installed, pick one of: %s", strings.Join(labels, ", "))
+	}
+	return schedule.Job{}, fmt.Errorf("no job labeled %q, installed: %s", label, strings.Join(labels, ", "))
+}
+
+// copyLogFrom writes what path gained past offset to w and returns the new
+// offset. A log that shrank, because it was rotated, is read from the start.
+func copyLogFrom(w io.Writer, path string, offset int64) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return offset
+	}
+	if fi.Size() < offset {
+		offset = 0
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset
+	}
+	n, _ := io.Copy(w, f)
+	return offset + n
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// RunRecord describes one fetch run. Records are appended to runs.jsonl in
+// the state directory.
+type RunRecord struct {
+	Version    string                  `json:"version,omitempty"`
+	Start      time.Time               `json:"start"`
+	End        time.Time               `json:"end"`
+	Hosts      []string                `json:"hosts"`
+	Errors     map[string]string       `json:"errors,omitempty"`
+	Metadata   map[string]HostMetadata `json:"metadata,omitempty"`
+	CatchUp    bool                    `json:"catch_up,omitempty"`
+	Gap        time.Duration           `json:"gap,omitempty"`
+	MissedRuns int                     `json:"missed_runs,omitempty"`
+}
+
+func runsPath(stateDir string) string {
+	return filepath.Join(stateDir, "runs.jsonl")
+}
+
+// lastRunRecord returns the most recent record, or nil if there are none
+func lastRunRecord(stateDir string) (*RunRecord, error) {
+	file, err := os.Open(runsPath(stateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last *RunRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec RunRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		last = &rec
+	}
+
+	return last, scanner.Err()
+}
+
+func appendRunRecord(stateDir string, rec RunRecord) error {
+	err := os.MkdirAll(stateDir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(runsPath(stateDir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// missedRuns returns how many runs the installed schedule had due between
+// the runs started at last and now. ok is false when the run wasn't
+// started by the schedule, or the schedule is a systemd calendar, which
+// isn't parsed here and catches up by itself with -persistent.
+func missedRuns(config Config, last, now time.Time) (missed int, ok bool) {
+	switch {
+	case !config.Scheduled || config.OnCalendar != "":
+		return 0, false
+	case config.Schedule != "":
+		intervals, err := schedule.Parse(config.Schedule)
+		if err != nil {
+			return 0, false
+		}
+		// This run is the one due in the minute it started
+		return schedule.Due(intervals, last, now.Add(-time.Minute)), true
+	case config.Delay > 0:
+		gap := now.Sub(last)
+		if gap < config.Delay+config.Delay/2 {
+			return 0, true
+		}
+		return max(int(gap/config.Delay)-1, 1), true
+	}
+	return 0, false
+}
+
+// beginRun starts a run record and checks how long it has been since the
+// previous run. When the schedule had runs due in between, the machine
+// most likely slept through them, so this run is marked as a catch-up and
+// the missed runs are recorded.
+func beginRun(config Config, now time.Time) RunRecord {
+	rec := RunRecord{Version: buildInfo().Version, Start: now}
+
+	last, err := lastRunRecord(config.StateDir)
+	if err != nil {
+		slog.Warn("Failed to read run records", "err", err)
+		return rec
+	}
+	if last == nil {
+		return rec
+	}
+
+	missed, ok := missedRuns(config, last.Start, now)
+	if !ok || missed == 0 {
+		return rec
+	}
+
+	rec.CatchUp = true
+	rec.Gap = now.Sub(last.Start)
+	rec.MissedRuns = missed
+	slog.Warn("Missed scheduled runs, catching up now", "since_last", rec.Gap.Round(time.Second), "missed", rec.MissedRuns)
+
+	return rec
+}
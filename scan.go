@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// scanResult is what scanHistoryFiles learned from the files it read
+type scanResult struct {
+	Files []FileSummary
+	Cache history.LineCache
+}
+
+// scanHistoryFiles reads the history files under dataDir that read accepts,
+// in parallel, counting their lines and keeping them for the summaries.
+// Files already summarized aren't opened, which for encrypted snapshots
+// would mean decrypting them on every run.
+func scanHistoryFiles(dataDir string, workers int, read func(path string) bool) (scanResult, error) {
+	var paths []string
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && history.IsHistoryFile(path) && read(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return scanResult{}, fmt.Errorf("failed to walk through files: %w", err)
+	}
+
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	files := make([]FileSummary, len(paths))
+	cached := make([][]string, len(paths))
+	errs := make([]error, len(paths))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				files[j].Path = paths[j]
+				errs[j] = streamLines(paths[j], func(line string) {
+					files[j].Lines++
+					cached[j] = append(cached[j], line)
+				})
+			}
+		}()
+	}
+
+	for j := range paths {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := scanResult{Files: files, Cache: make(history.LineCache)}
+	for j, err := range errs {
+		if err != nil {
+			return result, err
+		}
+		result.Cache[paths[j]] = cached[j]
+	}
+	return result, nil
+}
+
+// streamLines calls fn for every line of the history file at path, with
+// bash timestamp comments joined to their command like history.ReadLines
+func streamLines(path string, fn func(line string)) error {
+	file, err := history.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var pairer history.TimestampPairer
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line, ok := pairer.Pair(scanner.Text()); ok {
+			fn(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to scan %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// SearchMatch is a command matching a search, with where it was first seen
+type SearchMatch struct {
+	Host    string    `json:"host"`
+	User    string    `json:"user"`
+	When    time.Time `json:"first_seen"`
+	File    string    `json:"file"`
+	Command string    `json:"command"`
+}
+
+// searchHistory finds the commands matching re in the snapshots under
+// dataDir. Each command is reported once per host and user, from the
+// earliest snapshot holding it. Empty host and user match every host and
+// user; entries outside [since, until] are skipped, and so are snapshots a
+// non-nil keep rejects.
+func searchHistory(dataDir string, re *regexp.Regexp, keep func(path string) bool, host, user string, since, until time.Time) ([]SearchMatch, error) {
+	first := make(map[string]*SearchMatch)
+
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !history.IsSnapshotFile(path) || keep != nil && !keep(path) {
+			return nil
+		}
+
+		fileHost := snapshotHost(path)
+		fileUser := snapshotUser(dataDir, path)
+		if host != "" && fileHost != schedule.SanitizeHost(host) || user != "" && fileUser != user {
+			return nil
+		}
+
+		taken, _ := history.SnapshotTime(path)
+		_, lines, err := history.ReadLines(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			entry := history.ParseLine(line)
+			if !re.MatchString(entry.Command) {
+				continue
+			}
+			when := entry.Timestamp
+			if when.IsZero() {
+				when = taken
+			}
+			if !since.IsZero() && when.Before(since) || !until.IsZero() && when.After(until) {
+				continue
+			}
+
+			key := fileHost + "\x00" + fileUser + "\x00" + entry.Command
+			if m, ok := first[key]; ok && !when.Before(m.When) {
+				continue
+			}
+			first[key] = &SearchMatch{Host: fileHost, User: fileUser, When: when, File: path, Command: entry.Command}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]SearchMatch, 0, len(first))
+	for _, m := range first {
+		matches = append(matches, *m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].When.Equal(matches[j].When) {
+			return matches[i].When.Before(matches[j].When)
+		}
+		if matches[i].Host != matches[j].Host {
+			return matches[i].Host < matches[j].Host
+		}
+		return matches[i].Command < matches[j].Command
+	})
+	return matches, nil
+}
+
+func printSearchMatches(w io.Writer, matches []SearchMatch) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIRST SEEN\tHOST\tUSER\tFILE\tCOMMAND")
+	for _, m := range matches {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", m.When.Format("2006-01-02 15:04"), m.Host, m.User, filepath.Base(m.File), m.Command)
+	}
+	return tw.Flush()
+}
+
+// runSearchCommand implements `tarsnap search <pattern>`. Flags may come
+// before or after the pattern.
+func runSearchCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	host := fs.String("host", config.Host, "Only search snapshots fetched from this host")
+	user := fs.String("user", "", "Only search this remote user's snapshots")
+	sinceArg := fs.String("since", "", "Only match commands run at or after this time")
+	untilArg := fs.String("until", "", "Only match commands run at or before this time")
+	ignoreCase := fs.Bool("i", false, "Match case-insensitively")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: tarsnap search [flags] <pattern> [flags]")
+	}
+	pattern := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q after the pattern", fs.Arg(0))
+	}
+
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	var since, until time.Time
+	if *sinceArg != "" {
+		since, err = parseTimeArg(*sinceArg)
+		if err != nil {
+			return err
+		}
+	}
+	if *untilArg != "" {
+		until, err = parseTimeArg(*untilArg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// -tag limits the snapshots searched; -host is already applied above
+	config.Host = ""
+	keep, err := historyFilter(config)
+	if err != nil {
+		return err
+	}
+
+	matches, err := searchHistory(config.DataDir, re, keep, *host, *user, since, until)
+	if err != nil {
+		return err
+	}
+	if config.Output == "json" {
+		return writeJSON(os.Stdout, matches)
+	}
+	return printSearchMatches(os.Stdout, matches)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/secrets"
+)
+
+// resolveSecrets replaces the settings given as secrets references, such as
+// keychain:tarsnap-webhook, with the secrets they refer to. The ssh password
+// and passphrase are left as references for the askpass helper to read
+// only when ssh prompts.
+func resolveSecrets(config Config, cmdRunner runner.Runner) (Config, error) {
+	for _, field := range []*string{&config.WebhookURL, &config.HealthcheckURL, &config.AWSAccessKey, &config.AWSSecretKey} {
+		value, err := secrets.Resolve(cmdRunner, *field)
+		if err != nil {
+			return config, err
+		}
+		*field = value
+	}
+	return config, nil
+}
+
+// setEncryptKey reads the age identity that key is a secrets reference to,
+// or the file holding it, and hands it to the history package
+func setEncryptKey(key string, cmdRunner runner.Runner) error {
+	identity := key
+	if secrets.IsRef(key) {
+		var err error
+		identity, err = secrets.Resolve(cmdRunner, key)
+		if err != nil {
+			return err
+		}
+	} else {
+		data, err := os.ReadFile(key)
+		if err != nil {
+			return err
+		}
+		identity = string(data)
+	}
+	return history.SetKey(identity)
+}
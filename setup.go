@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+func setup(config Config, cmdRunner runner.Runner) error {
+	var absCwd string
+
+	// If --show-full flag is provided, only show the unique list of bash lines
+	if config.ShowFull {
+		if config.Chronological {
+			return printChronological(os.Stdout, config)
+		}
+		uniqueLines, err := selectBashLines(config)
+		if err != nil {
+			return err
+		}
+		for _, line := range uniqueLines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+
+	// Expand cwd into an absolute path
+	absCwd, err := filepath.Abs(config.CWD)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	ips, err := resolveIPs(config, cmdRunner)
+	if err != nil {
+		return err
+	}
+
+	if len(ips) == 0 || ips[0] == "" {
+		return errors.New("cound not get ip, quitting")
+	}
+	ip := ips[0]
+
+	tmpl, err := template.New("plist").Parse(schedule.PlistTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to create template: %w", err)
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	absExePath, err := filepath.Abs(exePath)
+	if err != nil {
+		return err
+	}
+
+	exeDir := filepath.Dir(absExePath)
+	slog.Debug("Resolved executable", "path", absExePath)
+
+	// The host is sanitized so IPv6 colons and the like stay out of the
+	// label and the plist name
+	launctlTask := schedule.JobLabel(config.Label, ip)
+
+	LaunchAgentsDir, err := schedule.LaunchAgentsDir()
+	if err != nil {
+		return err
+	}
+
+	// concatenate cwd with the plist file name
+	plist := fmt.Sprintf("%s/%s.plist", LaunchAgentsDir, launctlTask)
+
+	// Get the base name
+	baseName := filepath.Base(plist)
+
+	// Remove the extension
+	baseNameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+
+	// The job logs to its own rotated file, named after its label so jobs
+	// don't share one. launchd's stdout/stderr capture appends to the same
+	// file, so anything that escapes the logger is rotated away with it
+	// instead of piling up in /tmp.
+	logFile := config.LogFile
+	if logFile == "" {
+		logFile, err = defaultJobLogPath(config.StateDir, launctlTask)
+		if err != nil {
+			return err
+		}
+	}
+	logFile, err = filepath.Abs(logFile)
+	if err != nil {
+		return err
+	}
+	if !config.DryRun {
+		err = os.MkdirAll(filepath.Dir(logFile), 0o700)
+		if err != nil {
+			return err
+		}
+	}
+	// The job gets absolute data and state directories so it uses the same
+	// ones as the install no matter its working directory
+	dataDir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		return err
+	}
+	stateDir, err := filepath.Abs(config.StateDir)
+	if err != nil {
+		return err
+	}
+	args := []string{
+		absExePath,
+		"--data-dir", dataDir,
+		"--state-dir", stateDir,
+		"--log-file", logFile,
+		"--log-level", config.LogLevel,
+		"--log-format", config.LogFormat,
+		"--log-max-size", config.LogMaxSize.String(),
+		"--log-keep", strconv.Itoa(config.LogKeep),
+		"--log-max-age", config.LogMaxAge.String(),
+		"--scheduled",
+	}
+	extra, err := jobArgs(config)
+	if err != nil {
+		return err
+	}
+	args = append(args, extra...)
+
+	var env []schedule.EnvVar
+	for _, kv := range config.JobEnv {
+		e, err := schedule.ParseEnv(kv)
+		if err != nil {
+			return err
+		}
+		env = append(env, e)
+	}
+
+	if runtime.GOOS == "linux" {
+		return schedule.InstallUnits(cmdRunner, schedule.UnitOptions{
+			Name:       launctlTask,
+			Args:       args,
+			WorkingDir: absCwd,
+			Delay:      config.Delay,
+			Schedule:   config.Schedule,
+			Env:        env,
+			OnCalendar: config.OnCalendar,
+			Persistent: config.Persistent,
+			DryRun:     config.DryRun,
+		})
+	}
+
+	if runtime.GOOS == "windows" {
+		if len(env) > 0 {
+			slog.Warn("Task Scheduler tasks can't set environment variables, ignoring -job-env; set them for the user instead")
+		}
+		return schedule.InstallTask(cmdRunner, schedule.TaskOptions{
+			Name:       launctlTask,
+			Args:       args,
+			WorkingDir: absCwd,
+			Delay:      config.Delay,
+			Schedule:   config.Schedule,
+			StateDir:   config.StateDir,
+			DryRun:     config.DryRun,
+		})
+	}
+
+	data := schedule.PlistData{
+		Label:         baseNameWithoutExt,
+		IP:            ip,
+		StartInterval: strconv.Itoa(int(config.Delay.Seconds())),
+		Args:          args,
+		Path:          exeDir,
+		Cwd:           absCwd,
+		LogPath:       logFile,
+		Env:           env,
+
+		RunAtLoad:        config.RunAtLoad,
+		ThrottleInterval: config.ThrottleInterval,
+		Nice:             config.Nice,
+		LowPriorityIO:    config.LowPriorityIO,
+	}
+	data.KeepAlive, err = schedule.ParseKeepAlive(config.KeepAlive)
+	if err != nil {
+		return err
+	}
+	err = data.Validate()
+	if err != nil {
+		return err
+	}
+
+	if config.Schedule != "" {
+		data.CalendarIntervals, err = schedule.Parse(config.Schedule)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A job installed earlier from this directory for another address is
+	// replaced rather than left to run alongside the new one
+	launchctl := schedule.NewLaunchctl(cmdRunner, config.LegacyLaunchctl)
+	err = schedule.ReplaceStaleJobs(launchctl, LaunchAgentsDir, config.Label, launctlTask, absCwd, config.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		fmt.Printf("[dry-run] would write %s:\n", plist)
+		err = tmpl.Execute(os.Stdout, data)
+		if err != nil {
+			return fmt.Errorf("failed to execute template: %w", err)
+		}
+		runner.PrintDryRun("plutil", "-lint", plist)
+		runner.PrintDryRun("launchctl", launchctl.LoadArgs(plist)...)
+		runner.PrintDryRun("launchctl", "list")
+		return nil
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	return schedule.InstallPlist(launchctl, launctlTask, plist, rendered.Bytes())
+}
+
+// defaultJobLogPath is ~/Library/Logs/tarsnap/<label>.log on macOS, where
+// Console finds it, and <label>.log in the state directory elsewhere
+func defaultJobLogPath(stateDir, label string) (string, error) {
+	if runtime.GOOS != "darwin" {
+		return filepath.Join(stateDir, label+".log"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "Logs", "tarsnap", label+".log"), nil
+}
+
+// installOnlyFlags are flags of the install itself, or already passed by
+// setup, that the scheduled job must not repeat
+var installOnlyFlags = map[string]bool{
+	"install": true, "dry-run": true, "force-flags": true, "force-config": true,
+	"job-args": true, "job-env": true, "refresh-ip": true, "analytics": true, "show-full": true,
+	"data-dir": true, "state-dir": true, "log-file": true, "log-level": true,
+	"log-format": true, "log-max-size": true, "log-keep": true, "log-max-age": true,
+	"scheduled": true,
+}
+
+// jobArgs returns the arguments the scheduled job runs with after the ones
+// setup always passes: config.JobArgs when given, otherwise the flags this
+// install was run with, as typed, so a job installed with --config or
+// --users runs with them too
+func jobArgs(config Config) ([]string, error) {
+	if config.JobArgs != "" {
+		args, err := runner.SplitArgs(config.JobArgs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -job-args: %w", err)
+		}
+		return args, nil
+	}
+	return invocationFlags(os.Args[1:]), nil
+}
+
+// invocationFlags returns the flags in cmdline, each with its value,
+// leaving out installOnlyFlags and stopping at the first argument that
+// isn't a flag
+func invocationFlags(cmdline []string) []string {
+	var args []string
+	for i := 0; i < len(cmdline); i++ {
+		arg := cmdline[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := flag.Lookup(name)
+		if f == nil {
+			continue
+		}
+		group := []string{arg}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && bf.IsBoolFlag()) && i+1 < len(cmdline) {
+			i++
+			group = append(group, cmdline[i])
+		}
+		if !installOnlyFlags[name] {
+			args = append(args, group...)
+		}
+	}
+	return args
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// snapshotNameRe splits a snapshot file name into host and timestamp. Files
+// written before hosts were recorded in the name only carry the timestamp.
+var snapshotNameRe = regexp.MustCompile(`^bash_history_(?:(.+)_)?(\d{8}_\d{6})\.txt(?:\.gz|\.zst)?(?:\.age)?$`)
+
+// snapshotHost returns the host a snapshot was fetched from, as sanitized
+// for file names by schedule.SanitizeHost. Snapshots named before hosts
+// were sanitized are mapped to the same name.
+func snapshotHost(p string) string {
+	m := snapshotNameRe.FindStringSubmatch(filepath.Base(p))
+	if m == nil || m[1] == "" {
+		return "unknown"
+	}
+	host := schedule.SanitizeHost(m[1])
+	if host == "" {
+		return "unknown"
+	}
+	return host
+}
+
+// hostFilter accepts the snapshots fetched from host
+func hostFilter(host string) func(p string) bool {
+	host = schedule.SanitizeHost(host)
+	return func(p string) bool { return snapshotHost(p) == host }
+}
+
+// hostSummaryName is the per-host counterpart of summary.txt
+func hostSummaryName(host string) string {
+	return "summary_" + host + ".txt"
+}
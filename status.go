@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// JobStatus is what `tarsnap status` reports for one installed job
+type JobStatus struct {
+	schedule.Job
+	Loaded     bool       `json:"loaded"`
+	PID        string     `json:"pid,omitempty"`
+	ExitStatus string     `json:"last_exit_status,omitempty"`
+	LastRun    *RunRecord `json:"last_run,omitempty"`
+
+	// Newest maps each host to the time of its newest snapshot
+	Newest map[string]time.Time  `json:"newest_snapshot,omitempty"`
+	Hosts  map[string]*HostState `json:"hosts,omitempty"`
+}
+
+// StatusReport is the output of `tarsnap status`
+type StatusReport struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Jobs      []JobStatus `json:"jobs"`
+}
+
+// newestSnapshots returns the time of the newest snapshot of every host
+// under dataDir
+func newestSnapshots(dataDir string) (map[string]time.Time, error) {
+	newest := make(map[string]time.Time)
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !history.IsSnapshotFile(path) {
+			return nil
+		}
+		taken, ok := history.SnapshotTime(path)
+		if !ok {
+			taken = info.ModTime()
+		}
+		host := snapshotHost(path)
+		if taken.After(newest[host]) {
+			newest[host] = taken
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return newest, nil
+	}
+	return newest, err
+}
+
+// jobDir resolves dir, relative to the job's working directory like the
+// job itself would
+func jobDir(job schedule.Job, dir string) string {
+	if filepath.IsAbs(dir) || job.Cwd == "" {
+		return dir
+	}
+	return filepath.Join(job.Cwd, dir)
+}
+
+func collectStatus(config Config, cmdRunner runner.Runner) (StatusReport, error) {
+	report := StatusReport{Timestamp: time.Now()}
+
+	dir, err := schedule.LaunchAgentsDir()
+	if err != nil {
+		return report, err
+	}
+	jobs, err := schedule.ListJobs(dir, config.Label)
+	if err != nil {
+		return report, err
+	}
+
+	// Without launchctl the jobs are still listed, just not their state
+	list, err := schedule.List(cmdRunner)
+	if err != nil {
+		slog.Warn("Failed to list loaded jobs", "err", err)
+	}
+
+	for _, job := range jobs {
+		st := JobStatus{Job: job}
+		if entry, ok := list[job.Label]; ok {
+			st.Loaded = true
+			st.PID = entry.PID
+			st.ExitStatus = entry.Status
+		}
+
+		st.LastRun, err = lastRunRecord(jobDir(job, config.StateDir))
+		if err != nil {
+			slog.Warn("Failed to read run records", "label", job.Label, "err", err)
+		}
+		st.Newest, err = newestSnapshots(jobDir(job, config.DataDir))
+		if err != nil {
+			slog.Warn("Failed to read snapshots", "label", job.Label, "err", err)
+		}
+		st.Hosts, err = loadHostStates(jobDir(job, config.StateDir))
+		if err != nil {
+			slog.Warn("Failed to read host state", "label", job.Label, "err", err)
+		}
+		report.Jobs = append(report.Jobs, st)
+	}
+	return report, nil
+}
+
+func printStatus(w io.Writer, report StatusReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tSCHEDULE\tLOADED\tLAST EXIT\tLAST RUN\tHOST\tNEWEST SNAPSHOT\tLAST SUCCESS\tFAILURES")
+	for _, st := range report.Jobs {
+		loaded, exit, lastRun := "no", "-", "never"
+		if st.Loaded {
+			loaded = "yes"
+			exit = st.ExitStatus
+		}
+		if st.PID != "" {
+			loaded = "running"
+		}
+		if st.LastRun != nil {
+			lastRun = st.LastRun.Start.Format("2006-01-02 15:04")
+			if len(st.LastRun.Errors) > 0 {
+				lastRun += fmt.Sprintf(" (%d failed)", len(st.LastRun.Errors))
+			}
+		}
+
+		// Snapshot names carry the sanitized host, so key the host states
+		// the same way to line the two up for IPv6 addresses
+		states := make(map[string]*HostState)
+		for host, hs := range st.Hosts {
+			states[schedule.SanitizeHost(host)] = hs
+		}
+
+		seen := make(map[string]bool)
+		var hosts []string
+		for host := range st.Newest {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+		for host := range states {
+			if !seen[host] {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		if len(hosts) == 0 {
+			hosts = []string{"-"}
+		}
+
+		for i, host := range hosts {
+			age, success, failures := "-", "-", "-"
+			if t, ok := st.Newest[host]; ok {
+				age = ago(report.Timestamp, t)
+			}
+			if hs, ok := states[host]; ok {
+				if !hs.LastSuccess.IsZero() {
+					success = ago(report.Timestamp, hs.LastSuccess)
+				}
+				failures = strconv.Itoa(hs.ConsecutiveFailures)
+			}
+			if i == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", st.Label, st.Schedule, loaded, exit, lastRun, host, age, success, failures)
+			} else {
+				fmt.Fprintf(tw, "\t\t\t\t\t%s\t%s\t%s\t%s\n", host, age, success, failures)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func ago(now, t time.Time) string {
+	return now.Sub(t).Round(time.Minute).String() + " ago"
+}
+
+// runStatusCommand implements `tarsnap status`
+func runStatusCommand(config Config) error {
+	report, err := collectStatus(config, runner.Exec{})
+	if err != nil {
+		return err
+	}
+	if config.Output == "json" {
+		return writeJSON(os.Stdout, report)
+	}
+	return printStatus(os.Stdout, report)
+}
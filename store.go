@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/fetch"
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// Store is somewhere fetched history is mirrored to. Keys are slash
+// separated paths relative to the data directory.
+type Store interface {
+	Put(key, localPath string) error
+	Get(key, localPath string) error
+
+	// List returns the keys starting with prefix, sorted
+	List(prefix string) ([]string, error)
+}
+
+// localStore keeps the mirror in a directory, such as a mounted network
+// share
+type localStore struct {
+	dir string
+}
+
+func (s localStore) Put(key, localPath string) error {
+	dest := filepath.Join(s.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(dest), 0o700)
+	if err != nil {
+		return err
+	}
+	return copyLocalFile(localPath, dest)
+}
+
+func (s localStore) Get(key, localPath string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0o700)
+	if err != nil {
+		return err
+	}
+	return copyLocalFile(filepath.Join(s.dir, filepath.FromSlash(key)), localPath)
+}
+
+func (s localStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && p == s.dir {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// copyLocalFile atomically copies src to dest
+func copyLocalFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := atomicfile.Create(dest, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// s3Store uploads to an S3 bucket with the aws CLI, like ec2Source
+type s3Store struct {
+	bucket    string
+	prefix    string
+	region    string
+	env       []string
+	cmdRunner runner.Runner
+}
+
+func (s s3Store) url(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, path.Join(s.prefix, key))
+}
+
+func (s s3Store) aws(args ...string) ([]byte, error) {
+	args = append([]string{"s3"}, args...)
+	if s.region != "" {
+		args = append(args, "--region", s.region)
+	}
+
+	slog.Debug("Executing command", "cmd", "aws "+strings.Join(args, " "))
+
+	var stderr strings.Builder
+	out, err := s.cmdRunner.Run(runner.Command{Name: "aws", Args: args, Env: s.env, Stderr: &stderr})
+	if err != nil {
+		return nil, fmt.Errorf("aws s3 %s: %w: %s", args[1], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s s3Store) Put(key, localPath string) error {
+	_, err := s.aws("cp", "--only-show-errors", localPath, s.url(key))
+	return err
+}
+
+func (s s3Store) Get(key, localPath string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0o700)
+	if err != nil {
+		return err
+	}
+	_, err = s.aws("cp", "--only-show-errors", s.url(key), localPath)
+	return err
+}
+
+func (s s3Store) List(prefix string) ([]string, error) {
+	root := s.prefix
+	if root != "" {
+		root += "/"
+	}
+	out, err := s.aws("ls", "--recursive", fmt.Sprintf("s3://%s/%s", s.bucket, root+prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, ok := s3ListKey(line)
+		if !ok {
+			continue
+		}
+		key = strings.TrimPrefix(key, root)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// s3ListKey returns the key of a line of `aws s3 ls --recursive`: date,
+// time and size padded with spaces, then the key, which may hold spaces
+func s3ListKey(line string) (string, bool) {
+	rest := strings.TrimSpace(line)
+	for i := 0; i < 3; i++ {
+		field := strings.Fields(rest)
+		if len(field) < 2 {
+			return "", false
+		}
+		rest = strings.TrimLeft(rest[len(field[0]):], " ")
+	}
+	return rest, rest != ""
+}
+
+// sftpStore keeps the mirror on a host reached with the sftp CLI, using the
+// same ssh settings as fetching does, which suits servers that only allow
+// SFTP
+type sftpStore struct {
+	target string
+	dir    string
+	remote fetch.Remote
+}
+
+// batch runs the sftp commands in cmds; a leading - lets one fail
+func (s sftpStore) batch(cmds ...string) (string, error) {
+	args := append(append([]string{"-q", "-b", "-"}, s.remote.Options...), s.target)
+
+	slog.Debug("Executing command", "cmd", "sftp "+strings.Join(args, " "), "batch", cmds)
+
+	var stderr strings.Builder
+	out, err := s.remote.Runner.Run(runner.Command{Name: "sftp", Args: args, Env: s.remote.Env, Stdin: strings.NewReader(strings.Join(cmds, "\n") + "\n"), Stderr: &stderr})
+	if err != nil {
+		return "", fmt.Errorf("sftp %s: %w: %s", s.target, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (s sftpStore) path(key string) string {
+	return path.Join(s.dir, key)
+}
+
+// sftpQuote quotes p for an sftp batch file
+func sftpQuote(p string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(p) + `"`
+}
+
+func (s sftpStore) Put(key, localPath string) error {
+	// sftp has no mkdir -p, so every parent is made, ignoring those that exist
+	var cmds []string
+	dir := path.Dir(s.path(key))
+	for d := dir; d != "." && d != "/" && d != s.dir; d = path.Dir(d) {
+		cmds = append([]string{"-mkdir " + sftpQuote(d)}, cmds...)
+	}
+	cmds = append(cmds, "put "+sftpQuote(localPath)+" "+sftpQuote(s.path(key)))
+	_, err := s.batch(cmds...)
+	return err
+}
+
+func (s sftpStore) Get(key, localPath string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0o700)
+	if err != nil {
+		return err
+	}
+	tmp, err := atomicfile.Create(localPath, 0o600)
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	_, err = s.batch("get " + sftpQuote(s.path(key)) + " " + sftpQuote(tmp.Name()))
+	if err == nil {
+		err = atomicfile.Rename(tmp.Name(), localPath)
+	}
+	return err
+}
+
+func (s sftpStore) List(prefix string) ([]string, error) {
+	var keys []string
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		rel := dirs[0]
+		dirs = dirs[1:]
+		out, err := s.batch("ls -la " + sftpQuote(s.path(rel)))
+		if err != nil {
+			return nil, err
+		}
+
+		// Long listings end with the name, which may hold spaces
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 9 || strings.HasPrefix(line, "sftp>") {
+				continue
+			}
+			name := path.Base(strings.Join(fields[8:], " "))
+			if name == "." || name == ".." {
+				continue
+			}
+			key := path.Join(rel, name)
+			if strings.HasPrefix(line, "d") {
+				if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key+"/") {
+					dirs = append(dirs, key)
+				}
+			} else if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// newStore picks the Store for a --store URL: s3://bucket/prefix,
+// sftp://user@host[:port]/dir, or a local directory as a path or file://
+// URL. An empty URL means none.
+func newStore(config Config, cmdRunner runner.Runner) (Store, error) {
+	if config.Store == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.Store)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store %q: %w", config.Store, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("store %q has no bucket", config.Store)
+		}
+		// Credentials from the config file, or the secret store they refer
+		// to, take precedence over the aws CLI's own
+		var env []string
+		if config.AWSAccessKey != "" {
+			env = []string{"AWS_ACCESS_KEY_ID=" + config.AWSAccessKey, "AWS_SECRET_ACCESS_KEY=" + config.AWSSecretKey}
+		}
+		return s3Store{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), region: config.AWSRegion, env: env, cmdRunner: cmdRunner}, nil
+	case "sftp":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("store %q has no host", config.Store)
+		}
+		remote := newRemote(config, u.Hostname(), cmdRunner)
+		if u.Port() != "" {
+			remote.Options = append(remote.Options, "-o", "Port="+u.Port())
+		}
+		target := u.Hostname()
+		if u.User != nil {
+			target = u.User.Username() + "@" + target
+		}
+		// A path after the host is relative to the login directory
+		// unless it starts with a second slash
+		dir := strings.TrimPrefix(u.Path, "/")
+		if dir == "" {
+			dir = "."
+		}
+		return sftpStore{target: target, dir: path.Clean(dir), remote: remote}, nil
+	case "file", "":
+		if u.Path == "" {
+			return nil, fmt.Errorf("store %q has no directory", config.Store)
+		}
+		dir, err := filepath.Abs(filepath.FromSlash(u.Path))
+		if err != nil {
+			return nil, err
+		}
+		return localStore{dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unsupported store %q, want s3://bucket/prefix, sftp://user@host/dir or a directory", config.Store)
+	}
+}
+
+// mirrorToStore uploads the snapshots fetched in this run and every summary
+// under localDir to the configured store
+func mirrorToStore(config Config, cmdRunner runner.Runner, localDir string, results []FetchResult) error {
+	store, err := newStore(config, cmdRunner)
+	if err != nil || store == nil {
+		return err
+	}
+
+	var paths []string
+	for _, r := range results {
+		if r.Err == nil && r.Path != "" {
+			paths = append(paths, r.Path)
+		}
+	}
+	summaries, err := filepath.Glob(filepath.Join(localDir, "summary*.txt*"))
+	if err != nil {
+		return err
+	}
+	paths = append(paths, summaries...)
+	for _, user := range config.Users {
+		summaries, err = filepath.Glob(filepath.Join(localDir, user, "summary.txt*"))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, summaries...)
+	}
+
+	// One failed upload shouldn't stop the rest from being mirrored
+	var errs []error
+	for _, p := range paths {
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = store.Put(filepath.ToSlash(rel), p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("Mirrored to store", "key", filepath.ToSlash(rel))
+	}
+
+	return errors.Join(errs...)
+}
+
+// runStoreCommand implements `tarsnap store ls|get`, reading back what was
+// mirrored to --store
+func runStoreCommand(config Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: tarsnap store ls [prefix] | get <key> [file]")
+	}
+	store, err := newStore(config, runner.Exec{})
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return errors.New("no store configured, set -store")
+	}
+
+	switch args[0] {
+	case "ls":
+		fs := flag.NewFlagSet("store ls", flag.ExitOnError)
+		fs.Parse(args[1:])
+		keys, err := store.List(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if config.Output == "json" {
+			return writeJSON(os.Stdout, keys)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return nil
+
+	case "get":
+		fs := flag.NewFlagSet("store get", flag.ExitOnError)
+		fs.Parse(args[1:])
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			return errors.New("usage: tarsnap store get <key> [file]")
+		}
+		// Keys are restored to where they came from in the data directory
+		// unless told otherwise
+		key := fs.Arg(0)
+		dest := fs.Arg(1)
+		if dest == "" {
+			dest = filepath.Join(config.DataDir, filepath.FromSlash(path.Clean("/"+key)))
+		}
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
+		err = store.Get(key, dest)
+		if err != nil {
+			return err
+		}
+		slog.Info("Restored from store", "key", key, "path", dest)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown store command %q", args[0])
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// summaryErrors are the per-user and per-host summaries that failed while
+// the combined one was brought up to date
+type summaryErrors struct {
+	errs []error
+}
+
+func (e *summaryErrors) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *summaryErrors) Unwrap() []error {
+	return e.errs
+}
+
+// summarize adds the snapshots the ledger hasn't seen yet to it and brings
+// the summary.txt files, built from the ledger, up to date. When only some
+// per-user or per-host summaries fail the error is a *summaryErrors and the
+// report is still complete otherwise.
+func summarize(config Config, localDir string) (SummaryReport, error) {
+	report := SummaryReport{Timestamp: time.Now()}
+
+	// Only the snapshots the ledger hasn't seen yet are read, once
+	idx, err := history.LoadDedupIndex(history.IndexPath(config.StateDir, "ledger"))
+	if err != nil {
+		return report, fmt.Errorf("failed to load dedup index: %w", err)
+	}
+	scan, err := scanHistoryFiles(localDir, 0, func(path string) bool {
+		return history.IsSnapshotFile(path) && !idx.Seen(path)
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Files = scan.Files
+
+	// Display the summary of data files
+	for _, f := range report.Files {
+		slog.Debug("Data file", "path", f.Path, "lines", f.Lines)
+	}
+
+	filter, err := newCommandFilter(config)
+	if err != nil {
+		return report, err
+	}
+
+	// The ledger keeps who ran each command, where and when; the summaries
+	// are the commands in it
+	ledger, added, ran, err := updateLedger(config, localDir, scan.Cache)
+	if err != nil {
+		return report, fmt.Errorf("ledger: %w", err)
+	}
+	report.RanByHost = ran
+	entries := ledger.Entries()
+	commands := func(entries []LedgerEntry, match func(e LedgerEntry) bool) []string {
+		var cmds []string
+		for _, e := range entries {
+			if match(e) {
+				cmds = append(cmds, e.Cmd)
+			}
+		}
+		return cmds
+	}
+	every := func(LedgerEntry) bool { return true }
+
+	// Generate summary.txt file containing unique list of bash lines
+	indexPath := history.IndexPath(config.StateDir, "all")
+	report.NewCommands, err = history.GenerateSummary(localDir, "summary.txt", indexPath, commands(entries, every), commands(added, every), filter)
+	if err != nil {
+		return report, err
+	}
+
+	// The index now holds every line in the summary
+	idx, err = history.LoadDedupIndex(indexPath)
+	if err != nil {
+		return report, fmt.Errorf("failed to load dedup index: %w", err)
+	}
+	report.UniqueLines = idx.Len()
+	slog.Info("Counted unique lines", "files", len(report.Files), "unique_lines", report.UniqueLines)
+
+	// A broken per-user or per-host summary shouldn't hide the others
+	var errs []error
+	for _, user := range config.allUsers() {
+		// Users nothing was ever fetched for have no directory yet
+		userDir := filepath.Join(localDir, user)
+		if _, err := os.Stat(userDir); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		byUser := func(e LedgerEntry) bool { return e.User == user }
+		_, err := history.GenerateSummary(userDir, "summary.txt", history.IndexPath(config.StateDir, "user-"+user), commands(entries, byUser), commands(added, byUser), filter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("summary for %s: %w", user, err))
+		}
+	}
+
+	hostSet := make(map[string]bool)
+	for _, e := range entries {
+		if e.Host != "unknown" {
+			hostSet[e.Host] = true
+		}
+	}
+	hosts := make([]string, 0, len(hostSet))
+	for host := range hostSet {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	report.NewByHost = make(map[string]int)
+	report.AddedByHost = make(map[string][]string)
+	for _, host := range hosts {
+		byHost := func(e LedgerEntry) bool { return e.Host == host }
+		added, err := history.GenerateSummary(localDir, hostSummaryName(host), history.IndexPath(config.StateDir, "host-"+host), commands(entries, byHost), commands(added, byHost), filter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("summary for %s: %w", host, err))
+		}
+		report.NewByHost[host] = len(added)
+		report.AddedByHost[host] = added
+	}
+
+	kept := ledger.Kept(filter)
+	err = writeToolSummaries(localDir, kept)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("tool summaries: %w", err))
+	}
+	if config.Changelog {
+		err = writeChangelog(localDir, kept)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("changelog: %w", err))
+		}
+	}
+
+	err = writeManifest(config.StateDir, localDir, config.ManifestKeep)
+	if err != nil {
+		slog.Error("Failed to write manifest", "err", err)
+	}
+
+	if len(errs) > 0 {
+		return report, &summaryErrors{errs: errs}
+	}
+	return report, nil
+}
+
+// selectBashLines returns the unique history lines, limited to the snapshots
+// carrying config.Tag and fetched from config.Host when those are set
+func selectBashLines(config Config) ([]string, error) {
+	keep, err := historyFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	return history.UniqueLines(config.DataDir, keep)
+}
+
+// selectCommandRuns returns a line for every time a command was run: the
+// lines of the newest snapshot of each host and user, since every snapshot
+// is a full copy of the history before it. The snapshots are limited like
+// selectBashLines.
+func selectCommandRuns(config Config) ([]string, error) {
+	keep, err := historyFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, _, err := listSnapshots(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := func(s snapshotFile) time.Time {
+		if t, ok := history.SnapshotTime(s.path); ok {
+			return t
+		}
+		return s.info.ModTime()
+	}
+	newest := make(map[string]snapshotFile)
+	for _, s := range snapshots {
+		if keep != nil && !keep(s.path) {
+			continue
+		}
+		stream := filepath.Dir(s.path) + "\x00" + snapshotHost(s.path)
+		if cur, ok := newest[stream]; !ok || taken(s).After(taken(cur)) {
+			newest[stream] = s
+		}
+	}
+
+	streams := make([]string, 0, len(newest))
+	for stream := range newest {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	var lines []string
+	for _, stream := range streams {
+		_, raw, err := history.ReadLines(newest[stream].path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range raw {
+			if !history.IsGarbage(line) {
+				lines = append(lines, history.NormalizeLine(line))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// historyFilter builds the file filter for config.Tag and config.Host; nil
+// when neither is set
+func historyFilter(config Config) (func(path string) bool, error) {
+	if config.Tag == "" && config.Host == "" {
+		return nil, nil
+	}
+
+	keep := func(path string) bool { return true }
+	if config.Tag != "" {
+		var err error
+		keep, err = tagFilter(config.StateDir, config.Tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Host != "" {
+		tagged, fromHost := keep, hostFilter(config.Host)
+		keep = func(path string) bool { return tagged(path) && fromHost(path) }
+	}
+	return keep, nil
+}
+
+// printChronological prints every unique command once, oldest first, with
+// the ISO 8601 time it was first seen. Shells that record timestamps supply
+// them; otherwise the time of the earliest snapshot holding the command is
+// used, and commands only known from a summary print "unknown".
+func printChronological(w io.Writer, config Config) error {
+	keep, err := historyFilter(config)
+	if err != nil {
+		return err
+	}
+	entries, err := history.UniqueEntries(config.DataDir, keep)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		when := "unknown"
+		if !e.Timestamp.IsZero() {
+			when = e.Timestamp.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", when, e.Command)
+	}
+	return nil
+}
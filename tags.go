@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/atomicfile"
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// Tag labels a single snapshot file or every snapshot taken within a time range
+type Tag struct {
+	Name     string    `json:"name"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Note     string    `json:"note,omitempty"`
+}
+
+// Matches reports whether the snapshot at path is covered by the tag
+func (t Tag) Matches(path string) bool {
+	if t.Snapshot != "" {
+		return filepath.Base(t.Snapshot) == filepath.Base(path)
+	}
+
+	taken, ok := history.SnapshotTime(path)
+	if !ok {
+		return false
+	}
+	if !t.From.IsZero() && taken.Before(t.From) {
+		return false
+	}
+	if !t.To.IsZero() && taken.After(t.To) {
+		return false
+	}
+
+	return true
+}
+
+func tagsPath(stateDir string) string {
+	return filepath.Join(stateDir, "tags.json")
+}
+
+func loadTags(stateDir string) ([]Tag, error) {
+	data, err := os.ReadFile(tagsPath(stateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []Tag
+	err = json.Unmarshal(data, &tags)
+	return tags, err
+}
+
+func saveTags(stateDir string, tags []Tag) error {
+	err := os.MkdirAll(stateDir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(tagsPath(stateDir), data, 0o600)
+}
+
+// tagFilter returns a predicate selecting the snapshots labelled with name
+func tagFilter(stateDir, name string) (func(path string) bool, error) {
+	tags, err := loadTags(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Tag
+	for _, t := range tags {
+		if t.Name == name {
+			matching = append(matching, t)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no snapshots are tagged %q", name)
+	}
+
+	return func(path string) bool {
+		for _, t := range matching {
+			if t.Matches(path) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// parseTimeArg accepts RFC 3339 timestamps as well as plain dates and minutes
+func parseTimeArg(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// runTagCommand implements `tarsnap tag add|list|rm`
+func runTagCommand(config Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: tarsnap tag add|list|rm [options] [name]")
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("tag add", flag.ExitOnError)
+		from := fs.String("from", "", "Start of the tagged time range")
+		to := fs.String("to", "", "End of the tagged time range")
+		snapshot := fs.String("snapshot", "", "Tag a single snapshot file instead of a time range")
+		note := fs.String("note", "", "Free form annotation stored with the tag")
+		fs.Parse(args[1:])
+
+		if fs.NArg() != 1 {
+			return errors.New("usage: tarsnap tag add [--from T] [--to T] [--snapshot FILE] [--note TEXT] name")
+		}
+
+		tag := Tag{Name: fs.Arg(0), Snapshot: *snapshot, Note: *note}
+		if *snapshot == "" && *from == "" && *to == "" {
+			return errors.New("either --snapshot or --from/--to is required")
+		}
+		if *from != "" {
+			t, err := parseTimeArg(*from)
+			if err != nil {
+				return err
+			}
+			tag.From = t
+		}
+		if *to != "" {
+			t, err := parseTimeArg(*to)
+			if err != nil {
+				return err
+			}
+			tag.To = t
+		}
+
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
+
+		tags, err := loadTags(config.StateDir)
+		if err != nil {
+			return err
+		}
+		return saveTags(config.StateDir, append(tags, tag))
+
+	case "list":
+		tags, err := loadTags(config.StateDir)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSNAPSHOT\tFROM\tTO\tNOTE")
+		for _, t := range tags {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, t.Snapshot, formatTagTime(t.From), formatTagTime(t.To), t.Note)
+		}
+		return w.Flush()
+
+	case "rm":
+		if len(args) != 2 {
+			return errors.New("usage: tarsnap tag rm name")
+		}
+
+		unlock, err := acquireRunLock(config.StateDir, config.LockWait)
+		if err != nil {
+			return fmt.Errorf("another run is in progress: %w", err)
+		}
+		defer unlock()
+
+		tags, err := loadTags(config.StateDir)
+		if err != nil {
+			return err
+		}
+
+		var kept []Tag
+		for _, t := range tags {
+			if t.Name != args[1] {
+				kept = append(kept, t)
+			}
+		}
+		return saveTags(config.StateDir, kept)
+
+	default:
+		return fmt.Errorf("unknown tag command %q", args[0])
+	}
+}
+
+func formatTagTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
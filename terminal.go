@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/taylormonacelli/tarsnap/internal/runner"
+)
+
+// stty runs stty against the controlling terminal on stdin
+func stty(args ...string) (string, error) {
+	out, err := runner.Exec{}.Run(runner.Command{Name: "stty", Args: args, Stdin: os.Stdin})
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawTerminal switches stdin to raw mode, without echo, and returns a
+// function restoring the previous settings. It fails when stdin isn't a
+// terminal or there is no stty, as on Windows.
+func rawTerminal() (func(), error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("raw mode needs stty")
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("stdin is not a terminal: %w", err)
+	}
+	_, err = stty("raw", "-echo")
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_, err := stty(saved)
+		if err != nil {
+			_, _ = stty("sane")
+		}
+	}, nil
+}
+
+// terminalSize returns the rows and columns of the terminal on stdin,
+// falling back to 24x80 when stty can't tell
+func terminalSize() (int, int) {
+	out, err := stty("size")
+	if err == nil {
+		var rows, cols int
+		_, err = fmt.Sscan(out, &rows, &cols)
+		if err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+	"github.com/taylormonacelli/tarsnap/internal/schedule"
+)
+
+// toolNameRe matches the tool names that can name a file; the rest are
+// counted as "other"
+var toolNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// assignmentRe matches a FOO=bar variable assignment
+var assignmentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// toolWrappers run the command that follows them
+var toolWrappers = map[string]bool{"sudo": true, "env": true, "time": true, "nohup": true, "exec": true, "command": true}
+
+// toolName returns the binary command runs, such as git for
+// "sudo GIT_TRACE=1 /usr/bin/git push", skipping variable assignments and
+// wrappers like sudo, whatever -normalize already stripped
+func toolName(command string) string {
+	for _, field := range strings.Fields(command) {
+		if assignmentRe.MatchString(field) || toolWrappers[field] || strings.HasPrefix(field, "-") {
+			continue
+		}
+		name := filepath.Base(field)
+		if !toolNameRe.MatchString(name) {
+			return "other"
+		}
+		return name
+	}
+	return ""
+}
+
+// ToolCount is how many distinct commands and runs of a tool the ledger holds
+type ToolCount struct {
+	Tool     string `json:"tool"`
+	Commands int    `json:"commands"`
+	Runs     int    `json:"runs"`
+}
+
+func toolsDir(dataDir string) string {
+	return filepath.Join(dataDir, "tools")
+}
+
+// classifyLedger buckets the ledger entries run on host, or on every host
+// when host is empty, by tool. Each bucket lists its commands once, in the
+// order first seen.
+func classifyLedger(entries []LedgerEntry, host string) (map[string][]string, map[string]*ToolCount) {
+	commands := make(map[string][]string)
+	counts := make(map[string]*ToolCount)
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if host != "" && e.Host != host {
+			continue
+		}
+		tool := toolName(e.Cmd)
+		if tool == "" {
+			continue
+		}
+		c := counts[tool]
+		if c == nil {
+			c = &ToolCount{Tool: tool}
+			counts[tool] = c
+		}
+		c.Runs += e.Count
+		if !seen[e.Cmd] {
+			seen[e.Cmd] = true
+			c.Commands++
+			commands[tool] = append(commands[tool], e.Cmd)
+		}
+	}
+	return commands, counts
+}
+
+// rankTools orders counts by descending runs
+func rankTools(counts map[string]*ToolCount) []ToolCount {
+	runs := make(map[string]int, len(counts))
+	for tool, c := range counts {
+		runs[tool] = c.Runs
+	}
+	var ranked []ToolCount
+	for _, tool := range rankCounts(runs) {
+		ranked = append(ranked, *counts[tool])
+	}
+	return ranked
+}
+
+// writeToolSummaries writes tools/<tool>.txt in dataDir with every command
+// of that tool, tools/<host>/<tool>.txt with those run on each host, and a
+// _counts.txt next to each set, from the ledger entries the summaries keep
+func writeToolSummaries(dataDir string, entries []LedgerEntry) error {
+	hosts := map[string]bool{"": true}
+	for _, e := range entries {
+		hosts[e.Host] = true
+	}
+	for host := range hosts {
+		dir := toolsDir(dataDir)
+		if host != "" {
+			dir = filepath.Join(dir, schedule.SanitizeHost(host))
+		}
+		err := os.MkdirAll(dir, 0o700)
+		if err != nil {
+			return err
+		}
+
+		commands, counts := classifyLedger(entries, host)
+		for tool, cmds := range commands {
+			err = history.WriteFile(filepath.Join(dir, tool+".txt"), []byte(strings.Join(cmds, "\n")+"\n"), 0o600)
+			if err != nil {
+				return err
+			}
+		}
+
+		var buf bytes.Buffer
+		err = printToolCounts(&buf, rankTools(counts))
+		if err != nil {
+			return err
+		}
+		err = history.WriteFile(filepath.Join(dir, "_counts.txt"), buf.Bytes(), 0o600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printToolCounts(w io.Writer, counts []ToolCount) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOOL\tCOMMANDS\tRUNS")
+	for _, c := range counts {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", c.Tool, c.Commands, c.Runs)
+	}
+	return tw.Flush()
+}
+
+// runToolsCommand implements `tarsnap tools [tool]`: without a tool it
+// prints how many commands and runs each tool has, with one it prints every
+// command of that tool, such as every kubectl invocation run on -host
+func runToolsCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("tools", flag.ExitOnError)
+	host := fs.String("host", config.Host, "Only count commands run on this host")
+	fs.Parse(args)
+
+	filter, err := newCommandFilter(config)
+	if err != nil {
+		return err
+	}
+	ledger, err := loadLedger(ledgerPath(config.DataDir))
+	if err != nil {
+		return err
+	}
+	commands, counts := classifyLedger(ledger.Kept(filter), *host)
+
+	if tool := fs.Arg(0); tool != "" {
+		if config.Output == "json" {
+			return writeJSON(os.Stdout, commands[tool])
+		}
+		for _, cmd := range commands[tool] {
+			fmt.Println(cmd)
+		}
+		return nil
+	}
+
+	ranked := rankTools(counts)
+	if config.Output == "json" {
+		return writeJSON(os.Stdout, ranked)
+	}
+	return printToolCounts(os.Stdout, ranked)
+}
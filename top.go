@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taylormonacelli/tarsnap/internal/history"
+)
+
+// commandFrequencies counts how often each command was run. Every snapshot
+// is a full copy of a remote history file, so per host and user a command's
+// count is the most times it appears in any one snapshot rather than the
+// sum over snapshots. Entries outside [from, to] are skipped; entries
+// without their own timestamp use the time of the snapshot.
+func commandFrequencies(dataDir string, from, to time.Time) (map[string]int, error) {
+	streams := make(map[string]map[string]int)
+
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !history.IsSnapshotFile(path) {
+			return nil
+		}
+
+		taken, _ := history.SnapshotTime(path)
+		_, lines, err := history.ReadLines(path)
+		if err != nil {
+			return err
+		}
+
+		counts := make(map[string]int)
+		for _, line := range lines {
+			entry := history.ParseLine(line)
+			when := entry.Timestamp
+			if when.IsZero() {
+				when = taken
+			}
+			if !from.IsZero() && when.Before(from) {
+				continue
+			}
+			if !to.IsZero() && when.After(to) {
+				continue
+			}
+			counts[entry.Command]++
+		}
+
+		key := filepath.Dir(path) + "\x00" + snapshotHost(path)
+		if streams[key] == nil {
+			streams[key] = make(map[string]int)
+		}
+		for command, n := range counts {
+			if n > streams[key][command] {
+				streams[key][command] = n
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total := make(map[string]int)
+	for _, counts := range streams {
+		for command, n := range counts {
+			total[command] += n
+		}
+	}
+	return total, nil
+}
+
+// rankCounts returns the keys of counts ordered by descending count
+func rankCounts(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func printRanking(w io.Writer, title string, counts map[string]int, limit int) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "RANK\tCOUNT\t%s\n", title)
+	for i, k := range rankCounts(counts) {
+		if limit > 0 && i >= limit {
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\n", i+1, counts[k], k)
+	}
+	return tw.Flush()
+}
+
+// runTopCommand implements `tarsnap top`
+func runTopCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	limit := fs.Int("n", 20, "Number of entries to show in each table; 0 shows all")
+	fromArg := fs.String("from", "", "Only count commands run at or after this time")
+	toArg := fs.String("to", "", "Only count commands run at or before this time")
+	fs.Parse(args)
+
+	var from, to time.Time
+	var err error
+	if *fromArg != "" {
+		from, err = parseTimeArg(*fromArg)
+		if err != nil {
+			return err
+		}
+	}
+	if *toArg != "" {
+		to, err = parseTimeArg(*toArg)
+		if err != nil {
+			return err
+		}
+	}
+
+	commands, err := commandFrequencies(config.DataDir, from, to)
+	if err != nil {
+		return err
+	}
+
+	binaries := make(map[string]int)
+	for command, n := range commands {
+		if name := commandName(command); name != "" {
+			binaries[name] += n
+		}
+	}
+
+	err = printRanking(os.Stdout, "BINARY", binaries, *limit)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	return printRanking(os.Stdout, "COMMAND", commands, *limit)
+}
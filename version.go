@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set by goreleaser with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=..."; go install builds fall back to the module build info
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// BuildInfo identifies the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildInfo returns what the linker flags say about the binary, filled in
+// from the build info Go embeds where they're missing
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+
+	bi, ok := debug.ReadBuildInfo()
+	if ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+// printVersion implements `tarsnap version`
+func printVersion(w io.Writer, output string) error {
+	info := buildInfo()
+	if output == "json" {
+		return writeJSON(w, info)
+	}
+
+	fmt.Fprintf(w, "tarsnap %s\n", info.Version)
+	if info.Commit != "" {
+		modified := ""
+		if info.Modified {
+			modified = " (modified)"
+		}
+		fmt.Fprintf(w, "commit: %s%s\n", info.Commit, modified)
+	}
+	if info.Date != "" {
+		fmt.Fprintf(w, "built:  %s\n", info.Date)
+	}
+	fmt.Fprintf(w, "go:     %s %s/%s\n", info.GoVersion, runtime.GOOS, runtime.GOARCH)
+	return nil
+}